@@ -87,8 +87,10 @@ internal class GoContractWriter : ContractWriter
         }
         else
         {
-            // Derived type interfaces will be generated along with the base type.
-            if (type.BaseType != null && type.BaseType.Name != nameof(Object))
+            // Types derived from an abstract base type will be generated along with the
+            // base type. Types derived from a concrete base type embed the base type.
+            if (type.BaseType != null && type.BaseType.Name != nameof(Object) &&
+                type.BaseType.IsAbstract)
             {
                 return false;
             }
@@ -118,9 +120,18 @@ internal class GoContractWriter : ContractWriter
         s.Append(FormatDocComment(type.GetDocumentationCommentXml(), ""));
         s.Append($"type {type.Name} struct {{");
 
-        var derivedTypes = allTypes.Where(
+        // An abstract base type embeds its derived types, so that any endpoint can be read
+        // into the base type. A concrete base type is embedded in its derived types instead.
+        var derivedTypes = !type.IsAbstract ? Array.Empty<ITypeSymbol>() : allTypes.Where(
             (t) => SymbolEqualityComparer.Default.Equals(t.BaseType, type)).ToArray();
 
+        if (type.BaseType != null && type.BaseType.Name != nameof(Object) &&
+            !type.BaseType.IsAbstract)
+        {
+            s.AppendLine();
+            s.AppendLine($"	{type.BaseType.Name}");
+        }
+
         var properties = type.GetMembers()
             .OfType<IPropertySymbol>()
             .Where((p) => !p.IsStatic)
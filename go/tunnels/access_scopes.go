@@ -3,7 +3,11 @@
 
 package tunnels
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 var (
 	allScopes = map[TunnelAccessScope]bool{
@@ -43,3 +47,58 @@ func scopeContains(s []TunnelAccessScope, e TunnelAccessScope) bool {
 	}
 	return false
 }
+
+// AvailableScopes returns the scopes of the tunnel's access tokens. A token may be
+// keyed by several space-delimited scopes, such as "host connect"; each is returned
+// separately, in sorted order.
+func (t *Tunnel) AvailableScopes() TunnelAccessScopes {
+	return accessTokenScopes(t.AccessTokens)
+}
+
+// AccessToken returns the tunnel's access token for scope, including a token keyed by
+// several space-delimited scopes that include scope.
+func (t *Tunnel) AccessToken(scope TunnelAccessScope) (string, bool) {
+	return accessTokenForScope(t.AccessTokens, scope)
+}
+
+// AvailableScopes returns the scopes of the port's access tokens. A token may be
+// keyed by several space-delimited scopes, such as "host connect"; each is returned
+// separately, in sorted order.
+func (tp *TunnelPort) AvailableScopes() TunnelAccessScopes {
+	return accessTokenScopes(tp.AccessTokens)
+}
+
+// AccessToken returns the port's access token for scope, including a token keyed by
+// several space-delimited scopes that include scope.
+func (tp *TunnelPort) AccessToken(scope TunnelAccessScope) (string, bool) {
+	return accessTokenForScope(tp.AccessTokens, scope)
+}
+
+func accessTokenScopes(accessTokens map[TunnelAccessScope]string) TunnelAccessScopes {
+	found := make(map[TunnelAccessScope]bool)
+	var scopes TunnelAccessScopes
+	for key := range accessTokens {
+		for _, scope := range strings.Fields(string(key)) {
+			if !found[TunnelAccessScope(scope)] {
+				found[TunnelAccessScope(scope)] = true
+				scopes = append(scopes, TunnelAccessScope(scope))
+			}
+		}
+	}
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i] < scopes[j] })
+	return scopes
+}
+
+func accessTokenForScope(accessTokens map[TunnelAccessScope]string, scope TunnelAccessScope) (string, bool) {
+	if token, ok := accessTokens[scope]; ok {
+		return token, true
+	}
+	for key, token := range accessTokens {
+		for _, s := range strings.Fields(string(key)) {
+			if TunnelAccessScope(s) == scope {
+				return token, true
+			}
+		}
+	}
+	return "", false
+}
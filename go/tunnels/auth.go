@@ -0,0 +1,40 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import "net/url"
+
+// AuthHeaderForGitHub returns the authorization header value for a GitHub user access token,
+// for a token provider to return. The GitHub app client ID for the service environment is
+// in TunnelServiceProperties.GitHubAppClientID.
+func AuthHeaderForGitHub(token string) string {
+	if token == "" {
+		return ""
+	}
+	return string(TunnelAuthenticationSchemeGitHub) + " " + token
+}
+
+// AuthHeaderForAAD returns the authorization header value for an AAD or Microsoft account
+// access token, for a token provider to return. The token audience for the service
+// environment is in TunnelServiceProperties.ServiceAppID.
+func AuthHeaderForAAD(token string) string {
+	if token == "" {
+		return ""
+	}
+	return "Bearer " + token
+}
+
+// ServicePropertiesForURL returns the properties of the service environment at u, such as
+// the app IDs clients authenticate with. Returns false if u is not the URL of a known
+// environment.
+func ServicePropertiesForURL(u *url.URL) (TunnelServiceProperties, bool) {
+	if u != nil {
+		for _, properties := range []TunnelServiceProperties{ServiceProperties, PpeServiceProperties, DevServiceProperties} {
+			if serviceURL, err := url.Parse(properties.ServiceURI); err == nil && serviceURL.Host == u.Host {
+				return properties, true
+			}
+		}
+	}
+	return TunnelServiceProperties{}, false
+}
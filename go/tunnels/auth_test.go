@@ -0,0 +1,54 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestAuthHeaders(t *testing.T) {
+	if header := AuthHeaderForGitHub("gh-token"); header != "github gh-token" {
+		t.Errorf("unexpected GitHub header %q", header)
+	}
+	if header := AuthHeaderForAAD("aad-token"); header != "Bearer aad-token" {
+		t.Errorf("unexpected AAD header %q", header)
+	}
+	if header := AuthHeaderForAAD(""); header != "" {
+		t.Errorf("expected no header without a token, got %q", header)
+	}
+}
+
+func TestServicePropertiesForURL(t *testing.T) {
+	for _, test := range []struct {
+		url         string
+		appID       string
+		gitHubAppID string
+	}{
+		{"https://global.rel.tunnels.api.visualstudio.com/", prodFirstPartyAppID, prodGitHubAppClientID},
+		{"https://global.rel.tunnels.ppe.api.visualstudio.com/api/v1", nonProdFirstPartyAppID, nonProdGitHubAppClientID},
+		{"https://global.ci.tunnels.dev.api.visualstudio.com", nonProdFirstPartyAppID, nonProdGitHubAppClientID},
+	} {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		properties, ok := ServicePropertiesForURL(u)
+		if !ok {
+			t.Errorf("expected %s to be a known environment", test.url)
+			continue
+		}
+		if properties.ServiceAppID != test.appID || properties.GitHubAppClientID != test.gitHubAppID {
+			t.Errorf("unexpected app IDs for %s: %+v", test.url, properties)
+		}
+	}
+
+	u, err := url.Parse("https://tunnels.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ServicePropertiesForURL(u); ok {
+		t.Errorf("expected %s not to be a known environment", u)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// batchPortsConcurrency is the number of port requests CreateTunnelPorts and
+// DeleteAllTunnelPorts send at the same time.
+const batchPortsConcurrency = 8
+
+// PortErrors is returned by DeleteAllTunnelPorts with the error for each port that was
+// not deleted, by port number.
+type PortErrors map[uint16]error
+
+func (e PortErrors) Error() string {
+	ports := make([]int, 0, len(e))
+	for port := range e {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+
+	messages := make([]string, len(ports))
+	for i, port := range ports {
+		messages[i] = fmt.Sprintf("port %d: %v", port, e[uint16(port)])
+	}
+	return strings.Join(messages, "; ")
+}
+
+// CreateTunnelPorts creates the ports on the tunnel, sending the requests for several ports
+// at a time. If failFast is true, no more requests are sent after a port fails, and the
+// ports that were not created have the error of the context. The ports that are created
+// are updated in tunnel.Ports.
+// Returns the created ports in the order of ports, with nil for each port that was not
+// created, and the errors for the ports that were not created, or nil if all were created.
+func (m *Manager) CreateTunnelPorts(
+	ctx context.Context, tunnel *Tunnel, ports []*TunnelPort, failFast bool, options *TunnelRequestOptions,
+) ([]*TunnelPort, map[*TunnelPort]error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		errs map[*TunnelPort]error
+		wg   sync.WaitGroup
+	)
+	setErr := func(port *TunnelPort, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errs == nil {
+			errs = make(map[*TunnelPort]error)
+		}
+		errs[port] = err
+		if failFast {
+			cancel()
+		}
+	}
+
+	created := make([]*TunnelPort, len(ports))
+	sem := make(chan struct{}, batchPortsConcurrency)
+	for i, port := range ports {
+		if port == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, port *TunnelPort) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				setErr(port, ctx.Err())
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				setErr(port, err)
+				return
+			}
+
+			// CreateTunnelPort updates the ports of the tunnel it is passed, so give each
+			// request its own copy and update the tunnel once all requests are done.
+			requestTunnel := *tunnel
+			requestTunnel.Ports = nil
+			tp, err := m.CreateTunnelPort(ctx, &requestTunnel, port, options)
+			if err != nil {
+				setErr(port, err)
+				return
+			}
+			created[i] = tp
+		}(i, port)
+	}
+	wg.Wait()
+
+	for _, tp := range created {
+		if tp == nil {
+			continue
+		}
+		newPorts := make([]TunnelPort, 0, len(tunnel.Ports)+1)
+		for _, p := range tunnel.Ports {
+			if p.PortNumber != tp.PortNumber {
+				newPorts = append(newPorts, p)
+			}
+		}
+		tunnel.Ports = append(newPorts, *tp)
+	}
+	return created, errs
+}
+
+// DeleteAllTunnelPorts deletes the ports in tunnel.Ports, sending the requests for several
+// ports at a time. If listPorts is true, the ports of the tunnel are listed first, so that
+// ports missing from a stale tunnel.Ports are also deleted. The ports that are deleted are
+// removed from tunnel.Ports, which is empty once all ports are deleted.
+// Returns PortErrors with the error for each port that was not deleted, or an error if
+// listing the ports fails.
+func (m *Manager) DeleteAllTunnelPorts(
+	ctx context.Context, tunnel *Tunnel, listPorts bool, options *TunnelRequestOptions,
+) error {
+	if tunnel == nil {
+		return ErrNoTunnel
+	}
+	if listPorts {
+		ports, err := m.ListTunnelPorts(ctx, tunnel, options)
+		if err != nil {
+			return fmt.Errorf("error listing tunnel ports: %w", err)
+		}
+		tunnel.Ports = make([]TunnelPort, len(ports))
+		for i, port := range ports {
+			tunnel.Ports[i] = *port
+		}
+	}
+
+	var (
+		mu   sync.Mutex
+		errs PortErrors
+		wg   sync.WaitGroup
+	)
+	sem := make(chan struct{}, batchPortsConcurrency)
+	for _, port := range tunnel.Ports {
+		wg.Add(1)
+		go func(portNumber uint16) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// DeleteTunnelPort updates the ports of the tunnel it is passed, so give each
+			// request its own copy and update the tunnel once all requests are done.
+			requestTunnel := *tunnel
+			requestTunnel.Ports = nil
+			if err := m.DeleteTunnelPort(ctx, &requestTunnel, portNumber, options); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if errs == nil {
+					errs = make(PortErrors)
+				}
+				errs[portNumber] = err
+			}
+		}(port.PortNumber)
+	}
+	wg.Wait()
+
+	var remaining []TunnelPort
+	for _, port := range tunnel.Ports {
+		if _, failed := errs[port.PortNumber]; failed {
+			remaining = append(remaining, port)
+		}
+	}
+	tunnel.Ports = remaining
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
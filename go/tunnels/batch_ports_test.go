@@ -0,0 +1,131 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCreateTunnelPorts(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		var port TunnelPort
+		if err := json.NewDecoder(r.Body).Decode(&port); err != nil {
+			t.Error(err)
+		}
+		if port.PortNumber == 9999 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, port)
+	})
+	defer done()
+
+	tunnel := &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2", Ports: []TunnelPort{{PortNumber: 22}}}
+	ports := []*TunnelPort{{PortNumber: 80}, {PortNumber: 9999}, {PortNumber: 443}}
+	created, errs := managementClient.CreateTunnelPorts(ctx, tunnel, ports, false, &TunnelRequestOptions{})
+
+	if len(errs) != 1 || errs[ports[1]] == nil {
+		t.Errorf("expected only port 9999 to fail, got %v", errs)
+	}
+	if len(created) != 3 || created[0].PortNumber != 80 || created[1] != nil || created[2].PortNumber != 443 {
+		t.Errorf("unexpected created ports %v", created)
+	}
+	numbers := make(map[uint16]bool)
+	for _, p := range tunnel.Ports {
+		numbers[p.PortNumber] = true
+	}
+	if len(tunnel.Ports) != 3 || !numbers[22] || !numbers[80] || !numbers[443] {
+		t.Errorf("expected the created ports to be added to the tunnel, got %v", tunnel.Ports)
+	}
+}
+
+func TestCreateTunnelPortsFailFast(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		var port TunnelPort
+		if err := json.NewDecoder(r.Body).Decode(&port); err != nil {
+			t.Error(err)
+		}
+		// Fail the first request, and hold the others until they are cancelled.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	})
+	defer done()
+	defer close(release)
+
+	tunnel := &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}
+	ports := make([]*TunnelPort, 3*batchPortsConcurrency)
+	for i := range ports {
+		ports[i] = &TunnelPort{PortNumber: uint16(i + 1)}
+	}
+	_, errs := managementClient.CreateTunnelPorts(ctx, tunnel, ports, true, &TunnelRequestOptions{})
+
+	if len(errs) != len(ports) {
+		t.Errorf("expected all ports to fail, got %d errors", len(errs))
+	}
+	if n := atomic.LoadInt32(&requests); int(n) >= len(ports) {
+		t.Errorf("expected requests to stop after the first error, got %d requests", n)
+	}
+	if len(tunnel.Ports) != 0 {
+		t.Errorf("expected no ports to be added, got %v", tunnel.Ports)
+	}
+}
+
+func TestDeleteAllTunnelPorts(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeJSON(w, []TunnelPort{{PortNumber: 22}, {PortNumber: 80}, {PortNumber: 9999}})
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/9999") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		deleted = append(deleted, path.Base(r.URL.Path))
+	})
+	defer done()
+
+	// The local ports are stale, so the ports are listed first.
+	tunnel := &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2", Ports: []TunnelPort{{PortNumber: 22}}}
+	err := managementClient.DeleteAllTunnelPorts(ctx, tunnel, true, &TunnelRequestOptions{})
+
+	var errs PortErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[9999] == nil {
+		t.Errorf("expected only port 9999 to fail, got %v", err)
+	}
+	sort.Strings(deleted)
+	if len(deleted) != 2 || deleted[0] != "22" || deleted[1] != "80" {
+		t.Errorf("expected ports 22 and 80 to be deleted, got %v", deleted)
+	}
+	if len(tunnel.Ports) != 1 || tunnel.Ports[0].PortNumber != 9999 {
+		t.Errorf("expected only the port that failed to remain, got %v", tunnel.Ports)
+	}
+
+	tunnel = &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2", Ports: []TunnelPort{{PortNumber: 22}, {PortNumber: 80}}}
+	if err := managementClient.DeleteAllTunnelPorts(ctx, tunnel, false, &TunnelRequestOptions{}); err != nil {
+		t.Errorf("expected all ports to be deleted, got %v", err)
+	}
+	if len(tunnel.Ports) != 0 {
+		t.Errorf("expected no ports to remain, got %v", tunnel.Ports)
+	}
+}
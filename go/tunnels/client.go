@@ -5,12 +5,17 @@ package tunnels
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"net/http"
 
@@ -21,20 +26,225 @@ import (
 
 const (
 	clientWebSocketSubProtocol = "tunnel-relay-client"
+
+	defaultSSHHandshakeRetries = 2
+	sshHandshakeRetryDelay     = 250 * time.Millisecond
+	defaultRelayWriteTimeout   = 60 * time.Second
+	defaultRelayConnectRetries = 2
+	relayConnectRetryDelay     = 500 * time.Millisecond
+
+	portReachableRetryDelay = 250 * time.Millisecond
 )
 
 // Client is a client for a tunnel. It is used to connect to a tunnel.
 type Client struct {
-	logger *log.Logger
+	logger Logger
 
 	hostID    string
 	tunnel    *Tunnel
 	endpoints []TunnelEndpoint
 
+	sshMu                sync.Mutex
 	ssh                  *tunnelssh.ClientSSHSession
+	closed               bool
 	remoteForwardedPorts *remoteForwardedPorts
+	connections          *forwardedConnections
 
 	acceptLocalConnectionsForForwardedPorts bool
+	localBindAddress                        net.IP
+	localPorts                              map[uint16]uint16
+	localListenerObserver                   func(remotePort uint16, localAddr net.Addr)
+
+	sshHandshakeRetries int
+	relayConnectRetries int
+	relayWriteTimeout   time.Duration
+	endpointPriority    func(TunnelEndpoint) int
+
+	relayResolver          Resolver
+	relayLocalAddr         net.IP
+	relayTLSConfig         *tls.Config
+	relayServerName        string
+	relayProxyURL          *url.URL
+	relayVerifyCertificate func(tls.ConnectionState) error
+
+	hostCertificateAuthorities []ssh.PublicKey
+	hostPublicKeys             []string
+	skipHostKeyVerification    bool
+
+	forwardTLS *ForwardTLS
+
+	copyBuffers *tunnelssh.CopyBufferPool
+	halfClose   bool
+
+	metrics MetricsRecorder
+
+	transferObserver TransferObserver
+	transferInterval time.Duration
+	transfers        portTransfers
+
+	reconnectPolicy *ReconnectPolicy
+	reconnectEvents chan ReconnectEvent
+	reconnecting    bool
+
+	connectionEventsMu     sync.Mutex
+	connectionEvents       chan ConnectionEvent
+	connectionEventsClosed bool
+}
+
+// ClientOption configures optional behavior of a Client.
+type ClientOption func(*Client)
+
+// WithSSHHandshakeRetries sets the number of times the SSH handshake is retried when
+// the relay connection is established but the handshake fails, for example while the
+// relay is handing off the connection. Each retry dials a new relay connection.
+func WithSSHHandshakeRetries(retries int) ClientOption {
+	return func(c *Client) {
+		if retries >= 0 {
+			c.sshHandshakeRetries = retries
+		}
+	}
+}
+
+// WithEndpointPriority sets a function that ranks the client relay endpoints of the host,
+// so that endpoints with a higher priority are tried first. Endpoints with equal priority
+// keep the order in which the service returned them, which is also the order used when
+// this option is not set.
+func WithEndpointPriority(priority func(endpoint TunnelEndpoint) int) ClientOption {
+	return func(c *Client) {
+		c.endpointPriority = priority
+	}
+}
+
+// WithRelayConnectRetries sets the number of times connecting to the relay is retried
+// when the relay rejects the connection with a retryable status, such as 429 Too Many
+// Requests or 503 Service Unavailable. Authentication failures are never retried.
+func WithRelayConnectRetries(retries int) ClientOption {
+	return func(c *Client) {
+		if retries >= 0 {
+			c.relayConnectRetries = retries
+		}
+	}
+}
+
+// WithRelayWriteTimeout sets how long a write to the relay connection may block before
+// it fails with ErrRelayWriteTimeout, which closes the SSH session instead of letting it
+// stall when the relay stops reading. A timeout of zero disables the limit.
+func WithRelayWriteTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if timeout >= 0 {
+			c.relayWriteTimeout = timeout
+		}
+	}
+}
+
+// WithRelayLocalAddr binds the relay connection to the local address ip, so that it
+// leaves through the network interface that has that address. NewClient returns an
+// error if ip is not assigned to this machine.
+func WithRelayLocalAddr(ip net.IP) ClientOption {
+	return func(c *Client) {
+		c.relayLocalAddr = ip
+	}
+}
+
+// WithLocalBindAddress makes the listeners for forwarded ports bind to ip when the
+// client accepts local connections for forwarded ports. By default they bind to the
+// loopback address 127.0.0.1, so that forwarded ports are not exposed to the network;
+// use net.IPv4zero to accept connections on all interfaces.
+func WithLocalBindAddress(ip net.IP) ClientOption {
+	return func(c *Client) {
+		c.localBindAddress = ip
+	}
+}
+
+// WithLocalPortMapping makes the client listen on the local port mapped to each host
+// port in ports, instead of choosing a free local port near the host port number.
+// Forwarding a mapped port fails if its local port is in use.
+func WithLocalPortMapping(ports map[uint16]uint16) ClientOption {
+	return func(c *Client) {
+		c.localPorts = make(map[uint16]uint16, len(ports))
+		for remotePort, localPort := range ports {
+			c.localPorts[remotePort] = localPort
+		}
+	}
+}
+
+// WithLocalListenerObserver sets a function that is called with the local address the
+// client listens on for each forwarded host port, so that callers know where to connect.
+// It is called from the goroutine that accepts local connections for the port.
+func WithLocalListenerObserver(observer func(remotePort uint16, localAddr net.Addr)) ClientOption {
+	return func(c *Client) {
+		c.localListenerObserver = observer
+	}
+}
+
+// WithCopyBufferSize makes connections to forwarded ports copy data through buffers of
+// size bytes that are reused across connections, instead of allocating buffers for each
+// connection. This bounds memory use when many connections are forwarded at once.
+func WithCopyBufferSize(size int) ClientOption {
+	return func(c *Client) {
+		if size > 0 {
+			c.copyBuffers = tunnelssh.NewCopyBufferPool(size)
+		}
+	}
+}
+
+// WithHalfClose makes connections to forwarded ports close each direction separately.
+// When the local side closes its write direction, or ends, the client sends EOF to the
+// remote port and keeps reading its response. When the remote port sends EOF the client
+// closes the write direction of the local connection, if it has a CloseWrite() error
+// method as *net.TCPConn and streams from ConnectToForwardedPort do. By default both
+// directions are closed together when both are done.
+func WithHalfClose() ClientOption {
+	return func(c *Client) {
+		c.halfClose = true
+	}
+}
+
+// WithProxyURL makes the client connect to the relay through the proxy at proxyURL, an
+// HTTP CONNECT proxy with the http scheme or a SOCKS5 proxy with the socks5 scheme,
+// instead of the proxy configured by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables. User info in the URL is used to authenticate with the proxy. NewClient
+// returns an error for other schemes.
+func WithProxyURL(proxyURL *url.URL) ClientOption {
+	return func(c *Client) {
+		c.relayProxyURL = proxyURL
+	}
+}
+
+// WithRelayResolver sets the resolver used to resolve the relay host name,
+// instead of the system resolver.
+func WithRelayResolver(resolver Resolver) ClientOption {
+	return func(c *Client) {
+		c.relayResolver = resolver
+	}
+}
+
+// WithRelayTLSConfig sets the base TLS configuration used to connect to the relay,
+// for example to trust additional root certificates, or to pin the root certificate
+// authorities trusted for the devtunnels.ms certificate with RootCAs. The configuration
+// is cloned and is not modified.
+func WithRelayTLSConfig(config *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.relayTLSConfig = config
+	}
+}
+
+// WithRelayServerName sets the host name the relay's TLS certificate must be valid for,
+// instead of the host name in the client relay URI. A certificate that does not match
+// the expected name fails the connection, which detects relay connections that are
+// misrouted by a proxy.
+func WithRelayServerName(serverName string) ClientOption {
+	return func(c *Client) {
+		c.relayServerName = serverName
+	}
+}
+
+// WithRelayCertificateVerifier sets a callback that is called after the relay's TLS
+// certificate has been verified. Returning an error from verify fails the connection.
+func WithRelayCertificateVerifier(verify func(tls.ConnectionState) error) ClientOption {
+	return func(c *Client) {
+		c.relayVerifyCertificate = verify
+	}
 }
 
 var (
@@ -53,15 +263,30 @@ var (
 	// ErrNoRelayConnections is returned when no relay connections are available.
 	ErrNoRelayConnections = errors.New("the host is not currently accepting tunnel relay connections")
 
+	// ErrNoTransport is returned when a nil transport is provided to ConnectWithTransport.
+	ErrNoTransport = errors.New("transport cannot be nil")
+
+	// ErrNoClientEndpoint is returned when the selected tunnel endpoint does not have a
+	// client relay URI that a client can connect to.
+	ErrNoClientEndpoint = errors.New("the tunnel endpoint does not have a valid client relay uri")
+
 	// ErrSSHConnectionClosed is returned when the ssh connection is closed.
 	ErrSSHConnectionClosed = errors.New("the ssh connection is closed")
 
 	// ErrPortNotForwarded is returned when the specified port is not forwarded.
 	ErrPortNotForwarded = errors.New("the port is not forwarded")
+
+	// ErrPortUnreachable is returned when a forwarded port does not accept connections
+	// before the context passed to WaitForPortReachable is done.
+	ErrPortUnreachable = errors.New("the forwarded port is not reachable")
+
+	// ErrConnectionNotFound is returned when the specified forwarded connection does not exist.
+	ErrConnectionNotFound = errors.New("the forwarded connection was not found")
 )
 
-// Connect connects to a tunnel and returns a connected client.
-func NewClient(logger *log.Logger, tunnel *Tunnel, acceptLocalConnectionsForForwardedPorts bool) (*Client, error) {
+// NewClient creates a client for the tunnel that logs to logger; use WithLogger to log
+// with a structured logger instead.
+func NewClient(logger *log.Logger, tunnel *Tunnel, acceptLocalConnectionsForForwardedPorts bool, opts ...ClientOption) (*Client, error) {
 	if tunnel == nil {
 		return nil, ErrNoTunnel
 	}
@@ -71,15 +296,44 @@ func NewClient(logger *log.Logger, tunnel *Tunnel, acceptLocalConnectionsForForw
 	}
 
 	c := &Client{
-		logger:                                  logger,
+		logger:                                  NewStdLogger(logger),
 		tunnel:                                  tunnel,
 		endpoints:                               tunnel.Endpoints,
 		remoteForwardedPorts:                    newRemoteForwardedPorts(),
+		connections:                             newForwardedConnections(),
 		acceptLocalConnectionsForForwardedPorts: acceptLocalConnectionsForForwardedPorts,
+		sshHandshakeRetries:                     defaultSSHHandshakeRetries,
+		relayConnectRetries:                     defaultRelayConnectRetries,
+		relayWriteTimeout:                       defaultRelayWriteTimeout,
+		connectionEvents:                        make(chan ConnectionEvent, notificationBufferSize),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.remoteForwardedPorts.metrics = c.metrics
+	if c.reconnectPolicy != nil {
+		c.reconnectEvents = make(chan ReconnectEvent, notificationBufferSize)
+	}
+	if c.relayLocalAddr != nil {
+		if _, err := localTCPAddr(c.relayLocalAddr); err != nil {
+			return nil, err
+		}
+	}
+	if c.relayProxyURL != nil && c.relayProxyURL.Scheme != "http" && c.relayProxyURL.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected http or socks5", c.relayProxyURL.Scheme)
 	}
 	return c, nil
 }
 
+// Connect connects to the host with ID hostID through the relay endpoints of the tunnel,
+// trying endpoints with a higher priority first. If hostID is empty, the tunnel must have
+// a single host.
+//
+// The relay connection is authorized with the connect access token of the tunnel. A
+// tunnel whose access control allows anonymous connections, with an entry of type
+// TunnelAccessControlEntryTypeAnonymous for the connect scope, may have no connect
+// token; the client then connects without an Authorization header. Other tunnels reject
+// connections without a token.
 func (c *Client) Connect(ctx context.Context, hostID string) error {
 	endpointGroups := make(map[string][]TunnelEndpoint)
 	for _, endpoint := range c.tunnel.Endpoints {
@@ -98,18 +352,62 @@ func (c *Client) Connect(ctx context.Context, hostID string) error {
 		return ErrMultipleHosts
 	} else {
 		endpointGroup = endpointGroups[c.tunnel.Endpoints[0].HostID]
+		c.hostID = c.tunnel.Endpoints[0].HostID
 	}
 
-	if len(c.endpoints) != 1 {
-		return ErrNoRelayConnections
+	c.hostPublicKeys = hostPublicKeys(endpointGroup, c.hostID)
+
+	var clientRelayURIs []string
+	for _, endpoint := range c.sortEndpointsByPriority(endpointGroup) {
+		if !isValidClientRelayURI(endpoint.ClientRelayURI) {
+			continue
+		}
+		clientRelayURIs = append(clientRelayURIs, endpoint.ClientRelayURI)
 	}
-	tunnelEndpoint := endpointGroup[0]
-	clientRelayURI := tunnelEndpoint.ClientRelayURI
+	if len(clientRelayURIs) == 0 {
+		return ErrNoClientEndpoint
+	}
+
+	var err error
+	for _, clientRelayURI := range clientRelayURIs {
+		c.sendConnectionEvent(ConnectionStateConnecting, clientRelayURI, nil)
+		err = c.connectToRelay(ctx, clientRelayURI)
+		if err == nil {
+			c.sendConnectionEvent(ConnectionStateConnected, clientRelayURI, nil)
+			if c.reconnectPolicy != nil {
+				c.startReconnecting(ctx, clientRelayURI)
+			} else {
+				go c.watchConnection(c.session(), clientRelayURI)
+			}
+			return nil
+		}
+		c.sendConnectionEvent(ConnectionStateDisconnected, clientRelayURI, err)
+		if ctx.Err() != nil {
+			return err
+		}
+		c.logger.Warn("Failed to connect to client relay", "uri", clientRelayURI, "error", err)
+	}
+	return err
+}
 
-	accessToken := c.tunnel.AccessTokens[TunnelAccessScopeConnect]
+// sortEndpointsByPriority returns a copy of the endpoints ordered from the highest to the
+// lowest priority set with WithEndpointPriority. The relative order of endpoints with
+// equal priority is preserved.
+func (c *Client) sortEndpointsByPriority(endpoints []TunnelEndpoint) []TunnelEndpoint {
+	sorted := make([]TunnelEndpoint, len(endpoints))
+	copy(sorted, endpoints)
+	if c.endpointPriority == nil {
+		return sorted
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return c.endpointPriority(sorted[i]) > c.endpointPriority(sorted[j])
+	})
+	return sorted
+}
+
+func (c *Client) connectToRelay(ctx context.Context, clientRelayURI string) error {
+	accessToken, _ := c.tunnel.AccessToken(TunnelAccessScopeConnect)
 
-	c.logger.Printf(fmt.Sprintf("Connecting to client tunnel relay %s", clientRelayURI))
-	c.logger.Printf(fmt.Sprintf("Sec-Websocket-Protocol: %s", clientWebSocketSubProtocol))
 	protocols := []string{clientWebSocketSubProtocol}
 
 	var headers http.Header
@@ -119,30 +417,212 @@ func (c *Client) Connect(ctx context.Context, hostID string) error {
 			accessToken = fmt.Sprintf("Tunnel %s", accessToken)
 		}
 		headers.Add("Authorization", accessToken)
-		c.logger.Printf(fmt.Sprintf("Authorization: %s", accessToken))
+	}
+	c.logger.Debug("Connecting to client tunnel relay",
+		"uri", clientRelayURI,
+		"protocol", clientWebSocketSubProtocol,
+		"auth", authorizationFingerprint(accessToken),
+	)
+
+	connectRetries, handshakeRetries := 0, 0
+	for {
+		sock := newSocket(clientRelayURI, protocols, headers, c.relayClientTLSConfig())
+		sock.writeTimeout = c.relayWriteTimeout
+		sock.resolver = c.relayResolver
+		if c.relayLocalAddr != nil {
+			sock.localAddr = &net.TCPAddr{IP: c.relayLocalAddr}
+		}
+		if c.relayProxyURL != nil {
+			sock.proxy = http.ProxyURL(c.relayProxyURL)
+		}
+		if err := sock.connect(ctx); err != nil {
+			var relayErr *RelayConnectError
+			if !errors.As(err, &relayErr) || !relayErr.Retryable() || connectRetries >= c.relayConnectRetries {
+				return fmt.Errorf("failed to connect to client relay: %w", err)
+			}
+			connectRetries++
+			c.logger.Warn("Relay rejected the connection, retrying", "error", err)
+
+			if err := waitToRetry(ctx, relayConnectRetryDelay); err != nil {
+				return fmt.Errorf("failed to connect to client relay: %w", err)
+			}
+			continue
+		}
 
+		retryable, err := c.startSSHSession(ctx, sock)
+		if err == nil {
+			return nil
+		}
+		if !retryable || handshakeRetries >= c.sshHandshakeRetries {
+			return fmt.Errorf("failed to create ssh session: %w", err)
+		}
+		handshakeRetries++
+		c.logger.Warn("SSH handshake failed, retrying", "error", err)
+
+		if err := waitToRetry(ctx, sshHandshakeRetryDelay); err != nil {
+			return fmt.Errorf("failed to create ssh session: %w", err)
+		}
 	}
+}
 
-	sock := newSocket(clientRelayURI, protocols, headers, nil)
-	if err := sock.connect(ctx); err != nil {
-		return fmt.Errorf("failed to connect to client relay: %w", err)
+// startSSHSession runs the SSH handshake with the host over conn. If the handshake fails,
+// it reports whether it may succeed over a new relay connection.
+func (c *Client) startSSHSession(ctx context.Context, conn net.Conn) (retryable bool, err error) {
+	session := tunnelssh.NewClientSSHSession(conn, c.remoteForwardedPorts, c.acceptLocalConnectionsForForwardedPorts, sshLogger{c.logger})
+	session.SetCopyBufferPool(c.copyBuffers)
+	if c.localBindAddress != nil {
+		session.SetLocalBindAddress(c.localBindAddress.String())
+	}
+	session.SetLocalPortMapping(c.localPorts)
+	if previous := c.session(); previous != nil {
+		// Listen on the same local ports as before reconnecting, so local clients can reconnect.
+		session.SetPreferredLocalPorts(previous.LocalForwardedPorts())
+	}
+	session.SetLocalListenerCallback(c.localListenerObserver)
+	var hostKeyErr error
+	var verifyHostKey ssh.HostKeyCallback
+	switch {
+	case len(c.hostCertificateAuthorities) > 0:
+		verifyHostKey = hostCertificateCallback(c.hostCertificateAuthorities, c.hostID)
+	case c.skipHostKeyVerification:
+	case len(c.hostPublicKeys) > 0:
+		verifyHostKey = hostPublicKeyCallback(c.hostPublicKeys)
+	default:
+		verifyHostKey = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return fmt.Errorf("%w: the host presented %s key %s",
+				ErrNoHostPublicKeys, key.Type(), ssh.FingerprintSHA256(key))
+		}
+	}
+	if verifyHostKey != nil {
+		session.SetHostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = verifyHostKey(hostname, remote, key)
+			return hostKeyErr
+		})
+	}
+	err = session.Connect(ctx)
+	if err == nil {
+		if !c.setSession(session) {
+			session.Close()
+			return false, ErrSSHConnectionClosed
+		}
+		return false, nil
 	}
 
-	c.ssh = tunnelssh.NewClientSSHSession(sock, c.remoteForwardedPorts, c.acceptLocalConnectionsForForwardedPorts, c.logger)
-	if err := c.ssh.Connect(ctx); err != nil {
-		return fmt.Errorf("failed to create ssh session: %w", err)
+	// The handshake consumed part of the relay stream, so a retry requires a new relay connection.
+	session.Close()
+	if hostKeyErr != nil {
+		// The SSH library does not wrap the callback's error, and retrying would not help.
+		return false, hostKeyErr
+	}
+	return true, err
+}
+
+// session returns the current SSH session, or nil if the client has not connected.
+func (c *Client) session() *tunnelssh.ClientSSHSession {
+	c.sshMu.Lock()
+	defer c.sshMu.Unlock()
+	return c.ssh
+}
+
+// setSession makes session the current SSH session, unless the client has been closed.
+func (c *Client) setSession(session *tunnelssh.ClientSSHSession) bool {
+	c.sshMu.Lock()
+	defer c.sshMu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.ssh = session
+	return true
+}
+
+// ConnectWithTransport connects to the host over transport, an already established
+// connection to the tunnel relay or to the host, instead of dialing the relay.
+// This allows in-process or proxied connections; use NewRelayTransport to wrap an
+// existing relay websocket. hostID selects the host as in Connect.
+// The handshake is not retried, because a failed handshake leaves the transport unusable.
+func (c *Client) ConnectWithTransport(ctx context.Context, hostID string, transport net.Conn) error {
+	if transport == nil {
+		return ErrNoTransport
 	}
 
+	c.hostID = hostID
+	if hostID == "" {
+		c.hostID = c.tunnel.Endpoints[0].HostID
+		for _, endpoint := range c.tunnel.Endpoints {
+			if endpoint.HostID != c.hostID {
+				return ErrMultipleHosts
+			}
+		}
+	}
+
+	c.hostPublicKeys = hostPublicKeys(c.tunnel.Endpoints, c.hostID)
+	c.sendConnectionEvent(ConnectionStateConnecting, "", nil)
+	if _, err := c.startSSHSession(ctx, transport); err != nil {
+		c.sendConnectionEvent(ConnectionStateDisconnected, "", err)
+		return fmt.Errorf("failed to create ssh session: %w", err)
+	}
+	c.sendConnectionEvent(ConnectionStateConnected, "", nil)
+	go c.watchConnection(c.session(), "")
 	return nil
 }
 
+func waitToRetry(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// relayClientTLSConfig returns the TLS configuration for relay connections,
+// or nil if the default configuration should be used.
+func (c *Client) relayClientTLSConfig() *tls.Config {
+	if c.relayTLSConfig == nil && c.relayServerName == "" && c.relayVerifyCertificate == nil {
+		return nil
+	}
+
+	var config *tls.Config
+	if c.relayTLSConfig != nil {
+		config = c.relayTLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if c.relayServerName != "" {
+		config.ServerName = c.relayServerName
+	}
+	if c.relayVerifyCertificate != nil {
+		config.VerifyConnection = c.relayVerifyCertificate
+	}
+	return config
+}
+
+// isValidClientRelayURI reports whether uri is a websocket URI the client can dial.
+// Endpoints that only carry host-side information, such as a host relay URI or
+// local network host endpoints, cannot be used by the client.
+func isValidClientRelayURI(uri string) bool {
+	if uri == "" {
+		return false
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "ws" || u.Scheme == "wss") && u.Host != ""
+}
+
 // Opens a stream connected to a remote port for clients which cannot or do not want to forward local TCP ports.
 // Returns a readWriteCloser which can be used to read and write to the remote port.
+// Closing it ends only this connection; it may be called repeatedly for the same port
+// to open independent connections. If the client was created with WithHalfClose, the
+// stream also has a CloseWrite() error method that sends EOF to the remote port while
+// the stream can still be read.
 // Set AcceptLocalConnectionsForForwardedPorts to false in ConnectAsync to ensure TCP listeners are not created
 // This will return an error if the port is not yet forwarded,
 // the caller should first call WaitForForwardedPort.
 func (c *Client) ConnectToForwardedPort(ctx context.Context, listenerIn *net.Listener, port uint16) (io.ReadWriteCloser, chan error) {
-	rwc := new(buffer)
+	streamCtx, cancel := context.WithCancel(ctx)
+	rwc, conn := newForwardedStream(cancel)
 	errc := make(chan error, 1)
 	sendError := func(err error) {
 		// Use non-blocking send, to avoid goroutines getting
@@ -154,12 +634,13 @@ func (c *Client) ConnectToForwardedPort(ctx context.Context, listenerIn *net.Lis
 	}
 
 	go func() {
-		for {
-			go func() {
-				if err := c.handleConnection(ctx, rwc, port); err != nil {
-					sendError(err)
-				}
-			}()
+		err := c.handleConnection(streamCtx, conn, port)
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			// The stream was closed, which is not an error.
+			return
+		}
+		if err != nil {
+			sendError(err)
 		}
 	}()
 
@@ -169,6 +650,10 @@ func (c *Client) ConnectToForwardedPort(ctx context.Context, listenerIn *net.Lis
 // WaitForForwardedPort waits for the specified port to be forwarded.
 // It is common practice to call this function before ConnectToForwardedPort.
 func (c *Client) WaitForForwardedPort(ctx context.Context, port uint16) error {
+	// Subscribe before checking, so that a port added in between is not missed.
+	notifications, unsubscribe := c.remoteForwardedPorts.subscribe()
+	defer unsubscribe()
+
 	// It's already forwarded there's no need to wait.
 	if c.remoteForwardedPorts.hasPort(port) {
 		return nil
@@ -178,7 +663,7 @@ func (c *Client) WaitForForwardedPort(ctx context.Context, port uint16) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case n := <-c.remoteForwardedPorts.notify:
+		case n := <-notifications:
 			if n.port == port && n.notificationType == remoteForwardedPortNotificationTypeAdd {
 				return nil
 			}
@@ -186,6 +671,176 @@ func (c *Client) WaitForForwardedPort(ctx context.Context, port uint16) error {
 	}
 }
 
+// LocalForwardedPort returns the local port the client listens on for connections to
+// remotePort on the host, which may differ from remotePort when that port is in use.
+// Returns false if the client is not listening for the port, for example because the
+// client does not accept local connections or the port has not been forwarded yet.
+func (c *Client) LocalForwardedPort(remotePort uint16) (uint16, bool) {
+	session := c.session()
+	if session == nil {
+		return 0, false
+	}
+	return session.LocalForwardedPort(remotePort)
+}
+
+// WaitForForwardedPortRemoved waits until the host stops forwarding the specified port,
+// returning immediately if the port is not forwarded.
+func (c *Client) WaitForForwardedPortRemoved(ctx context.Context, port uint16) error {
+	// Subscribe before checking, so that a port removed in between is not missed.
+	notifications, unsubscribe := c.remoteForwardedPorts.subscribe()
+	defer unsubscribe()
+
+	if !c.remoteForwardedPorts.hasPort(port) {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-notifications:
+			if n.port == port && n.notificationType == remoteForwardedPortNotificationTypeRemove {
+				return nil
+			}
+		}
+	}
+}
+
+// ForwardedPorts returns the remote ports the host currently forwards, in ascending order.
+func (c *Client) ForwardedPorts() []uint16 {
+	return c.remoteForwardedPorts.list()
+}
+
+// WaitForPortReachable waits for the specified port to be forwarded, then until the host
+// accepts a connection to it, which shows that the service behind the port is running.
+// Connection attempts are repeated until one succeeds or ctx is done; then it returns
+// ErrPortUnreachable with the error from the last attempt.
+func (c *Client) WaitForPortReachable(ctx context.Context, port uint16) error {
+	if err := c.WaitForForwardedPort(ctx, port); err != nil {
+		return err
+	}
+
+	for {
+		channel, err := c.openStreamingChannel(ctx, port)
+		if err == nil {
+			// The host only accepts the channel once it has connected to the port.
+			if closeErr := channel.Close(); closeErr != nil && closeErr != io.EOF {
+				c.logger.Warn("Failed to close the probe connection", "port", port, "error", closeErr)
+			}
+			return nil
+		}
+
+		var openErr *ChannelOpenError
+		if !errors.As(err, &openErr) {
+			return err
+		}
+		if waitErr := waitToRetry(ctx, portReachableRetryDelay); waitErr != nil {
+			return fmt.Errorf("%w: %v", ErrPortUnreachable, err)
+		}
+	}
+}
+
+// RefreshPorts asks the host to send the current set of forwarded ports, and waits until
+// the host has forwarded new ports and stopped forwarding ports that were removed.
+// Returns the ports that were added and removed since before the refresh.
+func (c *Client) RefreshPorts(ctx context.Context) (*ForwardedPortsDiff, error) {
+	session := c.session()
+	if session == nil {
+		return nil, ErrSSHConnectionClosed
+	}
+
+	before := c.remoteForwardedPorts.list()
+	if err := session.RefreshPorts(ctx); err != nil {
+		return nil, fmt.Errorf("failed to refresh ports: %w", err)
+	}
+	return diffForwardedPorts(before, c.remoteForwardedPorts.list()), nil
+}
+
+// ForwardPort waits for the specified remote port to be forwarded, then listens on
+// localAddr and forwards each accepted local connection to the remote port.
+// localAddr is a TCP address such as "127.0.0.1:5030"; use port 0 to pick any available port.
+// Set acceptLocalConnectionsForForwardedPorts to false in NewClient when using this method,
+// to avoid also listening on a local port chosen by the client.
+// Returns a PortForwarder that reports the local address and stops the forwarding.
+func (c *Client) ForwardPort(ctx context.Context, remotePort uint16, localAddr string) (*PortForwarder, error) {
+	if err := c.WaitForForwardedPort(ctx, remotePort); err != nil {
+		return nil, fmt.Errorf("error waiting for forwarded port: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on local address %s: %w", localAddr, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pf := &PortForwarder{
+		remotePort: remotePort,
+		listener:   listener,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go pf.acceptConnections(ctx, c)
+
+	return pf, nil
+}
+
+// ForwardAllPorts forwards every port the host forwards, now and as the host adds ports
+// later, and stops forwarding ports the host removes, such as after RefreshPorts.
+// mapper returns the local address to listen on for a remote port, or "" to skip the port.
+// Set acceptLocalConnectionsForForwardedPorts to false in NewClient when using this method.
+// Returns an AllPortsForwarder that lists the port forwarders and stops them.
+func (c *Client) ForwardAllPorts(ctx context.Context, mapper func(remotePort uint16) string) (*AllPortsForwarder, error) {
+	if mapper == nil {
+		return nil, errors.New("mapper must not be nil")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	f := &AllPortsForwarder{
+		client:     c,
+		mapper:     mapper,
+		forwarders: make(map[uint16]*PortForwarder),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+
+	// Subscribe before listing the current ports, so that a port added in between is not missed.
+	notifications, unsubscribe := c.remoteForwardedPorts.subscribe()
+	for _, port := range c.remoteForwardedPorts.list() {
+		f.add(ctx, port)
+	}
+	go f.followPorts(ctx, notifications, unsubscribe)
+
+	return f, nil
+}
+
+// ActiveConnections returns the local connections that are currently forwarded to
+// the specified remote port, ordered by connection ID.
+func (c *Client) ActiveConnections(port uint16) []ForwardedConnection {
+	return c.connections.list(port)
+}
+
+// SSHUser returns the user that ssh clients should log in as when connecting to the
+// remote port through a forwarded connection, taken from the tunnel's port metadata.
+// It returns "" if the port is not an SSH port or has no configured user; the relay
+// connection itself always authenticates as the "tunnel" user.
+func (c *Client) SSHUser(port uint16) string {
+	for _, tunnelPort := range c.tunnel.Ports {
+		if tunnelPort.PortNumber == port && tunnelPort.Protocol == string(TunnelProtocolSsh) {
+			return tunnelPort.SshUser
+		}
+	}
+	return ""
+}
+
+// CloseConnection closes a single forwarded connection, leaving other connections
+// to the same port open. Returns ErrConnectionNotFound if the connection does not exist.
+func (c *Client) CloseConnection(id uint64) error {
+	if !c.connections.close(id) {
+		return ErrConnectionNotFound
+	}
+	return nil
+}
+
 func awaitError(ctx context.Context, errc chan error) error {
 	select {
 	case err := <-errc:
@@ -203,6 +858,17 @@ func (c *Client) handleConnection(ctx context.Context, conn io.ReadWriteCloser,
 		return fmt.Errorf("failed to open streaming channel: %w", err)
 	}
 
+	// Closing the connection by ID cancels its context, which ends the copy below.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var remoteAddr net.Addr
+	if netConn, ok := conn.(net.Conn); ok {
+		remoteAddr = netConn.RemoteAddr()
+	}
+	id := c.connections.add(port, remoteAddr, cancel)
+	defer c.connections.remove(id)
+
 	// Ideally we would call safeClose again, but (*ssh.channel).Close
 	// appears to have a bug that causes it return io.EOF spuriously
 	// if its peer closed first; see github.com/golang/go/issues/38115.
@@ -214,13 +880,40 @@ func (c *Client) handleConnection(ctx context.Context, conn io.ReadWriteCloser,
 	}()
 
 	errs := make(chan error, 2)
-	copyConn := func(w io.Writer, r io.Reader) {
-		_, err := io.Copy(w, r)
+	copyConn := func(w io.Writer, r io.Reader, closeWrite func()) {
+		_, err := c.copyBuffers.Copy(w, r)
+		if c.halfClose {
+			closeWrite()
+		}
 		errs <- err
 	}
 
-	go copyConn(conn, channel)
-	go copyConn(channel, conn)
+	local, remote := c.forwardTLS.wrap(conn, channel)
+	var toLocal, toRemote io.Writer = local, remote
+	if c.metrics != nil {
+		toLocal = &bytesWriter{w: local, metrics: c.metrics, received: true}
+		toRemote = &bytesWriter{w: remote, metrics: c.metrics}
+	}
+	var reportTransfer <-chan time.Time
+	if c.transferObserver != nil {
+		counter := c.transfers.counter(port)
+		toLocal = &countingWriter{w: toLocal, count: &counter.received}
+		toRemote = &countingWriter{w: toRemote, count: &counter.sent}
+		ticker := time.NewTicker(c.transferInterval)
+		defer ticker.Stop()
+		reportTransfer = ticker.C
+		defer c.reportTransfer(port, counter)
+	}
+	go copyConn(toLocal, remote, func() {
+		closeWrite(local)
+	})
+	go copyConn(toRemote, local, func() {
+		// Close TLS to the remote port before the channel, so that it ends cleanly.
+		closeWrite(remote)
+		if remote != io.ReadWriter(channel) {
+			channel.CloseWrite()
+		}
+	})
 
 	// Wait until context is cancelled or both copies are done.
 	// Discard errors from io.Copy; they should not cause (e.g.) failures.
@@ -228,6 +921,8 @@ func (c *Client) handleConnection(ctx context.Context, conn io.ReadWriteCloser,
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-reportTransfer:
+			c.reportTransfer(port, c.transfers.counter(port))
 		case <-errs:
 			i++
 			if i == 2 {
@@ -237,6 +932,14 @@ func (c *Client) handleConnection(ctx context.Context, conn io.ReadWriteCloser,
 	}
 }
 
+// closeWrite closes the write direction of w if it supports that, as *net.TCPConn,
+// *tls.Conn and ssh.Channel do, so that its peer reads EOF while w can still be read.
+func closeWrite(w io.Writer) {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
 func safeClose(c io.Closer, err *error) {
 	if closerErr := c.Close(); *err == nil {
 		*err = closerErr
@@ -244,8 +947,12 @@ func safeClose(c io.Closer, err *error) {
 }
 
 func (c *Client) openStreamingChannel(ctx context.Context, port uint16) (ssh.Channel, error) {
+	session := c.session()
+	if session == nil {
+		return nil, ErrSSHConnectionClosed
+	}
 	portForwardChannel := messages.NewPortForwardChannel(
-		c.ssh.NextChannelID(),
+		session.NextChannelID(),
 		"127.0.0.1",
 		uint32(port),
 		"",
@@ -256,14 +963,55 @@ func (c *Client) openStreamingChannel(ctx context.Context, port uint16) (ssh.Cha
 		return nil, fmt.Errorf("failed to marshal port forward channel open message: %w", err)
 	}
 
-	channel, err := c.ssh.OpenChannel(ctx, portForwardChannel.Type(), data)
+	channel, err := session.OpenChannel(ctx, portForwardChannel.Type(), data)
 	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			err = &ChannelOpenError{Port: port, Reason: openErr.Reason, Message: openErr.Message, err: openErr}
+		}
 		return nil, fmt.Errorf("failed to open port forward channel: %w", err)
 	}
 
 	return channel, nil
 }
 
+// ChannelOpenError is returned when the host rejects a channel to a forwarded port.
+type ChannelOpenError struct {
+	// Port is the remote port the channel was opened for.
+	Port uint16
+
+	// Reason is the reason the host gave for rejecting the channel.
+	Reason ssh.RejectionReason
+
+	// Message is the description the host gave for rejecting the channel.
+	Message string
+
+	err error
+}
+
+func (e *ChannelOpenError) Error() string {
+	return fmt.Sprintf("channel to port %d rejected: %s (%s)", e.Port, e.Message, e.Reason)
+}
+
+func (e *ChannelOpenError) Unwrap() error {
+	return e.err
+}
+
+// Retryable reports whether opening the channel may succeed if it is retried later,
+// because the host or relay is short of resources. Channels to a port that is not
+// allowed, or that the host could not connect to, are not retryable.
+func (e *ChannelOpenError) Retryable() bool {
+	return e.Reason == ssh.ResourceShortage
+}
+
 func (c *Client) Close() error {
-	return c.ssh.Close()
+	c.sshMu.Lock()
+	c.closed = true
+	session := c.ssh
+	c.sshMu.Unlock()
+	c.sendConnectionEvent(ConnectionStateClosed, "", nil)
+	if session == nil {
+		return nil
+	}
+	return session.Close()
 }
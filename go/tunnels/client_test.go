@@ -4,21 +4,34 @@
 package tunnels
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/microsoft/dev-tunnels/go/tunnels/ssh/messages"
 
 	tunnelstest "github.com/microsoft/dev-tunnels/go/tunnels/test"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestSuccessfulConnect(t *testing.T) {
@@ -37,7 +50,8 @@ func TestSuccessfulConnect(t *testing.T) {
 		},
 		Endpoints: []TunnelEndpoint{
 			{
-				HostID: "host1",
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
 				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
 					ClientRelayURI: hostURL,
 				},
@@ -71,6 +85,69 @@ func TestSuccessfulConnect(t *testing.T) {
 	}
 }
 
+func TestRetriesFailedSSHHandshake(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithFailedHandshakes(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	c.Close()
+}
+
+func TestReturnsErrWhenSSHHandshakeRetriesAreExhausted(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithFailedHandshakes(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, WithSSHHandshakeRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
 func TestReturnsErrWithInvalidAccessToken(t *testing.T) {
 	accessToken := "access-token"
 	relayServer, err := tunnelstest.NewRelayServer(
@@ -87,7 +164,8 @@ func TestReturnsErrWithInvalidAccessToken(t *testing.T) {
 		},
 		Endpoints: []TunnelEndpoint{
 			{
-				HostID: "host1",
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
 				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
 					ClientRelayURI: hostURL,
 				},
@@ -103,6 +181,40 @@ func TestReturnsErrWithInvalidAccessToken(t *testing.T) {
 	}
 }
 
+func TestConnectWithMultiScopeAccessToken(t *testing.T) {
+	accessToken := "tunnel access-token"
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithAccessToken(accessToken),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := Tunnel{
+		AccessTokens: map[TunnelAccessScope]string{
+			"host connect": accessToken,
+		},
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	c, err := NewClient(log.New(io.Discard, "", 0), &tunnel, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("expected the token keyed by several scopes to be sent, got %v", err)
+	}
+	c.Close()
+}
+
 func TestReturnsErrWhenTunnelIsNil(t *testing.T) {
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 	_, err := NewClient(logger, nil, true)
@@ -177,6 +289,234 @@ func TestReturnsErrWhenThereAreMoreThanOneEndpoints(t *testing.T) {
 	}
 }
 
+func TestReturnsErrWhenEndpointHasNoClientRelayURI(t *testing.T) {
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID: "host1",
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					HostRelayURI: "wss://relay.example.com/host",
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, _ := NewClient(logger, &tunnel, true)
+	err := c.Connect(ctx, "")
+	if !errors.Is(err, ErrNoClientEndpoint) {
+		t.Errorf("expected ErrNoClientEndpoint, got %v", err)
+	}
+}
+
+func TestReturnsErrWhenClientRelayURIIsInvalid(t *testing.T) {
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID: "host1",
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: "relay.example.com/client",
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, _ := NewClient(logger, &tunnel, true)
+	err := c.Connect(ctx, "")
+	if !errors.Is(err, ErrNoClientEndpoint) {
+		t.Errorf("expected ErrNoClientEndpoint, got %v", err)
+	}
+}
+
+func TestConnectsToHigherPriorityEndpointFirst(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lowPriorityRequests int32
+	lowPriorityServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lowPriorityRequests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer lowPriorityServer.Close()
+
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID: "host1",
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(lowPriorityServer.URL, "http://", "ws://", 1),
+				},
+			},
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	preferred := tunnel.Endpoints[1].ClientRelayURI
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, true, WithEndpointPriority(preferRelayURI(preferred)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if n := atomic.LoadInt32(&lowPriorityRequests); n != 0 {
+		t.Errorf("expected the low priority endpoint not to be used, got %d requests", n)
+	}
+}
+
+func TestFallsBackToLowerPriorityEndpoint(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unavailableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailableServer.Close()
+
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+			{
+				HostID: "host1",
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(unavailableServer.URL, "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	preferred := tunnel.Endpoints[1].ClientRelayURI
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, true, WithRelayConnectRetries(0), WithEndpointPriority(preferRelayURI(preferred)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+}
+
+// preferRelayURI returns an endpoint priority function that prefers the endpoint with
+// the client relay URI uri.
+func preferRelayURI(uri string) func(TunnelEndpoint) int {
+	return func(endpoint TunnelEndpoint) int {
+		if endpoint.ClientRelayURI == uri {
+			return 10
+		}
+		return 0
+	}
+}
+
+func newTLSRelayTunnel(t *testing.T) (*Tunnel, *tls.Config, func()) {
+	// The test server's certificate is valid for example.com and the loopback addresses.
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tunnel := &Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID: "host1",
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(server.URL, "https://", "wss://", 1),
+				},
+			},
+		},
+	}
+	return tunnel, &tls.Config{RootCAs: roots}, server.Close
+}
+
+func TestRefusesRelayCertificateForUnexpectedServerName(t *testing.T) {
+	tunnel, tlsConfig, closeServer := newTLSRelayTunnel(t)
+	defer closeServer()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, tunnel, true,
+		WithRelayTLSConfig(tlsConfig),
+		WithRelayServerName("global.rel.tunnels.api.visualstudio.com"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Connect(ctx, "")
+	var hostnameErr x509.HostnameError
+	if !errors.As(err, &hostnameErr) {
+		t.Errorf("expected a certificate host name error, got %v", err)
+	}
+}
+
+func TestAcceptsRelayCertificateForExpectedServerName(t *testing.T) {
+	tunnel, tlsConfig, closeServer := newTLSRelayTunnel(t)
+	defer closeServer()
+
+	verified := false
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, tunnel, true,
+		WithRelayTLSConfig(tlsConfig),
+		WithRelayServerName("example.com"),
+		WithRelayCertificateVerifier(func(state tls.ConnectionState) error {
+			verified = state.ServerName == "example.com"
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The TLS handshake succeeds, and the test server then rejects the websocket upgrade.
+	err = c.Connect(ctx, "")
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("expected the websocket handshake to fail after TLS, got %v", err)
+	}
+	if !verified {
+		t.Errorf("certificate verifier was not called for the expected server name")
+	}
+}
+
+func TestRefusesRelayCertificateRejectedByVerifier(t *testing.T) {
+	tunnel, tlsConfig, closeServer := newTLSRelayTunnel(t)
+	defer closeServer()
+
+	errRejected := errors.New("unexpected relay certificate")
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, tunnel, true,
+		WithRelayTLSConfig(tlsConfig),
+		WithRelayCertificateVerifier(func(state tls.ConnectionState) error {
+			return errRejected
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Connect(ctx, "")
+	if !errors.Is(err, errRejected) {
+		t.Errorf("expected the verifier error, got %v", err)
+	}
+}
+
 func TestPortForwarding(t *testing.T) {
 	listen, err := net.Listen("tcp", "127.0.0.1:8000")
 	if err != nil {
@@ -201,7 +541,8 @@ func TestPortForwarding(t *testing.T) {
 	tunnel := Tunnel{
 		Endpoints: []TunnelEndpoint{
 			{
-				HostID: "host1",
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
 				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
 					ClientRelayURI: hostURL,
 				},
@@ -282,3 +623,1764 @@ func TestPortForwarding(t *testing.T) {
 		}
 	}
 }
+
+func TestForwardPort(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamPort := uint16(8002)
+	streamData := "stream-data"
+	stream := bytes.NewBufferString(streamData)
+	pfsChannel := messages.NewPortForwardChannel(1, "127.0.0.1", uint32(streamPort), "", 0)
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithForwardedStream(pfsChannel, streamPort, stream),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+
+	pf, err := c.ForwardPort(ctx, streamPort, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if pf.RemotePort() != streamPort {
+		t.Errorf("unexpected remote port: %d", pf.RemotePort())
+	}
+
+	conn, err := net.DialTimeout("tcp", pf.LocalAddr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to forwarded port: %v", err)
+	}
+	defer conn.Close()
+
+	b := make([]byte, len(streamData))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("reading stream: %v", err)
+	}
+	if string(b) != streamData {
+		t.Errorf("stream data is not expected value, got: %s", string(b))
+	}
+
+	if err := pf.Stop(); err != nil {
+		t.Errorf("stop failed: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", pf.LocalAddr().String(), time.Second); err == nil {
+		t.Error("expected local listener to be closed after stop")
+	}
+}
+
+func TestForwardPortWithForwardTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The test server's certificate is valid for example.com and the loopback addresses.
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certServer.Close()
+	certificates := certServer.TLS.Certificates
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+
+	streamPort := uint16(8003)
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithTLSEchoStreams(&tls.Config{Certificates: certificates}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	// Terminate the local client's TLS, and originate a separate TLS session to the host.
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, WithForwardTLS(&ForwardTLS{
+		LocalConfig:  &tls.Config{Certificates: certificates},
+		RemoteConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	pf, err := c.ForwardPort(ctx, streamPort, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	defer pf.Stop()
+
+	conn, err := tls.Dial("tcp", pf.LocalAddr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("failed to connect to forwarded port with TLS: %v", err)
+	}
+	defer conn.Close()
+
+	data := "tls-data"
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatalf("writing stream: %v", err)
+	}
+	b := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("reading stream: %v", err)
+	}
+	if string(b) != data {
+		t.Errorf("stream data is not expected value, got: %s", string(b))
+	}
+}
+
+func TestCloseForwardedConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamPort := uint16(8003)
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithEchoStreams(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	pf, err := c.ForwardPort(ctx, streamPort, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	defer pf.Stop()
+
+	echo := func(conn net.Conn, data string) error {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte(data)); err != nil {
+			return err
+		}
+		b := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if string(b) != data {
+			return fmt.Errorf("unexpected echo: %s", string(b))
+		}
+		return nil
+	}
+
+	conn1, err := net.Dial("tcp", pf.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+	if err := echo(conn1, "first"); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+
+	conn2, err := net.Dial("tcp", pf.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if err := echo(conn2, "second"); err != nil {
+		t.Fatalf("second connection: %v", err)
+	}
+
+	connections := c.ActiveConnections(streamPort)
+	if len(connections) != 2 {
+		t.Fatalf("expected 2 active connections, got %d", len(connections))
+	}
+	for _, connection := range connections {
+		if connection.Port != streamPort || connection.RemoteAddr == nil {
+			t.Errorf("unexpected connection info: %+v", connection)
+		}
+	}
+
+	if err := c.CloseConnection(connections[0].ID); err != nil {
+		t.Fatalf("close connection failed: %v", err)
+	}
+
+	conn1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn1.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected closed connection to return EOF, got %v", err)
+	}
+	if err := echo(conn2, "still open"); err != nil {
+		t.Errorf("second connection should still be open: %v", err)
+	}
+	if n := len(c.ActiveConnections(streamPort)); n != 1 {
+		t.Errorf("expected 1 active connection, got %d", n)
+	}
+
+	if err := c.CloseConnection(connections[0].ID); err != ErrConnectionNotFound {
+		t.Errorf("expected ErrConnectionNotFound, got %v", err)
+	}
+}
+
+func TestRefreshPortsReconcilesAddedAndRemovedPorts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithRefreshedPorts(8011, 8012),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	for _, port := range []uint16{8010, 8011} {
+		if err := relayServer.ForwardPort(ctx, port); err != nil {
+			t.Fatalf("forward port failed: %v", err)
+		}
+	}
+
+	notifications, unsubscribe := c.remoteForwardedPorts.subscribe()
+	defer unsubscribe()
+
+	diff, err := c.RefreshPorts(ctx)
+	if err != nil {
+		t.Fatalf("refresh ports failed: %v", err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0] != 8012 {
+		t.Errorf("expected port 8012 to be added, got %v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0] != 8010 {
+		t.Errorf("expected port 8010 to be removed, got %v", diff.Removed)
+	}
+	if c.remoteForwardedPorts.hasPort(8010) {
+		t.Errorf("removed port 8010 is still forwarded")
+	}
+
+	var added, removed bool
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-notifications:
+			added = added || (n.port == 8012 && n.notificationType == remoteForwardedPortNotificationTypeAdd)
+			removed = removed || (n.port == 8010 && n.notificationType == remoteForwardedPortNotificationTypeRemove)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for port notifications")
+		}
+	}
+	if !added || !removed {
+		t.Errorf("expected add and remove notifications, got added=%v removed=%v", added, removed)
+	}
+}
+
+func TestRefreshPortsRespectsContext(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.RefreshPorts(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func connectToRejectingRelay(t *testing.T, statusCodes []int, opts ...ClientOption) error {
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithRejectedConnections(statusCodes...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Connect(ctx, "")
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestRetriesRetryableRelayConnectErrors(t *testing.T) {
+	for _, statusCode := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		if err := connectToRejectingRelay(t, []int{statusCode}, WithRelayConnectRetries(1)); err != nil {
+			t.Errorf("expected connect to succeed after a %d response, got %v", statusCode, err)
+		}
+	}
+}
+
+func TestReturnsRelayConnectErrorWhenRetriesAreExhausted(t *testing.T) {
+	statusCodes := []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	err := connectToRejectingRelay(t, statusCodes, WithRelayConnectRetries(1))
+
+	var relayErr *RelayConnectError
+	if !errors.As(err, &relayErr) {
+		t.Fatalf("expected a RelayConnectError, got %v", err)
+	}
+	if relayErr.StatusCode != http.StatusServiceUnavailable || !relayErr.Retryable() {
+		t.Errorf("unexpected relay connect error: %+v", relayErr)
+	}
+}
+
+func TestDoesNotRetryRelayAuthErrors(t *testing.T) {
+	for _, statusCode := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		// A retry would succeed, so an error shows that the status was not retried.
+		err := connectToRejectingRelay(t, []int{statusCode}, WithRelayConnectRetries(1))
+
+		var relayErr *RelayConnectError
+		if !errors.As(err, &relayErr) {
+			t.Errorf("expected a RelayConnectError for status %d, got %v", statusCode, err)
+			continue
+		}
+		if relayErr.StatusCode != statusCode || relayErr.Retryable() {
+			t.Errorf("unexpected relay connect error: %+v", relayErr)
+		}
+	}
+}
+
+func TestForwardAllPorts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	for _, port := range []uint16{8020, 8021} {
+		if err := relayServer.ForwardPort(ctx, port); err != nil {
+			t.Fatalf("forward port failed: %v", err)
+		}
+	}
+
+	f, err := c.ForwardAllPorts(ctx, func(remotePort uint16) string {
+		return "127.0.0.1:0"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	waitForForwarders := func(expected ...uint16) {
+		for {
+			forwarders := f.Forwarders()
+			if len(forwarders) == len(expected) {
+				matches := true
+				for i, pf := range forwarders {
+					matches = matches && pf.RemotePort() == expected[i]
+				}
+				if matches {
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for forwarders of ports %v", expected)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	waitForForwarders(8020, 8021)
+	for _, pf := range f.Forwarders() {
+		conn, err := net.DialTimeout("tcp", pf.LocalAddr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatalf("failed to connect to local listener for port %d: %v", pf.RemotePort(), err)
+		}
+		conn.Close()
+	}
+
+	if err := relayServer.ForwardPort(ctx, 8022); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	waitForForwarders(8020, 8021, 8022)
+
+	if err := relayServer.CancelForwardPort(ctx, 8020); err != nil {
+		t.Fatalf("cancel forward port failed: %v", err)
+	}
+	waitForForwarders(8021, 8022)
+}
+
+func TestReturnsChannelOpenErrorWhenHostRejectsChannel(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithRejectedChannels(ssh.Prohibited, "port is not allowed"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	_, errc := c.ConnectToForwardedPort(ctx, nil, 8000)
+	select {
+	case err := <-errc:
+		var openErr *ChannelOpenError
+		if !errors.As(err, &openErr) {
+			t.Fatalf("expected a ChannelOpenError, got %v", err)
+		}
+		if openErr.Port != 8000 || openErr.Reason != ssh.Prohibited || openErr.Message != "port is not allowed" {
+			t.Errorf("unexpected channel open error: %+v", openErr)
+		}
+		if openErr.Retryable() {
+			t.Errorf("expected a prohibited channel not to be retryable")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the channel to be rejected")
+	}
+}
+
+func TestConnectWithTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SSH version exchange writes from both ends at once, so the transport must
+	// be buffered, unlike net.Pipe; a loopback connection stands in for a proxied one.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		hostConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		relayServer.ServeConn(ctx, hostConn)
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{{HostID: "host1", HostPublicKeys: relayServer.HostPublicKeys()}},
+	}
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConnectWithTransport(ctx, "", clientConn); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	streamPort := uint16(8004)
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, streamPort); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+
+	rwc, errc := c.ConnectToForwardedPort(ctx, nil, streamPort)
+	data := "pipe-data"
+	if _, err := rwc.Write([]byte(data)); err != nil {
+		t.Fatalf("writing stream: %v", err)
+	}
+	b := make([]byte, len(data))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(rwc, b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+	case err := <-errc:
+		t.Fatalf("connection failed: %v", err)
+	case <-ctx.Done():
+		t.Fatal("timed out reading the stream")
+	}
+	if string(b) != data {
+		t.Errorf("stream data is not expected value, got: %s", string(b))
+	}
+}
+
+func TestConnectWithTransportRequiresTransport(t *testing.T) {
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{{HostID: "host1"}},
+	}
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConnectWithTransport(ctx, "", nil); !errors.Is(err, ErrNoTransport) {
+		t.Errorf("expected ErrNoTransport, got %v", err)
+	}
+	if _, err := NewRelayTransport(nil); !errors.Is(err, ErrNoTransport) {
+		t.Errorf("expected ErrNoTransport, got %v", err)
+	}
+}
+
+func connectTestClient(t *testing.T, relayServer *tunnelstest.RelayServer, opts ...ClientOption) *Client {
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	return c
+}
+
+func TestWaitForPortReachable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer)
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, 8005); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForPortReachable(ctx, 8005); err != nil {
+		t.Errorf("expected the port to be reachable, got %v", err)
+	}
+}
+
+func TestWaitForPortReachableWhenServiceIsDown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithRejectedChannels(ssh.ConnectionFailed, "connection refused"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer)
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, 8006); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	err = c.WaitForPortReachable(ctx, 8006)
+	if !errors.Is(err, ErrPortUnreachable) {
+		t.Errorf("expected ErrPortUnreachable, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected the error to include the host's reason, got %v", err)
+	}
+}
+
+func TestCloseConnectToForwardedPortStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer)
+	defer c.Close()
+
+	streamPort := uint16(8007)
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, streamPort); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+
+	first, firstErrc := c.ConnectToForwardedPort(ctx, nil, streamPort)
+	_, secondErrc := c.ConnectToForwardedPort(ctx, nil, streamPort)
+	waitForConnections := func(count int) {
+		for len(c.ActiveConnections(streamPort)) != count {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("expected %d connections, got %d", count, len(c.ActiveConnections(streamPort)))
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	waitForConnections(2)
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitForConnections(1)
+
+	select {
+	case err := <-firstErrc:
+		t.Errorf("expected closing the stream not to report an error, got %v", err)
+	case err := <-secondErrc:
+		t.Errorf("expected the other connection to survive, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestForwardPortWithHalfClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithReplyOnEOFStreams([]byte(" response")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer, WithHalfClose())
+	defer c.Close()
+
+	streamPort := uint16(8009)
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, streamPort); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+	pf, err := c.ForwardPort(ctx, streamPort, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	defer pf.Stop()
+
+	conn, err := net.DialTimeout("tcp", pf.LocalAddr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to forwarded port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatalf("writing stream: %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading stream: %v", err)
+	}
+	if string(response) != "request response" {
+		t.Errorf("expected the response after half-closing, got %q", response)
+	}
+}
+
+func TestConnectToForwardedPortWithHalfClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithReplyOnEOFStreams([]byte(" response")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer, WithHalfClose())
+	defer c.Close()
+
+	streamPort := uint16(8012)
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, streamPort); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+
+	stream, errc := c.ConnectToForwardedPort(ctx, nil, streamPort)
+	defer stream.Close()
+	halfCloser, ok := stream.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("expected the stream to have a CloseWrite method")
+	}
+
+	done := make(chan error, 1)
+	var response []byte
+	go func() {
+		if _, err := stream.Write([]byte("request")); err != nil {
+			done <- fmt.Errorf("writing stream: %w", err)
+			return
+		}
+		if err := halfCloser.CloseWrite(); err != nil {
+			done <- err
+			return
+		}
+		data, err := io.ReadAll(stream)
+		response = data
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+	case err := <-errc:
+		t.Fatalf("connection failed: %v", err)
+	case <-ctx.Done():
+		t.Fatal("timed out reading the stream")
+	}
+	if string(response) != "request response" {
+		t.Errorf("expected the response after half-closing, got %q", response)
+	}
+}
+
+func TestTransferObserver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	transferred := make(map[TransferDirection]int64)
+	observer := func(port uint16, direction TransferDirection, bytes int64) {
+		if port != 8010 {
+			t.Errorf("unexpected port %d", port)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		transferred[direction] = bytes
+	}
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer, WithTransferObserver(10*time.Millisecond, observer))
+	defer c.Close()
+
+	streamPort := uint16(8010)
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, streamPort); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+	pf, err := c.ForwardPort(ctx, streamPort, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	defer pf.Stop()
+
+	conn, err := net.DialTimeout("tcp", pf.LocalAddr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to forwarded port: %v", err)
+	}
+	defer conn.Close()
+	data := "transfer-data"
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatalf("writing stream: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatalf("reading stream: %v", err)
+	}
+
+	for {
+		mu.Lock()
+		sent, received := transferred[TransferDirectionSent], transferred[TransferDirectionReceived]
+		mu.Unlock()
+		if sent == int64(len(data)) && received == int64(len(data)) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected %d bytes each way, got %d sent and %d received", len(data), sent, received)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// newConnectProxy starts an HTTP CONNECT proxy that sends the target of each tunnel it
+// opens to targets.
+func newConnectProxy(t *testing.T, targets chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || request.Method != http.MethodConnect {
+					return
+				}
+				targets <- request.Host
+				target, err := net.Dial("tcp", request.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestConnectsToRelayThroughProxy(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := make(chan string, 1)
+	proxy := newConnectProxy(t, targets)
+	defer proxy.Close()
+
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Addr().String()}
+	c := connectTestClient(t, relayServer, WithProxyURL(proxyURL))
+	defer c.Close()
+
+	select {
+	case target := <-targets:
+		if relayHost := strings.TrimPrefix(relayServer.URL(), "http://"); target != relayHost {
+			t.Errorf("expected the proxy to connect to the relay at %s, got %s", relayHost, target)
+		}
+	default:
+		t.Error("expected the client to connect through the proxy")
+	}
+}
+
+func TestRejectsUnsupportedProxyScheme(t *testing.T) {
+	tunnel := Tunnel{Endpoints: []TunnelEndpoint{{HostID: "host1"}}}
+	logger := log.New(io.Discard, "", 0)
+	proxyURL := &url.URL{Scheme: "ftp", Host: "proxy.example.com:21"}
+	if _, err := NewClient(logger, &tunnel, false, WithProxyURL(proxyURL)); err == nil {
+		t.Error("expected an error for an unsupported proxy scheme")
+	}
+}
+
+func TestConnectsToRelayWithResolver(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(relayServer.URL(), "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: fmt.Sprintf("ws://relay.staging.example:%s", port),
+				},
+			},
+		},
+	}
+
+	resolver := mapResolver{"relay.staging.example": "127.0.0.1"}
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, WithRelayResolver(resolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	c.Close()
+}
+
+func TestNewClientWithUnassignableRelayLocalAddr(t *testing.T) {
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{{HostID: "host1"}},
+	}
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	_, err := NewClient(logger, &tunnel, false, WithRelayLocalAddr(net.ParseIP("192.0.2.1")))
+	if err == nil || !strings.Contains(err.Error(), "not assignable") {
+		t.Errorf("expected an error for an unassignable local address, got %v", err)
+	}
+}
+
+func newHostCertificateSigner(t *testing.T, ca ssh.Signer, principals ...string) ssh.Signer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             hostSigner.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, hostSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certSigner
+}
+
+func newCertificateAuthority(t *testing.T) ssh.Signer {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func connectWithHostSigner(t *testing.T, hostSigner ssh.Signer, trusted ssh.PublicKey) error {
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithHostSigner(hostSigner),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false,
+		WithHostCertificateAuthorities(trusted),
+		WithSSHHandshakeRetries(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Connect(ctx, "")
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestAcceptsHostCertificateFromTrustedAuthority(t *testing.T) {
+	ca := newCertificateAuthority(t)
+	hostSigner := newHostCertificateSigner(t, ca, "host1")
+	if err := connectWithHostSigner(t, hostSigner, ca.PublicKey()); err != nil {
+		t.Errorf("expected the host certificate to be accepted, got %v", err)
+	}
+}
+
+func TestRejectsHostCertificateFromUntrustedAuthority(t *testing.T) {
+	ca := newCertificateAuthority(t)
+	otherCA := newCertificateAuthority(t)
+	hostSigner := newHostCertificateSigner(t, otherCA, "host1")
+	err := connectWithHostSigner(t, hostSigner, ca.PublicKey())
+	if !errors.Is(err, ErrUntrustedHostKey) {
+		t.Errorf("expected ErrUntrustedHostKey, got %v", err)
+	}
+}
+
+func TestRejectsHostCertificateForOtherHost(t *testing.T) {
+	ca := newCertificateAuthority(t)
+	hostSigner := newHostCertificateSigner(t, ca, "host2")
+	err := connectWithHostSigner(t, hostSigner, ca.PublicKey())
+	if !errors.Is(err, ErrUntrustedHostKey) {
+		t.Errorf("expected ErrUntrustedHostKey, got %v", err)
+	}
+}
+
+func connectWithPublishedHostKeys(t *testing.T, hostSigner ssh.Signer, published []string, opts ...ClientOption) error {
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithHostSigner(hostSigner),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostURL := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: published,
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: hostURL,
+				},
+			},
+		},
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, append(opts, WithSSHHandshakeRetries(0))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Connect(ctx, "")
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestAcceptsPublishedHostKey(t *testing.T) {
+	hostSigner := newCertificateAuthority(t)
+	published := base64.StdEncoding.EncodeToString(hostSigner.PublicKey().Marshal())
+	if err := connectWithPublishedHostKeys(t, hostSigner, []string{published}); err != nil {
+		t.Errorf("expected the published host key to be accepted, got %v", err)
+	}
+}
+
+func TestAcceptsPublishedPKIXHostKey(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := base64.StdEncoding.EncodeToString(der)
+	if err := connectWithPublishedHostKeys(t, hostSigner, []string{published}); err != nil {
+		t.Errorf("expected the published host key to be accepted, got %v", err)
+	}
+}
+
+func TestRejectsUnpublishedHostKey(t *testing.T) {
+	hostSigner := newCertificateAuthority(t)
+	otherKey := newCertificateAuthority(t)
+	published := base64.StdEncoding.EncodeToString(otherKey.PublicKey().Marshal())
+	err := connectWithPublishedHostKeys(t, hostSigner, []string{published})
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("expected ErrHostKeyMismatch, got %v", err)
+	}
+}
+
+func TestInsecureSkipHostKeyVerification(t *testing.T) {
+	hostSigner := newCertificateAuthority(t)
+	otherKey := newCertificateAuthority(t)
+	published := base64.StdEncoding.EncodeToString(otherKey.PublicKey().Marshal())
+	err := connectWithPublishedHostKeys(t, hostSigner, []string{published}, WithInsecureSkipHostKeyVerification())
+	if err != nil {
+		t.Errorf("expected the host key to be accepted without verification, got %v", err)
+	}
+}
+
+func TestRejectsHostWithoutPublishedKeys(t *testing.T) {
+	hostSigner := newCertificateAuthority(t)
+	err := connectWithPublishedHostKeys(t, hostSigner, nil)
+	if !errors.Is(err, ErrNoHostPublicKeys) {
+		t.Errorf("expected ErrNoHostPublicKeys, got %v", err)
+	}
+}
+
+func TestInsecureSkipHostKeyVerificationWithoutPublishedKeys(t *testing.T) {
+	hostSigner := newCertificateAuthority(t)
+	err := connectWithPublishedHostKeys(t, hostSigner, nil, WithInsecureSkipHostKeyVerification())
+	if err != nil {
+		t.Errorf("expected the host key to be accepted without verification, got %v", err)
+	}
+}
+
+func TestSSHUserForSSHPort(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{{HostID: "host1"}},
+		Ports: []TunnelPort{
+			{PortNumber: 22, Protocol: string(TunnelProtocolSsh), SshUser: "azureuser"},
+			{PortNumber: 2222, Protocol: string(TunnelProtocolSsh)},
+			{PortNumber: 8080, Protocol: string(TunnelProtocolHttp), SshUser: "ignored"},
+		},
+	}
+	c, err := NewClient(logger, &tunnel, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user := c.SSHUser(22); user != "azureuser" {
+		t.Errorf("expected user azureuser for port 22, got %q", user)
+	}
+	if user := c.SSHUser(2222); user != "" {
+		t.Errorf("expected no user for port 2222, got %q", user)
+	}
+	if user := c.SSHUser(8080); user != "" {
+		t.Errorf("expected no user for non-SSH port 8080, got %q", user)
+	}
+	if user := c.SSHUser(9999); user != "" {
+		t.Errorf("expected no user for unknown port 9999, got %q", user)
+	}
+}
+
+func awaitReconnectEvent(t *testing.T, ctx context.Context, events <-chan ReconnectEvent, eventType ReconnectEventType) ReconnectEvent {
+	t.Helper()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("reconnect events closed before event type %d", eventType)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for reconnect event type %d", eventType)
+		}
+	}
+}
+
+func TestAutoReconnectRestoresForwardedPorts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(
+		tunnelstest.WithEchoStreams(),
+		tunnelstest.WithPortsForwardedOnConnect(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectLocalForwardingClient(t, ctx, relayServer, WithAutoReconnect(ReconnectPolicy{InitialBackoff: 10 * time.Millisecond}))
+	defer c.Close()
+
+	port := freeLocalPort(t)
+	if err := relayServer.ForwardPort(ctx, port); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, port); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+	localPort := awaitLocalForwardedPort(t, ctx, c, port)
+
+	if err := relayServer.DropConnection(); err != nil {
+		t.Fatal(err)
+	}
+	awaitReconnectEvent(t, ctx, c.ReconnectEvents(), ReconnectEventAttempt)
+	awaitReconnectEvent(t, ctx, c.ReconnectEvents(), ReconnectEventSucceeded)
+
+	if err := c.WaitForForwardedPort(ctx, port); err != nil {
+		t.Fatalf("port was not restored: %v", err)
+	}
+	if restored := awaitLocalForwardedPort(t, ctx, c, port); restored != localPort {
+		t.Errorf("expected the port to be restored on local port %d, got %d", localPort, restored)
+	}
+	assertLocalEcho(t, localPort)
+}
+
+func TestAutoReconnectGivesUpAfterMaxAttempts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer, WithAutoReconnect(ReconnectPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: 10 * time.Millisecond,
+	}))
+	defer c.Close()
+
+	if err := relayServer.DropConnection(); err != nil {
+		t.Fatal(err)
+	}
+	relayServer.Close()
+
+	event := awaitReconnectEvent(t, ctx, c.ReconnectEvents(), ReconnectEventFailed)
+	if event.Attempt != 2 || event.Err == nil {
+		t.Errorf("expected to give up after 2 attempts with an error, got attempt %d: %v", event.Attempt, event.Err)
+	}
+	select {
+	case _, ok := <-c.ReconnectEvents():
+		if ok {
+			t.Error("expected no events after giving up")
+		}
+	case <-ctx.Done():
+		t.Error("expected reconnect events to be closed after giving up")
+	}
+}
+
+func TestManagerNewClientUsesManagerToken(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithAccessToken("Tunnel connect-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer user-token" {
+			t.Errorf("expected the manager's token, got %q", got)
+		}
+		if got := r.URL.Query().Get("tokenScopes"); got != string(TunnelAccessScopeConnect) {
+			t.Errorf("expected a connect token to be requested, got %q", got)
+		}
+		writeJSON(w, Tunnel{
+			ClusterID:    "usw2",
+			TunnelID:     "abc123",
+			AccessTokens: map[TunnelAccessScope]string{TunnelAccessScopeConnect: "connect-token"},
+			Endpoints: []TunnelEndpoint{
+				{
+					HostID:         "host1",
+					HostPublicKeys: relayServer.HostPublicKeys(),
+					TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+						ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+					},
+				},
+			},
+		})
+	})
+	defer done()
+	managementClient = managementClient.WithTokenProvider(func() string { return "Bearer user-token" })
+
+	c, err := managementClient.NewClient(ctx, &Tunnel{ClusterID: "usw2", TunnelID: "abc123"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case err := <-relayServer.Err():
+		t.Errorf("relay server error: %v", err)
+	default:
+	}
+}
+
+func TestWaitForForwardedPortRemoved(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer)
+	defer c.Close()
+
+	for _, port := range []uint16{8030, 8031} {
+		if err := relayServer.ForwardPort(ctx, port); err != nil {
+			t.Fatalf("forward port failed: %v", err)
+		}
+		if err := c.WaitForForwardedPort(ctx, port); err != nil {
+			t.Fatalf("wait for forwarded port failed: %v", err)
+		}
+	}
+	if ports := c.ForwardedPorts(); !reflect.DeepEqual(ports, []uint16{8030, 8031}) {
+		t.Errorf("expected ports 8030 and 8031 to be forwarded, got %v", ports)
+	}
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- c.WaitForForwardedPortRemoved(ctx, 8030)
+	}()
+	if err := relayServer.CancelForwardPort(ctx, 8030); err != nil {
+		t.Fatalf("cancel forward port failed: %v", err)
+	}
+	if err := <-removed; err != nil {
+		t.Fatalf("wait for removed port failed: %v", err)
+	}
+	if ports := c.ForwardedPorts(); !reflect.DeepEqual(ports, []uint16{8031}) {
+		t.Errorf("expected only port 8031 to be forwarded, got %v", ports)
+	}
+	if err := c.WaitForForwardedPortRemoved(ctx, 8030); err != nil {
+		t.Errorf("expected an already removed port to return immediately, got %v", err)
+	}
+}
+
+func awaitConnectionEvent(t *testing.T, ctx context.Context, events <-chan ConnectionEvent) ConnectionEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("connection events closed")
+		}
+		return event
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for a connection event")
+	}
+	return ConnectionEvent{}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer)
+	relayURI := strings.Replace(relayServer.URL(), "http://", "ws://", 1)
+
+	for _, state := range []ConnectionState{ConnectionStateConnecting, ConnectionStateConnected} {
+		event := awaitConnectionEvent(t, ctx, c.ConnectionEvents())
+		if event.State != state || event.HostID != "host1" || event.ClientRelayURI != relayURI || event.Time.IsZero() {
+			t.Errorf("expected state %d for host1 at %s, got %+v", state, relayURI, event)
+		}
+	}
+
+	if err := relayServer.DropConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if event := awaitConnectionEvent(t, ctx, c.ConnectionEvents()); event.State != ConnectionStateDisconnected {
+		t.Errorf("expected a disconnected event, got %+v", event)
+	}
+
+	c.Close()
+	if event := awaitConnectionEvent(t, ctx, c.ConnectionEvents()); event.State != ConnectionStateClosed {
+		t.Errorf("expected a closed event, got %+v", event)
+	}
+	if _, ok := <-c.ConnectionEvents(); ok {
+		t.Error("expected connection events to be closed after the client is closed")
+	}
+}
+
+func TestConnectionEventsReconnecting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, relayServer, WithAutoReconnect(ReconnectPolicy{InitialBackoff: 10 * time.Millisecond}))
+	defer c.Close()
+	awaitConnectionEvent(t, ctx, c.ConnectionEvents())
+	awaitConnectionEvent(t, ctx, c.ConnectionEvents())
+
+	if err := relayServer.DropConnection(); err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []ConnectionState{
+		ConnectionStateDisconnected, ConnectionStateReconnecting, ConnectionStateConnected,
+	} {
+		if event := awaitConnectionEvent(t, ctx, c.ConnectionEvents()); event.State != state {
+			t.Fatalf("expected state %d, got %+v", state, event)
+		}
+	}
+}
+
+// connectLocalForwardingClient connects a client that accepts local connections for
+// forwarded ports.
+func connectLocalForwardingClient(
+	t *testing.T, ctx context.Context, relayServer *tunnelstest.RelayServer, opts ...ClientOption,
+) *Client {
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+	c, err := NewClient(log.New(io.Discard, "", 0), &tunnel, true, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	return c
+}
+
+// freeLocalPort returns a local port that is likely to be free.
+func freeLocalPort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestLocalForwardedPort(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectLocalForwardingClient(t, ctx, relayServer)
+	defer c.Close()
+
+	port := freeLocalPort(t)
+
+	if _, ok := c.LocalForwardedPort(port); ok {
+		t.Fatal("expected no local port before the port is forwarded")
+	}
+	if err := relayServer.ForwardPort(ctx, port); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+
+	localPort := awaitLocalForwardedPort(t, ctx, c, port)
+	assertLocalEcho(t, localPort)
+}
+
+// awaitLocalForwardedPort waits until the client listens for the forwarded port and
+// returns the local port it listens on.
+func awaitLocalForwardedPort(t *testing.T, ctx context.Context, c *Client, port uint16) uint16 {
+	t.Helper()
+	for {
+		if localPort, ok := c.LocalForwardedPort(port); ok {
+			return localPort
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the client to listen for the forwarded port")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// assertLocalEcho checks that data written to localPort is echoed back.
+func assertLocalEcho(t *testing.T, localPort uint16) {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read from local connection failed: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected echo of ping, got %q", buf)
+	}
+}
+
+func TestCancelForwardPortClosesLocalListener(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectLocalForwardingClient(t, ctx, relayServer)
+	defer c.Close()
+
+	port := freeLocalPort(t)
+	if err := relayServer.ForwardPort(ctx, port); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	localPort := awaitLocalForwardedPort(t, ctx, c, port)
+
+	if err := relayServer.CancelForwardPort(ctx, port); err != nil {
+		t.Fatalf("cancel forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPortRemoved(ctx, port); err != nil {
+		t.Fatalf("wait for removed port failed: %v", err)
+	}
+	if _, ok := c.LocalForwardedPort(port); ok {
+		t.Error("expected no local port after forwarding was canceled")
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort)); err == nil {
+		conn.Close()
+		t.Errorf("expected local port %d to be closed", localPort)
+	}
+}
+
+func TestLocalForwardedPortBindsLoopbackByDefault(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listening := make(chan net.Addr, 1)
+	c := connectLocalForwardingClient(t, ctx, relayServer, WithLocalListenerObserver(
+		func(remotePort uint16, localAddr net.Addr) {
+			listening <- localAddr
+		}))
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, freeLocalPort(t)); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	select {
+	case addr := <-listening:
+		if ip := addr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("expected the listener to bind to the loopback address, got %v", addr)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the client to listen for the forwarded port")
+	}
+}
+
+func TestLocalPortMapping(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotePort, localPort := freeLocalPort(t), freeLocalPort(t)
+	listening := make(chan net.Addr, 1)
+	c := connectLocalForwardingClient(t, ctx, relayServer,
+		WithLocalBindAddress(net.IPv4(127, 0, 0, 1)),
+		WithLocalPortMapping(map[uint16]uint16{remotePort: localPort}),
+		WithLocalListenerObserver(func(port uint16, localAddr net.Addr) {
+			if port == remotePort {
+				listening <- localAddr
+			}
+		}))
+	defer c.Close()
+
+	if err := relayServer.ForwardPort(ctx, remotePort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	select {
+	case addr := <-listening:
+		if port := addr.(*net.TCPAddr).Port; port != int(localPort) {
+			t.Errorf("expected the listener on mapped port %d, got %v", localPort, addr)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the client to listen for the forwarded port")
+	}
+	if port, ok := c.LocalForwardedPort(remotePort); !ok || port != localPort {
+		t.Errorf("expected local port %d, got %d", localPort, port)
+	}
+}
+
+func TestConnectAnonymously(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithAnonymousAccess(), tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tunnel has no access tokens, so the client sends no Authorization header.
+	c := connectTestClient(t, relayServer)
+	defer c.Close()
+
+	port := uint16(8011)
+	if err := relayServer.ForwardPort(ctx, port); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	if err := c.WaitForForwardedPort(ctx, port); err != nil {
+		t.Fatalf("wait for forwarded port failed: %v", err)
+	}
+	stream, _ := c.ConnectToForwardedPort(ctx, nil, port)
+	defer stream.Close()
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatalf("read from stream failed: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected echo of ping, got %q", buf)
+	}
+}
+
+func TestConnectAnonymouslyRejectsToken(t *testing.T) {
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithAnonymousAccess())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := Tunnel{
+		AccessTokens: map[TunnelAccessScope]string{TunnelAccessScopeConnect: "connect-token"},
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+	c, err := NewClient(log.New(io.Discard, "", 0), &tunnel, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test relay rejects the Authorization header, which shows that it is sent when
+	// the tunnel has a connect token.
+	if err := c.Connect(ctx, ""); err == nil {
+		c.Close()
+		t.Fatal("expected the relay to reject a connection with an Authorization header")
+	}
+}
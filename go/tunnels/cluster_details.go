@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rodaine/table"
+)
+
+// ErrClusterNotFound is returned by GetCluster when the service has no cluster with the ID.
+var ErrClusterNotFound = errors.New("tunnel service cluster not found")
+
+// ClusterDetails describes a cluster of the tunnel service.
+type ClusterDetails struct {
+	// ClusterID is the ID of the cluster, such as "usw2". Tunnels created in the
+	// cluster have this cluster ID.
+	ClusterID string `json:"clusterId"`
+
+	// URI is the base URI of the cluster's tunnel service API.
+	URI string `json:"uri"`
+
+	// AzureLocation is the Azure location of the cluster, such as "westus2".
+	AzureLocation string `json:"azureLocation"`
+
+	// IsDefault indicates whether tunnels are created in this cluster
+	// when no cluster ID is specified.
+	IsDefault bool `json:"isDefault,omitempty"`
+}
+
+// Clusters is a list of tunnel service clusters, as returned by Manager.ListClusters.
+type Clusters []*ClusterDetails
+
+// Default returns the default cluster, or false if no cluster is marked as the default.
+func (c Clusters) Default() (*ClusterDetails, bool) {
+	for _, cluster := range c {
+		if cluster != nil && cluster.IsDefault {
+			return cluster, true
+		}
+	}
+	return nil, false
+}
+
+// ByID returns the cluster with the specified ID, or false if there is no such cluster.
+func (c Clusters) ByID(clusterID string) (*ClusterDetails, bool) {
+	for _, cluster := range c {
+		if cluster != nil && cluster.ClusterID == clusterID {
+			return cluster, true
+		}
+	}
+	return nil, false
+}
+
+// Gets a cluster of the tunnel service by ID, including the URI of its service API.
+// Returns an error if clusterID is not a valid cluster ID, or ErrClusterNotFound if the
+// service does not list a cluster with the ID.
+func (m *Manager) GetCluster(ctx context.Context, clusterID string, options *TunnelRequestOptions) (*ClusterDetails, error) {
+	if TunnelConstraintsClusterIDRegex.FindString(clusterID) != clusterID || clusterID == "" {
+		return nil, fmt.Errorf("invalid cluster ID %q", clusterID)
+	}
+	clusters, err := m.ListClusters(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	cluster, ok := clusters.ByID(clusterID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrClusterNotFound, clusterID)
+	}
+	return cluster, nil
+}
+
+func (c Clusters) Table() table.Table {
+	tbl := table.New("ClusterId", "Azure Location", "URI", "Default")
+	for _, cluster := range c {
+		if cluster == nil {
+			continue
+		}
+		isDefault := ""
+		if cluster.IsDefault {
+			isDefault = "*"
+		}
+		tbl.AddRow(cluster.ClusterID, cluster.AzureLocation, cluster.URI, isDefault)
+	}
+	return tbl
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListClusters(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/clusters" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{ "clusterId": "usw2", "uri": "https://usw2.rel.tunnels.api.visualstudio.com/", "azureLocation": "westus2" },
+			{ "clusterId": "euw", "uri": "https://euw.rel.tunnels.api.visualstudio.com/", "azureLocation": "westeurope", "isDefault": true }
+		]`))
+	})
+	defer closeServer()
+
+	clusters, err := managementClient.ListClusters(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %d", len(clusters))
+	}
+
+	defaultCluster, ok := clusters.Default()
+	if !ok || defaultCluster.ClusterID != "euw" {
+		t.Errorf("expected euw to be the default cluster, got %+v", defaultCluster)
+	}
+
+	cluster, ok := clusters.ByID("usw2")
+	if !ok || cluster.AzureLocation != "westus2" || cluster.URI != "https://usw2.rel.tunnels.api.visualstudio.com/" {
+		t.Errorf("unexpected cluster usw2: %+v", cluster)
+	}
+	if _, ok := clusters.ByID("none"); ok {
+		t.Errorf("expected no cluster with ID none")
+	}
+
+	var buf bytes.Buffer
+	clusters.Table().WithWriter(&buf).Print()
+	if !strings.Contains(buf.String(), "westeurope") {
+		t.Errorf("table does not include the clusters:\n%s", buf.String())
+	}
+}
+
+func TestGetCluster(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Clusters{
+			{ClusterID: "usw2", URI: "https://usw2.rel.tunnels.api.visualstudio.com/", AzureLocation: "westus2"},
+		})
+	})
+	defer closeServer()
+
+	cluster, err := managementClient.GetCluster(ctx, "usw2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.URI != "https://usw2.rel.tunnels.api.visualstudio.com/" {
+		t.Errorf("unexpected cluster URI %q", cluster.URI)
+	}
+
+	if _, err := managementClient.GetCluster(ctx, "euw", nil); !errors.Is(err, ErrClusterNotFound) {
+		t.Errorf("expected ErrClusterNotFound, got %v", err)
+	}
+	for _, clusterID := range []string{"", "u", "US-W2", "usw2.example"} {
+		if _, err := managementClient.GetCluster(ctx, clusterID, nil); err == nil || errors.Is(err, ErrClusterNotFound) {
+			t.Errorf("expected an invalid cluster ID error for %q, got %v", clusterID, err)
+		}
+	}
+}
+
+func TestClustersDefaultWhenNoneIsMarked(t *testing.T) {
+	clusters := Clusters{{ClusterID: "usw2"}}
+	if _, ok := clusters.Default(); ok {
+		t.Errorf("expected no default cluster")
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptEncoding is the Accept-Encoding header sent with requests to the tunnel service.
+// Setting it disables the transparent decompression of http.Transport, so responses are
+// decompressed by decompressResponse instead, whatever http client the manager uses.
+const acceptEncoding = "gzip, deflate"
+
+// decompressedBody reads a decompressed response body and closes the original body.
+type decompressedBody struct {
+	io.Reader
+	decompressor io.Closer
+	body         io.Closer
+}
+
+func (b *decompressedBody) Close() error {
+	b.decompressor.Close()
+	return b.body.Close()
+}
+
+// decompressResponse replaces the body of a response with a gzip or deflate
+// Content-Encoding by the decompressed body, and removes the encoding from the headers.
+func decompressResponse(response *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	var decompressor io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		decompressor, err = gzip.NewReader(response.Body)
+	case "deflate":
+		decompressor, err = zlib.NewReader(response.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error decompressing %s response: %w", encoding, err)
+	}
+
+	response.Body = &decompressedBody{Reader: decompressor, decompressor: decompressor, body: response.Body}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+	return nil
+}
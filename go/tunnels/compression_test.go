@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func writeCompressedJSON(t *testing.T, w http.ResponseWriter, encoding string, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", encoding)
+	var compressor io.WriteCloser
+	if encoding == "gzip" {
+		compressor = gzip.NewWriter(w)
+	} else {
+		compressor = zlib.NewWriter(w)
+	}
+	if err := json.NewEncoder(compressor).Encode(value); err != nil {
+		t.Error(err)
+	}
+	compressor.Close()
+}
+
+func TestManagerDecompressesResponses(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+				if accept := r.Header.Get("Accept-Encoding"); accept != acceptEncoding {
+					t.Errorf("unexpected Accept-Encoding %q", accept)
+				}
+				writeCompressedJSON(t, w, encoding, []Tunnel{{TunnelID: "tunnel1"}, {TunnelID: "tunnel2"}})
+			})
+			defer done()
+
+			tunnels, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tunnels) != 2 || tunnels[0].TunnelID != "tunnel1" {
+				t.Errorf("unexpected tunnels %v", tunnels)
+			}
+		})
+	}
+}
+
+func TestManagerDecompressesErrorResponses(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+		compressor := gzip.NewWriter(w)
+		compressor.Write([]byte(`{"title":"Bad request"}`))
+		compressor.Close()
+	})
+	defer done()
+
+	_, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{})
+	var tunnelServiceErr *TunnelServiceError
+	if !errors.As(err, &tunnelServiceErr) {
+		t.Fatalf("expected a TunnelServiceError, got %v", err)
+	}
+	if tunnelServiceErr.ProblemDetails == nil ||
+		tunnelServiceErr.ProblemDetails.Title != "Bad request" {
+		t.Errorf("expected the problem details to be decompressed, got %v", err)
+	}
+}
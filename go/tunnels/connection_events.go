@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"time"
+
+	tunnelssh "github.com/microsoft/dev-tunnels/go/tunnels/ssh"
+)
+
+// ConnectionState is the state of a client's connection to the host, reported by a
+// ConnectionEvent.
+type ConnectionState int
+
+const (
+	// ConnectionStateConnecting is sent before the client connects to a relay endpoint
+	// or over a transport.
+	ConnectionStateConnecting ConnectionState = iota
+
+	// ConnectionStateConnected is sent when the SSH session with the host is established,
+	// including after reconnecting.
+	ConnectionStateConnected
+
+	// ConnectionStateDisconnected is sent when the connection drops, when connecting
+	// fails, or when the client gives up reconnecting. Err holds the cause.
+	ConnectionStateDisconnected
+
+	// ConnectionStateReconnecting is sent before each attempt to reconnect after the
+	// connection dropped, when WithAutoReconnect is used.
+	ConnectionStateReconnecting
+
+	// ConnectionStateClosed is sent when the client is closed. It is the last event.
+	ConnectionStateClosed
+)
+
+// ConnectionEvent reports a change in the state of a client's connection to the host.
+type ConnectionEvent struct {
+	State ConnectionState
+
+	// Time is when the state changed.
+	Time time.Time
+
+	// HostID is the ID of the host the client connects to.
+	HostID string
+
+	// ClientRelayURI is the relay endpoint the client connects through, or empty when
+	// the client connects with ConnectWithTransport.
+	ClientRelayURI string
+
+	// Err is the reason the client disconnected when State is ConnectionStateDisconnected.
+	Err error
+}
+
+// ConnectionEvents returns a channel that receives an event each time the state of the
+// connection changes. The channel is closed after the ConnectionStateClosed event when
+// the client is closed. Events are dropped if the receiver falls behind, so that a slow
+// receiver does not stall the connection.
+func (c *Client) ConnectionEvents() <-chan ConnectionEvent {
+	return c.connectionEvents
+}
+
+func (c *Client) sendConnectionEvent(state ConnectionState, clientRelayURI string, err error) {
+	c.connectionEventsMu.Lock()
+	defer c.connectionEventsMu.Unlock()
+	if c.connectionEventsClosed {
+		return
+	}
+
+	event := ConnectionEvent{
+		State:          state,
+		Time:           time.Now(),
+		HostID:         c.hostID,
+		ClientRelayURI: clientRelayURI,
+		Err:            err,
+	}
+	select {
+	case c.connectionEvents <- event:
+	default:
+	}
+
+	if state == ConnectionStateClosed {
+		c.connectionEventsClosed = true
+		close(c.connectionEvents)
+	}
+}
+
+// watchConnection sends a ConnectionStateDisconnected event when session ends, unless the
+// client was closed. It is used when the client does not reconnect, since the reconnect
+// loop watches the connection otherwise.
+func (c *Client) watchConnection(session *tunnelssh.ClientSSHSession, clientRelayURI string) {
+	err := session.Wait()
+	if !c.isClosed() {
+		c.sendConnectionEvent(ConnectionStateDisconnected, clientRelayURI, err)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxDumpBodyLength is the number of body bytes included in a debug dump.
+	maxDumpBodyLength = 2048
+
+	redacted = "<redacted>"
+)
+
+// WithDebugDump makes the manager log the method, URL, headers and body of every
+// request and response to logger, for diagnosing issues with the tunnel service.
+// Authorization headers, access tokens and signatures are redacted, and bodies
+// are truncated.
+func WithDebugDump(logger *log.Logger) ManagerOption {
+	return func(m *Manager) {
+		m.debugLogger = logger
+	}
+}
+
+func (m *Manager) dumpRequest(request *http.Request, body []byte) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Request: %s %s\n", request.Method, redactURL(request.URL))
+	writeDumpHeaders(&sb, request.Header)
+	writeDumpBody(&sb, body)
+	m.debugLogger.Print(sb.String())
+}
+
+// dumpResponse logs the response, replacing its body so that it can still be read.
+func (m *Manager) dumpResponse(response *http.Response) error {
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Response: %s\n", response.Status)
+	writeDumpHeaders(&sb, response.Header)
+	writeDumpBody(&sb, body)
+	m.debugLogger.Print(sb.String())
+	return nil
+}
+
+func writeDumpHeaders(sb *strings.Builder, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			if isSensitiveName(name) {
+				value = redacted
+			}
+			fmt.Fprintf(sb, "%s: %s\n", name, value)
+		}
+	}
+}
+
+func writeDumpBody(sb *strings.Builder, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		// Tokens cannot be found reliably in a body that is not JSON, so leave it out.
+		fmt.Fprintf(sb, "<%d bytes>\n", len(body))
+		return
+	}
+	redactedBody, err := json.Marshal(redactJSON(value))
+	if err != nil {
+		fmt.Fprintf(sb, "<%d bytes>\n", len(body))
+		return
+	}
+
+	if len(redactedBody) > maxDumpBodyLength {
+		fmt.Fprintf(sb, "%s... (%d bytes)\n", redactedBody[:maxDumpBodyLength], len(redactedBody))
+	} else {
+		fmt.Fprintf(sb, "%s\n", redactedBody)
+	}
+}
+
+// redactJSON replaces the values of JSON properties that hold tokens.
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if isSensitiveName(key) {
+				v[key] = redactValue(item)
+			} else {
+				v[key] = redactJSON(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactJSON(item)
+		}
+	}
+	return value
+}
+
+// redactValue redacts a token, or each token in a map of tokens such as Tunnel.AccessTokens.
+func redactValue(value interface{}) interface{} {
+	if tokens, ok := value.(map[string]interface{}); ok {
+		for key := range tokens {
+			tokens[key] = redacted
+		}
+		return tokens
+	}
+	return redacted
+}
+
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	if len(query) == 0 {
+		return u.String()
+	}
+
+	redactedURL := *u
+	for name := range query {
+		if isSensitiveName(name) || strings.EqualFold(name, "sig") {
+			query.Set(name, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+	return redactedURL.String()
+}
+
+func isSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "authorization") ||
+		strings.Contains(name, "token") ||
+		strings.Contains(name, "cookie") ||
+		strings.Contains(name, "signature")
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// DryRunRequest describes a request that a dry-run manager prepared but did not send.
+type DryRunRequest struct {
+	Method string
+
+	// URL is the request URL, with signatures and tokens in the query redacted.
+	URL string
+
+	// Header holds the request headers, with authorization and token values redacted.
+	Header http.Header
+
+	Body []byte
+}
+
+// DryRunError is returned instead of a response by a manager created with WithDryRun,
+// for each request that would change the tunnel service state.
+type DryRunError struct {
+	Request *DryRunRequest
+}
+
+func (e *DryRunError) Error() string {
+	return fmt.Sprintf("dry run: %s %s was not sent", e.Request.Method, e.Request.URL)
+}
+
+// WithDryRun makes the manager validate and build requests that would create, update or
+// delete tunnels, ports or endpoints, without sending them. Such calls return a *DryRunError
+// describing the request. Requests that only read from the service are still sent.
+func WithDryRun() ManagerOption {
+	return func(m *Manager) {
+		m.dryRun = true
+	}
+}
+
+func newDryRunRequest(request *http.Request, body []byte) *DryRunRequest {
+	header := make(http.Header, len(request.Header))
+	for name, values := range request.Header {
+		for _, value := range values {
+			if isSensitiveName(name) {
+				value = redacted
+			}
+			header.Add(name, value)
+		}
+	}
+	return &DryRunRequest{
+		Method: request.Method,
+		URL:    redactURL(request.URL),
+		Header: header,
+		Body:   body,
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// maxEntityTags is the number of tunnels and ports whose entity tags a manager keeps.
+// The tags of the least recently used tunnels and ports are forgotten first.
+const maxEntityTags = 1000
+
+// entityTagCache holds the entity tags the service returned with tunnels and ports, so
+// that an update fails if the tunnel or port was changed since it was read. Tags are
+// keyed by the *Tunnel or *TunnelPort they were returned with, so that an update sends
+// the tag of the object being updated, and not of another copy of the same tunnel.
+type entityTagCache struct {
+	mu      sync.Mutex
+	tags    map[interface{}]*list.Element
+	entries *list.List
+}
+
+type entityTagEntry struct {
+	entity interface{}
+	etag   string
+}
+
+func (c *entityTagCache) get(entity interface{}) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.tags[entity]
+	if !ok {
+		return ""
+	}
+	c.entries.MoveToFront(element)
+	return element.Value.(*entityTagEntry).etag
+}
+
+// set records the entity tag from the header of a response for each of the entities,
+// or forgets their previous tag if the response did not have one.
+func (c *entityTagCache) set(header http.Header, entities ...interface{}) {
+	etag := header.Get("ETag")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entity := range entities {
+		if etag == "" {
+			c.removeLocked(entity)
+			continue
+		}
+		if element, ok := c.tags[entity]; ok {
+			element.Value.(*entityTagEntry).etag = etag
+			c.entries.MoveToFront(element)
+			continue
+		}
+		if c.tags == nil {
+			c.tags = make(map[interface{}]*list.Element)
+			c.entries = list.New()
+		}
+		c.tags[entity] = c.entries.PushFront(&entityTagEntry{entity, etag})
+		if c.entries.Len() > maxEntityTags {
+			c.removeLocked(c.entries.Back().Value.(*entityTagEntry).entity)
+		}
+	}
+}
+
+// remove forgets the entity tag of the tunnel or port.
+func (c *entityTagCache) remove(entity interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(entity)
+}
+
+func (c *entityTagCache) removeLocked(entity interface{}) {
+	if element, ok := c.tags[entity]; ok {
+		c.entries.Remove(element)
+		delete(c.tags, entity)
+	}
+}
+
+// ifMatch returns options that make an update of the tunnel or port conditional on the
+// entity tag it was read with, unless the options skip the concurrency check or the
+// manager has no tag for it.
+func (m *Manager) ifMatch(options *TunnelRequestOptions, entity interface{}) *TunnelRequestOptions {
+	if options != nil && options.SkipConcurrencyCheck {
+		return options
+	}
+	etag := m.entityTags.get(entity)
+	if etag == "" {
+		return options
+	}
+	return options.withAdditionalHeader("If-Match", etag)
+}
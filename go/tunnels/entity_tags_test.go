@@ -0,0 +1,44 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEntityTagCacheForgetsLeastRecentlyUsed(t *testing.T) {
+	cache := &entityTagCache{}
+	header := http.Header{}
+	header.Set("ETag", `"v1"`)
+
+	tunnels := make([]*Tunnel, maxEntityTags+1)
+	for i := range tunnels {
+		tunnels[i] = &Tunnel{}
+	}
+	for _, tunnel := range tunnels[:maxEntityTags] {
+		cache.set(header, tunnel)
+	}
+	// Reading the first tunnel's tag makes the second tunnel's the least recently used.
+	cache.get(tunnels[0])
+	cache.set(header, tunnels[maxEntityTags])
+
+	if etag := cache.get(tunnels[0]); etag != `"v1"` {
+		t.Errorf("expected the recently used tag to be kept, got %q", etag)
+	}
+	if etag := cache.get(tunnels[1]); etag != "" {
+		t.Errorf("expected the least recently used tag to be forgotten, got %q", etag)
+	}
+	if etag := cache.get(tunnels[maxEntityTags]); etag != `"v1"` {
+		t.Errorf("expected the newest tag to be kept, got %q", etag)
+	}
+	if len(cache.tags) != maxEntityTags || cache.entries.Len() != maxEntityTags {
+		t.Errorf("expected %d tags, got %d", maxEntityTags, len(cache.tags))
+	}
+
+	cache.set(http.Header{}, tunnels[0])
+	if etag := cache.get(tunnels[0]); etag != "" {
+		t.Errorf("expected the tag to be forgotten for a response without one, got %q", etag)
+	}
+}
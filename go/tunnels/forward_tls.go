@@ -0,0 +1,69 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ForwardTLS configures TLS at the boundary between local connections to forwarded
+// ports and the channels to the host. By default data is passed through unchanged.
+type ForwardTLS struct {
+	// LocalConfig, if set, terminates TLS on local connections to forwarded ports,
+	// presenting its certificates to the local client and forwarding plaintext to the host.
+	LocalConfig *tls.Config
+
+	// RemoteConfig, if set, originates TLS to the host over the channel, so that a local
+	// client speaking plaintext can reach a forwarded port that expects TLS.
+	RemoteConfig *tls.Config
+}
+
+// WithForwardTLS terminates or originates TLS for connections to forwarded ports,
+// as described by forwardTLS. Local TLS termination applies to connections accepted
+// by the client's listeners, not to streams from ConnectToForwardedPort.
+func WithForwardTLS(forwardTLS *ForwardTLS) ClientOption {
+	return func(c *Client) {
+		c.forwardTLS = forwardTLS
+	}
+}
+
+// wrap returns the local connection and channel to copy between, with TLS applied.
+func (f *ForwardTLS) wrap(conn io.ReadWriteCloser, channel ssh.Channel) (io.ReadWriter, io.ReadWriter) {
+	var local io.ReadWriter = conn
+	var remote io.ReadWriter = channel
+	if f == nil {
+		return local, remote
+	}
+	if netConn, ok := conn.(net.Conn); ok && f.LocalConfig != nil {
+		local = tls.Server(netConn, f.LocalConfig)
+	}
+	if f.RemoteConfig != nil {
+		remote = tls.Client(&channelConn{Channel: channel}, f.RemoteConfig)
+	}
+	return local, remote
+}
+
+var errChannelDeadline = errors.New("deadlines are not supported on tunnel channels")
+
+// channelConn adapts an SSH channel to net.Conn so that TLS can run over it.
+type channelConn struct {
+	ssh.Channel
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return channelAddr{} }
+func (c *channelConn) RemoteAddr() net.Addr               { return channelAddr{} }
+func (c *channelConn) SetDeadline(t time.Time) error      { return errChannelDeadline }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return errChannelDeadline }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return errChannelDeadline }
+
+type channelAddr struct{}
+
+func (channelAddr) Network() string { return "ssh" }
+func (channelAddr) String() string  { return "tunnel channel" }
@@ -0,0 +1,90 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+)
+
+// ForwardedConnection describes a local connection that is forwarded to a remote port.
+type ForwardedConnection struct {
+	// ID identifies the connection within the client.
+	ID uint64
+
+	// Port is the remote port the connection is forwarded to.
+	Port uint16
+
+	// RemoteAddr is the address of the local peer, or nil if it is not known.
+	RemoteAddr net.Addr
+}
+
+type forwardedConnections struct {
+	mu          sync.Mutex
+	lastID      uint64
+	connections map[uint64]*forwardedConnection
+}
+
+type forwardedConnection struct {
+	info   ForwardedConnection
+	cancel context.CancelFunc
+}
+
+func newForwardedConnections() *forwardedConnections {
+	return &forwardedConnections{
+		connections: make(map[uint64]*forwardedConnection),
+	}
+}
+
+func (f *forwardedConnections) add(port uint16, remoteAddr net.Addr, cancel context.CancelFunc) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastID++
+	f.connections[f.lastID] = &forwardedConnection{
+		info: ForwardedConnection{
+			ID:         f.lastID,
+			Port:       port,
+			RemoteAddr: remoteAddr,
+		},
+		cancel: cancel,
+	}
+	return f.lastID
+}
+
+func (f *forwardedConnections) remove(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.connections, id)
+}
+
+func (f *forwardedConnections) list(port uint16) []ForwardedConnection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result []ForwardedConnection
+	for _, conn := range f.connections {
+		if conn.info.Port == port {
+			result = append(result, conn.info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (f *forwardedConnections) close(id uint64) bool {
+	f.mu.Lock()
+	conn, ok := f.connections[id]
+	f.mu.Unlock()
+
+	if ok {
+		conn.cancel()
+	}
+	return ok
+}
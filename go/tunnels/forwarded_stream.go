@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"io"
+)
+
+// forwardedStream is a stream returned by ConnectToForwardedPort. What the caller writes
+// is sent to the forwarded port, and what the port sends is read by the caller.
+// Closing it ends only the connection to the forwarded port that it belongs to.
+type forwardedStream struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	cancel context.CancelFunc
+}
+
+// forwardedStreamConn is the end of a forwardedStream that the client copies to and from
+// the channel to the forwarded port.
+type forwardedStreamConn struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// newForwardedStream returns a stream for the caller of ConnectToForwardedPort and the
+// connection connected to it, for the client to copy to and from the channel.
+func newForwardedStream(cancel context.CancelFunc) (*forwardedStream, *forwardedStreamConn) {
+	fromPort, toStream := io.Pipe()
+	fromStream, toPort := io.Pipe()
+	return &forwardedStream{reader: fromPort, writer: toPort, cancel: cancel},
+		&forwardedStreamConn{reader: fromStream, writer: toStream}
+}
+
+func (s *forwardedStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *forwardedStream) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+// CloseWrite sends EOF to the forwarded port while the stream can still be read, if the
+// client was created with WithHalfClose.
+func (s *forwardedStream) CloseWrite() error {
+	return s.writer.Close()
+}
+
+func (s *forwardedStream) Close() error {
+	s.cancel()
+	s.writer.Close()
+	return s.reader.Close()
+}
+
+func (c *forwardedStreamConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *forwardedStreamConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// CloseWrite makes the caller's reads of the stream return EOF once it has read what
+// the forwarded port sent.
+func (c *forwardedStreamConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *forwardedStreamConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
@@ -0,0 +1,129 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUntrustedHostKey is returned when the host does not present an SSH certificate
+// signed by one of the certificate authorities trusted by the client.
+var ErrUntrustedHostKey = errors.New("the host key is not certified by a trusted certificate authority")
+
+// ErrHostKeyMismatch is returned when the host presents a key that is not among the
+// public keys the tunnel endpoints publish for the host.
+var ErrHostKeyMismatch = errors.New("the host key does not match a public key published for the host")
+
+// ErrNoHostPublicKeys is returned when the tunnel endpoints publish no public keys for
+// the host, so that the host key cannot be verified.
+var ErrNoHostPublicKeys = errors.New("the tunnel endpoints do not publish public keys for the host")
+
+// WithInsecureSkipHostKeyVerification makes the client accept any host key, even when the
+// tunnel endpoints publish the host's public keys or publish none. By default the client
+// only accepts a published key, so that a spoofed relay cannot intercept the connection,
+// and fails to connect if the endpoints publish no keys for the host.
+func WithInsecureSkipHostKeyVerification() ClientOption {
+	return func(c *Client) {
+		c.skipHostKeyVerification = true
+	}
+}
+
+// WithHostCertificateAuthorities makes the client verify the host during the SSH
+// handshake: the host must present an SSH host certificate signed by one of the
+// authorities. If the certificate lists principals, one of them must be the host ID.
+// This replaces verification against the public keys published by the tunnel endpoints.
+func WithHostCertificateAuthorities(authorities ...ssh.PublicKey) ClientOption {
+	return func(c *Client) {
+		c.hostCertificateAuthorities = authorities
+	}
+}
+
+// hostCertificateCallback returns an SSH host key callback that accepts host certificates
+// signed by one of the authorities and valid for the host ID.
+func hostCertificateCallback(authorities []ssh.PublicKey, hostID string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return fmt.Errorf("%w: the host did not present a certificate", ErrUntrustedHostKey)
+		}
+		if cert.CertType != ssh.HostCert {
+			return fmt.Errorf("%w: the certificate is not a host certificate", ErrUntrustedHostKey)
+		}
+
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				for _, authority := range authorities {
+					if bytes.Equal(auth.Marshal(), authority.Marshal()) {
+						return true
+					}
+				}
+				return false
+			},
+		}
+		if !checker.IsHostAuthority(cert.SignatureKey, hostname) {
+			return fmt.Errorf("%w: the certificate is signed by an unknown authority", ErrUntrustedHostKey)
+		}
+		if err := checker.CheckCert(hostID, cert); err != nil {
+			return fmt.Errorf("%w: %v", ErrUntrustedHostKey, err)
+		}
+		return nil
+	}
+}
+
+// hostPublicKeys returns the public keys published by the endpoints of the host.
+func hostPublicKeys(endpoints []TunnelEndpoint, hostID string) []string {
+	var keys []string
+	for _, endpoint := range endpoints {
+		if endpoint.HostID == hostID {
+			keys = append(keys, endpoint.HostPublicKeys...)
+		}
+	}
+	return keys
+}
+
+// parseHostPublicKey parses a base64 public key published by a tunnel endpoint, either in
+// the SSH wire format or as a PKIX public key.
+func parseHostPublicKey(encoded string) (ssh.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding host public key: %w", err)
+	}
+	if key, err := ssh.ParsePublicKey(b); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing host public key: %w", err)
+	}
+	return ssh.NewPublicKey(key)
+}
+
+// hostPublicKeyCallback returns an SSH host key callback that accepts only the published
+// public keys, or a certificate for one of them.
+func hostPublicKeyCallback(published []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			key = cert.Key
+		}
+		presented := key.Marshal()
+		for _, encoded := range published {
+			publishedKey, err := parseHostPublicKey(encoded)
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(publishedKey.Marshal(), presented) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: the host presented %s key %s",
+			ErrHostKeyMismatch, key.Type(), ssh.FingerprintSHA256(key))
+	}
+}
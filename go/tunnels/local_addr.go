@@ -0,0 +1,22 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"fmt"
+	"net"
+)
+
+// localTCPAddr returns the address to bind outgoing connections to, so that they
+// leave through the network interface that has ip. It returns an error if ip is not
+// assigned to an interface on this machine.
+func localTCPAddr(ip net.IP) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: ip}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("local address %s is not assignable: %w", ip, err)
+	}
+	listener.Close()
+	return addr, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Logger receives the log messages of a Client, so that they can be written with a
+// structured logging library such as zap, logrus or slog. Fields are passed as
+// alternating keys and values. Access tokens are redacted before they are logged.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// WithLogger makes the client log to logger instead of the *log.Logger passed to NewClient.
+func WithLogger(logger Logger) ClientOption {
+	return func(c *Client) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// NewStdLogger returns a Logger that writes each message to logger as one line with its
+// level and fields, such as `WARN Relay rejected the connection, retrying error="..."`.
+// Values of fields named like tokens or authorization, and tokens in messages, are
+// redacted. A nil logger discards the messages.
+func NewStdLogger(logger *log.Logger) Logger {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &stdLogger{logger: logger}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+}
+
+func (l *stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log("DEBUG", msg, keysAndValues)
+}
+
+func (l *stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log("INFO", msg, keysAndValues)
+}
+
+func (l *stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log("WARN", msg, keysAndValues)
+}
+
+func (l *stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log("ERROR", msg, keysAndValues)
+}
+
+func (l *stdLogger) log(level string, msg string, keysAndValues []interface{}) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		value := "<missing>"
+		if i+1 < len(keysAndValues) {
+			value = fmt.Sprint(keysAndValues[i+1])
+		}
+		if isSensitiveName(key) {
+			value = redacted
+		}
+		fmt.Fprintf(&sb, " %s=%q", key, value)
+	}
+	l.logger.Print(jwtPattern.ReplaceAllString(sb.String(), redacted))
+}
+
+// authorizationFingerprint returns the scheme of an Authorization header value with a
+// fingerprint of the token instead of the token, so that logs can tell tokens apart
+// without revealing them.
+func authorizationFingerprint(authorization string) string {
+	if authorization == "" {
+		return ""
+	}
+	scheme, token := "", authorization
+	if i := strings.Index(authorization, " "); i >= 0 {
+		scheme, token = authorization[:i+1], authorization[i+1:]
+	}
+	return scheme + tokenFingerprint(token)
+}
+
+// tokenFingerprint returns a prefix of the SHA-256 hash of a token and its length.
+func tokenFingerprint(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("sha256:%x (%d chars)", hash[:4], len(token))
+}
+
+// sshLogger adapts a Logger to the logger of the SSH session, which has no levels.
+type sshLogger struct {
+	logger Logger
+}
+
+func (l sshLogger) Printf(format string, v ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, v...))
+}
@@ -8,12 +8,18 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 var ServiceProperties = TunnelServiceProperties{
@@ -43,9 +49,13 @@ const (
 	apiV1Path                  = "/api/v1"
 	tunnelsApiPath             = apiV1Path + "/tunnels"
 	subjectsApiPath            = apiV1Path + "/subjects"
+	clustersApiPath            = apiV1Path + "/clusters"
 	endpointsApiSubPath        = "/endpoints"
 	portsApiSubPath            = "/ports"
+	servicePropertiesApiPath   = apiV1Path + "/serviceProperties"
 	tunnelAuthenticationScheme = "Tunnel"
+	continuationTokenHeader    = "X-Ms-Continuation"
+	listTunnelsMaxPages        = 100
 	goUserAgent                = "Visual-Studio-Tunnel-Service-Go-SDK/" + PackageVersion
 )
 
@@ -71,51 +81,418 @@ type Manager struct {
 	tokenProvider     tokenProviderfn
 	httpClient        *http.Client
 	uri               *url.URL
-	additionalHeaders map[string]string
+	additionalHeaders *defaultHeaders
 	userAgents        []UserAgent
+	resolver          Resolver
+	localAddr         net.IP
+	tlsConfig         *tls.Config
+	debugLogger       *log.Logger
+	dryRun            bool
+	metrics           MetricsRecorder
+	middlewares       []Middleware
+
+	portProtocolResolved func(tunnel *Tunnel, port *TunnelPort)
+
+	// serviceProperties caches the properties returned by GetServiceProperties.
+	serviceProperties *servicePropertiesCache
+
+	// tunnelClusters caches the clusters resolved by ResolveTunnelCluster.
+	tunnelClusters *tunnelClusterCache
+
+	// entityTags holds the entity tags of the tunnels and ports the manager returned,
+	// sent with updates of the same tunnels and ports.
+	entityTags *entityTagCache
+}
+
+// defaultHeaders holds the headers added to every request. They may be changed while
+// requests are in flight.
+type defaultHeaders struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+func (h *defaultHeaders) set(key, value string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]string)
+	}
+	h.values[key] = value
+}
+
+func (h *defaultHeaders) remove(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.values, key)
+}
+
+// addTo adds the headers to a request's headers.
+func (h *defaultHeaders) addTo(header http.Header) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for key, value := range h.values {
+		header.Add(key, value)
+	}
+}
+
+func (h *defaultHeaders) clone() *defaultHeaders {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c := &defaultHeaders{values: make(map[string]string, len(h.values))}
+	for key, value := range h.values {
+		c.values[key] = value
+	}
+	return c
+}
+
+type servicePropertiesCache struct {
+	mu         sync.Mutex
+	properties *TunnelServiceProperties
+}
+
+func (c *servicePropertiesCache) get() (*TunnelServiceProperties, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.properties == nil {
+		return nil, false
+	}
+	properties := *c.properties
+	return &properties, true
+}
+
+func (c *servicePropertiesCache) set(properties TunnelServiceProperties) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.properties = &properties
+}
+
+// ManagerOption configures optional behavior of a Manager.
+type ManagerOption func(*Manager)
+
+// WithTokenProvider sets the function that returns the access token to use for requests
+// that are not given a tunnel access token.
+func WithTokenProvider(tokenProvider func() string) ManagerOption {
+	return func(m *Manager) {
+		m.tokenProvider = tokenProvider
+	}
+}
+
+// WithServiceURL sets the URL of the tunnel service, instead of the production service.
+func WithServiceURL(serviceURL *url.URL) ManagerOption {
+	return func(m *Manager) {
+		m.uri = serviceURL
+	}
+}
+
+// WithHTTPClient sets the http client used to send requests to the tunnel service.
+// It cannot be combined with WithResolver, WithLocalAddr or WithTLSConfig.
+func WithHTTPClient(httpClient *http.Client) ManagerOption {
+	return func(m *Manager) {
+		m.httpClient = httpClient
+	}
+}
+
+// WithAdditionalHeaders adds headers that are sent with every request to the tunnel
+// service, such as headers required by a proxy or for tracing.
+func WithAdditionalHeaders(headers map[string]string) ManagerOption {
+	return func(m *Manager) {
+		for header, value := range headers {
+			m.additionalHeaders.set(header, value)
+		}
+	}
+}
+
+// WithResolver sets the resolver used to resolve the tunnel service host name,
+// instead of the system resolver. It cannot be combined with a custom http client,
+// whose transport controls how connections are dialed.
+func WithResolver(resolver Resolver) ManagerOption {
+	return func(m *Manager) {
+		m.resolver = resolver
+	}
+}
+
+// WithLocalAddr binds connections to the tunnel service to the local address ip, so that
+// they leave through the network interface that has that address. NewManager returns an
+// error if ip is not assigned to this machine. It cannot be combined with a custom http client.
+func WithLocalAddr(ip net.IP) ManagerOption {
+	return func(m *Manager) {
+		m.localAddr = ip
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to the tunnel service, for
+// example to trust the self-signed certificate of a test service, or to pin the root
+// certificate authorities trusted for the devtunnels.ms certificate with RootCAs.
+// The configuration is cloned and is not modified. It replaces the configuration that
+// skips certificate verification for a service on localhost. It cannot be combined with
+// a custom http client, whose transport has its own TLS configuration.
+func WithTLSConfig(config *tls.Config) ManagerOption {
+	return func(m *Manager) {
+		m.tlsConfig = config
+	}
 }
 
 // Creates a new Manager used for interacting with the Tunnels APIs.
 // tokenProvider is an optional paramater containing a function that returns the access token to use for the request.
 // If no tunnelServiceUrl or httpClient is provided, the default values will be used.
+// opts are optional settings such as WithResolver and WithLocalAddr.
 // Can return error if userAgent is empty or url is invalid.
-func NewManager(userAgents []UserAgent, tp tokenProviderfn, tunnelServiceUrl *url.URL, httpHandler *http.Client) (*Manager, error) {
+func NewManager(
+	userAgents []UserAgent, tp tokenProviderfn, tunnelServiceUrl *url.URL, httpHandler *http.Client, opts ...ManagerOption,
+) (*Manager, error) {
+	managerOpts := []ManagerOption{WithTokenProvider(tp), WithServiceURL(tunnelServiceUrl), WithHTTPClient(httpHandler)}
+	return NewManagerWithOptions(userAgents, append(managerOpts, opts...)...)
+}
+
+// Creates a new Manager used for interacting with the Tunnels APIs, configured by options
+// such as WithTokenProvider, WithServiceURL, WithHTTPClient and WithAdditionalHeaders.
+// The default service URL and http client are used unless options set them.
+// Can return error if userAgent is empty or the options are invalid.
+func NewManagerWithOptions(userAgents []UserAgent, opts ...ManagerOption) (*Manager, error) {
 	if len(userAgents) == 0 {
 		return nil, fmt.Errorf("user agents cannot be empty")
 	}
-	if tp == nil {
-		tp = func() string {
+
+	m := &Manager{
+		userAgents:        userAgents,
+		additionalHeaders: &defaultHeaders{},
+		serviceProperties: &servicePropertiesCache{},
+		tunnelClusters:    &tunnelClusterCache{},
+		entityTags:        &entityTagCache{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.tokenProvider == nil {
+		m.tokenProvider = func() string {
 			return ""
 		}
 	}
-
-	if tunnelServiceUrl == nil {
+	if m.uri == nil {
 		url, err := url.Parse(defaultServiceUrl)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing default url %w", err)
 		}
-		tunnelServiceUrl = url
+		m.uri = url
+	}
+
+	if m.httpClient != nil {
+		if m.resolver != nil {
+			return nil, fmt.Errorf("a resolver cannot be used with a custom http client")
+		}
+		if m.localAddr != nil {
+			return nil, fmt.Errorf("a local address cannot be used with a custom http client")
+		}
+		if m.tlsConfig != nil {
+			return nil, fmt.Errorf("a TLS config cannot be used with a custom http client")
+		}
+		return m, nil
+	}
+
+	if !strings.Contains(m.uri.Host, "localhost") && m.resolver == nil && m.localAddr == nil && m.tlsConfig == nil {
+		m.httpClient = &http.Client{}
+		return m, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if m.tlsConfig != nil {
+		transport.TLSClientConfig = m.tlsConfig.Clone()
+	} else if strings.Contains(m.uri.Host, "localhost") {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if m.localAddr != nil {
+		localAddr, err := localTCPAddr(m.localAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = localAddr
+		transport.DialContext = dialer.DialContext
+	}
+	if m.resolver != nil {
+		transport.DialContext = resolvingDialContext(m.resolver, dialer)
+	}
+	m.httpClient = &http.Client{Transport: transport}
+	return m, nil
+}
+
+// WithBaseURL returns a copy of the manager that sends requests to the tunnel service at u.
+// The copy shares the http client of the original manager, which is left unchanged.
+// If u is nil the copy uses the same base URL as the original manager.
+func (m *Manager) WithBaseURL(u *url.URL) *Manager {
+	c := m.clone()
+	if u != nil {
+		c.uri = cloneURL(u)
+	}
+	return c
+}
+
+// WithTokenProvider returns a copy of the manager that uses tp to get the access token for requests.
+// The copy shares the http client of the original manager, which is left unchanged.
+func (m *Manager) WithTokenProvider(tp tokenProviderfn) *Manager {
+	c := m.clone()
+	if tp == nil {
+		tp = func() string {
+			return ""
+		}
+	}
+	c.tokenProvider = tp
+	return c
+}
+
+// SetDefaultHeader sets a header that is sent with every request to the tunnel service,
+// such as a header required by a gateway. It is safe to call while requests are in flight.
+func (m *Manager) SetDefaultHeader(key, value string) {
+	m.additionalHeaders.set(key, value)
+}
+
+// RemoveDefaultHeader removes a header set by SetDefaultHeader or WithAdditionalHeaders.
+func (m *Manager) RemoveDefaultHeader(key string) {
+	m.additionalHeaders.remove(key)
+}
+
+// clone returns a shallow copy of the manager that does not share mutable state,
+// other than the http client, with the original.
+func (m *Manager) clone() *Manager {
+	c := *m
+	c.uri = cloneURL(m.uri)
+	c.additionalHeaders = m.additionalHeaders.clone()
+	c.userAgents = append([]UserAgent(nil), m.userAgents...)
+	c.middlewares = append([]Middleware(nil), m.middlewares...)
+	c.serviceProperties = &servicePropertiesCache{}
+	c.tunnelClusters = &tunnelClusterCache{}
+	c.entityTags = &entityTagCache{}
+	return &c
+}
+
+func cloneURL(u *url.URL) *url.URL {
+	c := *u
+	if u.User != nil {
+		user := *u.User
+		c.User = &user
 	}
+	return &c
+}
 
-	var client *http.Client
-	if httpHandler == nil {
-		if strings.Contains(tunnelServiceUrl.Host, "localhost") {
-			client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
-		} else {
-			client = &http.Client{}
+// Gets the properties of the tunnel service, such as the app IDs clients authenticate with.
+// Properties returned by the service are cached, so later calls do not send a request.
+// If the service does not provide the properties endpoint, the compiled-in properties for
+// the service URI are returned instead, and are not cached.
+func (m *Manager) GetServiceProperties(ctx context.Context, options *TunnelRequestOptions) (*TunnelServiceProperties, error) {
+	if properties, ok := m.serviceProperties.get(); ok {
+		return properties, nil
+	}
+
+	if options == nil {
+		options = &TunnelRequestOptions{}
+	}
+	url := m.buildUri("", servicePropertiesApiPath, options, "")
+	response, err := m.sendTunnelRequest(ctx, nil, options, http.MethodGet, url, nil, nil, readAccessTokenScope, false)
+	if err != nil {
+		var serviceErr *TunnelServiceError
+		if errors.As(err, &serviceErr) && serviceErr.StatusCode == http.StatusNotFound {
+			return m.defaultServiceProperties(), nil
 		}
-	} else {
-		client = httpHandler
+		return nil, fmt.Errorf("error sending get service properties request: %w", err)
+	}
+
+	var properties TunnelServiceProperties
+	if err := json.Unmarshal(response, &properties); err != nil {
+		return nil, fmt.Errorf("error parsing response json to service properties: %w", err)
+	}
+	m.serviceProperties.set(properties)
+	return &properties, nil
+}
+
+// defaultServiceProperties returns the compiled-in properties of the service environment
+// the manager is configured for, or the production properties with the manager's service
+// URI if the environment is not known.
+func (m *Manager) defaultServiceProperties() *TunnelServiceProperties {
+	if properties, ok := ServicePropertiesForURL(m.uri); ok {
+		return &properties
+	}
+
+	properties := ServiceProperties
+	properties.ServiceURI = m.uri.String()
+	return &properties
+}
+
+// Lists the clusters of the tunnel service.
+// Returns the clusters or an error if the request fails.
+func (m *Manager) ListClusters(ctx context.Context, options *TunnelRequestOptions) (clusters Clusters, err error) {
+	if options == nil {
+		options = &TunnelRequestOptions{}
+	}
+	url := m.buildUri("", clustersApiPath, options, "")
+	response, err := m.sendTunnelRequest(ctx, nil, options, http.MethodGet, url, nil, nil, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("error sending list clusters request: %w", err)
 	}
 
-	return &Manager{tokenProvider: tp, httpClient: client, uri: tunnelServiceUrl, userAgents: userAgents}, nil
+	err = json.Unmarshal(response, &clusters)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing response json to clusters: %w", err)
+	}
+	return clusters, nil
 }
 
-// Lists tunnels owned by the authenticated user.
+// Lists tunnels owned by the authenticated user, following continuation tokens until
+// all pages have been read. Set options.IncludeAccessControl to get the access control
+// of each tunnel, which the service only returns to callers with the manage scope.
 // Returns a list of tunnels or an error if the search fails.
 func (m *Manager) ListTunnels(
 	ctx context.Context, clusterID string, domain string, options *TunnelRequestOptions,
 ) (ts []*Tunnel, err error) {
+	continuationToken := ""
+	for page := 0; page < listTunnelsMaxPages; page++ {
+		tunnels, nextToken, err := m.ListTunnelsPage(ctx, clusterID, domain, continuationToken, options)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, tunnels...)
+		if nextToken == "" {
+			return ts, nil
+		}
+		continuationToken = nextToken
+	}
+	return nil, fmt.Errorf("error listing tunnels: more than %d pages of tunnels", listTunnelsMaxPages)
+}
+
+// Searches tunnels owned by the authenticated user for tunnels with the given tags.
+// If requireAll is true, only tunnels that have all of the tags are returned; otherwise
+// tunnels that have any of the tags are returned.
+// Returns a list of tunnels, or an error if a tag is not valid or the search fails.
+func (m *Manager) SearchTunnels(
+	ctx context.Context, tags []string, requireAll bool, clusterID string, domain string, options *TunnelRequestOptions,
+) (ts []*Tunnel, err error) {
+	for _, tag := range tags {
+		if !isValidTag(tag) {
+			return nil, fmt.Errorf("invalid tag: %q", tag)
+		}
+	}
+
+	// Copy the options so that the caller's options are not modified.
+	searchOptions := TunnelRequestOptions{}
+	if options != nil {
+		searchOptions = *options
+	}
+	searchOptions.Tags = tags
+	searchOptions.RequireAllTags = requireAll
+
+	return m.ListTunnels(ctx, clusterID, domain, &searchOptions)
+}
+
+// Lists one page of tunnels owned by the authenticated user. Pass an empty continuation
+// token to get the first page, and the returned token to get the next page.
+// Returns the page of tunnels and a continuation token, which is empty on the last page,
+// or an error if the search fails.
+func (m *Manager) ListTunnelsPage(
+	ctx context.Context, clusterID string, domain string, continuationToken string, options *TunnelRequestOptions,
+) (ts []*Tunnel, nextToken string, err error) {
 	queryParams := url.Values{}
 	if clusterID == "" {
 		queryParams.Add("global", "true")
@@ -123,18 +500,65 @@ func (m *Manager) ListTunnels(
 	if domain != "" {
 		queryParams.Add("domain", domain)
 	}
+	if continuationToken != "" {
+		options = options.withAdditionalHeader(continuationTokenHeader, continuationToken)
+	}
 	url := m.buildUri(clusterID, tunnelsApiPath, options, queryParams.Encode())
-	response, err := m.sendTunnelRequest(ctx, nil, options, http.MethodGet, url, nil, nil, readAccessTokenScope, false)
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, nil, options, http.MethodGet, url, nil, nil, options.readTunnelAccessTokenScopes(), false)
 	if err != nil {
-		return nil, fmt.Errorf("error sending list tunnel request: %w", err)
+		return nil, "", fmt.Errorf("error sending list tunnel request: %w", err)
 	}
 
 	err = json.Unmarshal(response, &ts)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing response json to tunnel: %w", err)
+		return nil, "", fmt.Errorf("error parsing response json to tunnel: %w", err)
+	}
+
+	return ts, header.Get(continuationTokenHeader), nil
+}
+
+// Enumerates the ports of all tunnels owned by the authenticated user.
+// Tunnels are listed with their ports included, and fn is called for each (tunnel, port) pair
+// for which filter returns true. A nil filter matches every port.
+// Enumeration stops when fn returns an error or ctx is canceled, and that error is returned.
+func (m *Manager) EnumeratePorts(
+	ctx context.Context,
+	filter func(*Tunnel, *TunnelPort) bool,
+	fn func(*Tunnel, *TunnelPort) error,
+	options *TunnelRequestOptions,
+) error {
+	if fn == nil {
+		return fmt.Errorf("fn must be provided and must not be nil")
+	}
+
+	// Copy the options so that the caller's options are not modified.
+	listOptions := TunnelRequestOptions{}
+	if options != nil {
+		listOptions = *options
+	}
+	listOptions.IncludePorts = true
+
+	tunnels, err := m.ListTunnels(ctx, "", "", &listOptions)
+	if err != nil {
+		return fmt.Errorf("error listing tunnels: %w", err)
 	}
 
-	return ts, nil
+	for _, tunnel := range tunnels {
+		for i := range tunnel.Ports {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			port := &tunnel.Ports[i]
+			if filter != nil && !filter(tunnel, port) {
+				continue
+			}
+			if err := fn(tunnel, port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // Gets a tunnel by id or name.
@@ -146,7 +570,8 @@ func (m *Manager) GetTunnel(ctx context.Context, tunnel *Tunnel, options *Tunnel
 		return nil, fmt.Errorf("error creating tunnel url: %w", err)
 	}
 
-	response, err := m.sendTunnelRequest(ctx, tunnel, options, http.MethodGet, url, nil, nil, readAccessTokenScope, true)
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, options, http.MethodGet, url, nil, nil, options.readTunnelAccessTokenScopes(), true)
 	if err != nil {
 		return nil, fmt.Errorf("error sending get tunnel request: %w", err)
 	}
@@ -156,10 +581,28 @@ func (m *Manager) GetTunnel(ctx context.Context, tunnel *Tunnel, options *Tunnel
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response json to tunnel: %w", err)
 	}
+	if t != nil {
+		m.entityTags.set(header, t)
+	}
 
 	return t, err
 }
 
+// Lists the hosts of a tunnel and the endpoints each host accepts connections on.
+// The service only publishes endpoints for hosts while they accept connections, but it
+// does not report per-host connection counts; see Tunnel.Status for the totals.
+// Returns the hosts or an error if the tunnel could not be retrieved.
+func (m *Manager) ListTunnelHosts(ctx context.Context, tunnel *Tunnel, options *TunnelRequestOptions) ([]TunnelHost, error) {
+	t, err := m.GetTunnel(ctx, tunnel, options)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("tunnel not found")
+	}
+	return t.Hosts(), nil
+}
+
 // Creates a new tunnel with the properties specified in tunnel.
 // Tunnel fields may be nil but the tunnel struct must not be nil.
 // Returns the created tunnel or an error if the create fails.
@@ -170,12 +613,16 @@ func (m *Manager) CreateTunnel(ctx context.Context, tunnel *Tunnel, options *Tun
 	if tunnel.TunnelID != "" {
 		return nil, fmt.Errorf("tunnelId cannot be set for creating a tunnel")
 	}
+	if err := options.validate(tunnel); err != nil {
+		return nil, fmt.Errorf("invalid tunnel: %w", err)
+	}
 	url := m.buildUri(tunnel.ClusterID, tunnelsApiPath, options, "")
 	convertedTunnel, err := tunnel.requestObject()
 	if err != nil {
 		return nil, fmt.Errorf("error converting tunnel for request: %w", err)
 	}
-	response, err := m.sendTunnelRequest(ctx, tunnel, options, http.MethodPost, url, convertedTunnel, nil, manageAccessTokenScope, false)
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, options, http.MethodPost, url, convertedTunnel, nil, manageAccessTokenScope, false)
 	if err != nil {
 		return nil, fmt.Errorf("error sending create tunnel request: %w", err)
 	}
@@ -185,6 +632,9 @@ func (m *Manager) CreateTunnel(ctx context.Context, tunnel *Tunnel, options *Tun
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response json to tunnel: %w", err)
 	}
+	if t != nil {
+		m.entityTags.set(header, t)
+	}
 
 	return t, err
 }
@@ -195,6 +645,9 @@ func (m *Manager) UpdateTunnel(ctx context.Context, tunnel *Tunnel, updateFields
 	if tunnel == nil {
 		return nil, fmt.Errorf("tunnel must be provided")
 	}
+	if err := options.validate(tunnel); err != nil {
+		return nil, fmt.Errorf("invalid tunnel: %w", err)
+	}
 
 	url, err := m.buildTunnelSpecificUri(tunnel, "", options, "")
 	if err != nil {
@@ -205,7 +658,9 @@ func (m *Manager) UpdateTunnel(ctx context.Context, tunnel *Tunnel, updateFields
 	if err != nil {
 		return nil, fmt.Errorf("error converting tunnel for request: %w", err)
 	}
-	response, err := m.sendTunnelRequest(ctx, tunnel, options, http.MethodPut, url, convertedTunnel, updateFields, manageAccessTokenScope, false)
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, m.ifMatch(options, tunnel), http.MethodPut, url, convertedTunnel, updateFields,
+		manageAccessTokenScope, false)
 	if err != nil {
 		return nil, fmt.Errorf("error sending update tunnel request: %w", err)
 	}
@@ -215,10 +670,65 @@ func (m *Manager) UpdateTunnel(ctx context.Context, tunnel *Tunnel, updateFields
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response json to tunnel: %w", err)
 	}
+	if t != nil {
+		m.entityTags.set(header, t, tunnel)
+	}
 
 	return t, err
 }
 
+// Renames a tunnel, updating only its name. If force is true and another tunnel has the
+// requested name, the name is taken from the other tunnel.
+// Returns the updated tunnel, and sets the name of the passed tunnel on success.
+func (m *Manager) RenameTunnel(
+	ctx context.Context, tunnel *Tunnel, newName string, force bool, options *TunnelRequestOptions,
+) (t *Tunnel, err error) {
+	if tunnel == nil {
+		return nil, fmt.Errorf("tunnel must be provided")
+	}
+	if !isValidTunnelName(newName) {
+		return nil, fmt.Errorf("invalid tunnel name: %s", newName)
+	}
+
+	// Build the url before the name changes, since a tunnel may be addressed by name.
+	renameOptions := TunnelRequestOptions{}
+	if options != nil {
+		renameOptions = *options
+	}
+	if force {
+		renameOptions.ForceRename = true
+	}
+	url, err := m.buildTunnelSpecificUri(tunnel, "", &renameOptions, "")
+	if err != nil {
+		return nil, fmt.Errorf("error creating request url: %w", err)
+	}
+
+	renamedTunnel := *tunnel
+	renamedTunnel.Name = newName
+	convertedTunnel, err := renamedTunnel.requestObject()
+	if err != nil {
+		return nil, fmt.Errorf("error converting tunnel for request: %w", err)
+	}
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, m.ifMatch(&renameOptions, tunnel), http.MethodPut, url, convertedTunnel, []string{"Name"},
+		manageAccessTokenScope, false)
+	if err != nil {
+		return nil, fmt.Errorf("error sending rename tunnel request: %w", err)
+	}
+
+	// Read response into a tunnel
+	err = json.Unmarshal(response, &t)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing response json to tunnel: %w", err)
+	}
+	if t != nil {
+		m.entityTags.set(header, t, tunnel)
+	}
+
+	tunnel.Name = newName
+	return t, nil
+}
+
 // Deletes a tunnel.
 // Returns error if delete fails.
 func (m *Manager) DeleteTunnel(ctx context.Context, tunnel *Tunnel, options *TunnelRequestOptions) error {
@@ -230,12 +740,14 @@ func (m *Manager) DeleteTunnel(ctx context.Context, tunnel *Tunnel, options *Tun
 	if err != nil {
 		return fmt.Errorf("error sending delete tunnel request: %w", err)
 	}
+	m.entityTags.remove(tunnel)
 
 	return nil
 }
 
 // Updates an endpoint on a tunnel.
-// Returns the updated endpoint or an error if the update fails.
+// Returns the updated endpoint or an error if the update fails, or if the endpoint is new
+// and its host already has MaxEndpointsPerHost endpoints on the tunnel.
 func (m *Manager) UpdateTunnelEndpoint(
 	ctx context.Context, tunnel *Tunnel, endpoint *TunnelEndpoint, updateFields []string, options *TunnelRequestOptions,
 ) (te *TunnelEndpoint, err error) {
@@ -245,6 +757,11 @@ func (m *Manager) UpdateTunnelEndpoint(
 	if endpoint.HostID == "" {
 		return nil, fmt.Errorf("endpoint hostId must be provided and must not be nil")
 	}
+	if tunnel != nil && !hasEndpoint(tunnel.Endpoints, endpoint.HostID, endpoint.ConnectionMode) &&
+		tunnel.EndpointCountForHost(endpoint.HostID) >= MaxEndpointsPerHost {
+		return nil, fmt.Errorf(
+			"host %s already has the maximum of %d endpoints", endpoint.HostID, MaxEndpointsPerHost)
+	}
 	url, err := m.buildTunnelSpecificUri(tunnel, fmt.Sprintf("%s/%s/%s", endpointsApiSubPath, endpoint.HostID, endpoint.ConnectionMode), options, "")
 	if err != nil {
 		return nil, fmt.Errorf("error creating tunnel url: %w", err)
@@ -261,9 +778,13 @@ func (m *Manager) UpdateTunnelEndpoint(
 		return nil, fmt.Errorf("error parsing response json to tunnel: %w", err)
 	}
 
+	// Replace the endpoint that was updated, which the service may have returned with a
+	// different connection mode than requested, so that the tunnel has no duplicates.
 	var newEndpoints []TunnelEndpoint
 	for _, ep := range tunnel.Endpoints {
-		if ep.HostID != endpoint.HostID || ep.ConnectionMode != endpoint.ConnectionMode {
+		requested := ep.HostID == endpoint.HostID && ep.ConnectionMode == endpoint.ConnectionMode
+		returned := ep.HostID == te.HostID && ep.ConnectionMode == te.ConnectionMode
+		if !requested && !returned {
 			newEndpoints = append(newEndpoints, ep)
 		}
 	}
@@ -273,6 +794,15 @@ func (m *Manager) UpdateTunnelEndpoint(
 	return te, err
 }
 
+func hasEndpoint(endpoints []TunnelEndpoint, hostID string, connectionMode TunnelConnectionMode) bool {
+	for _, ep := range endpoints {
+		if ep.HostID == hostID && ep.ConnectionMode == connectionMode {
+			return true
+		}
+	}
+	return false
+}
+
 // Deletes endpoints on a tunnel.
 // Returns error if the delete fails.
 func (m *Manager) DeleteTunnelEndpoints(
@@ -307,6 +837,7 @@ func (m *Manager) DeleteTunnelEndpoints(
 }
 
 // Lists ports on the tunnel.
+// Local ports with the auto protocol are updated with the protocol the service resolved.
 func (m *Manager) ListTunnelPorts(
 	ctx context.Context, tunnel *Tunnel, options *TunnelRequestOptions,
 ) (tp []*TunnelPort, err error) {
@@ -325,9 +856,27 @@ func (m *Manager) ListTunnelPorts(
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response json to tunnel ports: %w", err)
 	}
+	m.updateResolvedProtocols(tunnel, tp...)
 	return tp, nil
 }
 
+// Lists ports on the tunnel together with their status, in one request instead of a
+// request for each port. The status of each port has its client connection count, last
+// client connection time and connection and request rates. The status of a port is nil if
+// the service did not include it; use GetTunnelPortStatus to get it separately.
+func (m *Manager) ListTunnelPortsWithStatus(
+	ctx context.Context, tunnel *Tunnel, options *TunnelRequestOptions,
+) ([]*TunnelPort, error) {
+	requestOptions := TunnelRequestOptions{}
+	if options != nil {
+		requestOptions = *options
+	}
+	requestOptions.IncludePortStatus = true
+	return m.ListTunnelPorts(ctx, tunnel, &requestOptions)
+}
+
+// Gets a port of the tunnel.
+// A local port with the auto protocol is updated with the protocol the service resolved.
 func (m *Manager) GetTunnelPort(
 	ctx context.Context, tunnel *Tunnel, port int, options *TunnelRequestOptions,
 ) (tp *TunnelPort, err error) {
@@ -336,7 +885,8 @@ func (m *Manager) GetTunnelPort(
 		return nil, fmt.Errorf("error creating tunnel url: %w", err)
 	}
 
-	response, err := m.sendTunnelRequest(ctx, tunnel, options, http.MethodGet, url, nil, nil, readAccessTokenScope, true)
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, options, http.MethodGet, url, nil, nil, readAccessTokenScope, true)
 	if err != nil {
 		return nil, fmt.Errorf("error sending get tunnel port request: %w", err)
 	}
@@ -346,14 +896,46 @@ func (m *Manager) GetTunnelPort(
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response json to tunnel ports: %w", err)
 	}
+	if tp != nil {
+		m.entityTags.set(header, tp)
+	}
+	m.updateResolvedProtocols(tunnel, tp)
 	return tp, nil
 }
 
+// Gets the current status of a tunnel port.
+// The port is requested with its status included; use ListTunnelPortsWithStatus to get
+// the status of all ports of the tunnel in one request.
+func (m *Manager) GetTunnelPortStatus(
+	ctx context.Context, tunnel *Tunnel, port int, options *TunnelRequestOptions,
+) (tps *TunnelPortStatus, err error) {
+	requestOptions := TunnelRequestOptions{}
+	if options != nil {
+		requestOptions = *options
+	}
+	requestOptions.IncludePortStatus = true
+	tp, err := m.GetTunnelPort(ctx, tunnel, port, &requestOptions)
+	if err != nil {
+		return nil, err
+	}
+	if tp == nil {
+		return nil, fmt.Errorf("tunnel port %d was not found", port)
+	}
+	return tp.Status, nil
+}
+
 // Creates a port on the tunnel.
 // Returns the created port or error if create fails.
 func (m *Manager) CreateTunnelPort(
 	ctx context.Context, tunnel *Tunnel, port *TunnelPort, options *TunnelRequestOptions,
 ) (tp *TunnelPort, err error) {
+	if port == nil {
+		return nil, fmt.Errorf("port must be provided")
+	}
+	if err := options.validate(port); err != nil {
+		return nil, fmt.Errorf("invalid tunnel port: %w", err)
+	}
+
 	url, err := m.buildTunnelSpecificUri(tunnel, portsApiSubPath, options, "")
 	if err != nil {
 		return nil, fmt.Errorf("error creating tunnel url: %w", err)
@@ -396,6 +978,9 @@ func (m *Manager) UpdateTunnelPort(
 	if port.ClusterID != "" && tunnel.ClusterID != "" && port.ClusterID != tunnel.ClusterID {
 		return nil, fmt.Errorf("cluster ids do not match")
 	}
+	if err := options.validate(port); err != nil {
+		return nil, fmt.Errorf("invalid tunnel port: %w", err)
+	}
 	path := fmt.Sprintf("%s/%d", portsApiSubPath, port.PortNumber)
 	url, err := m.buildTunnelSpecificUri(tunnel, path, options, "")
 	if err != nil {
@@ -407,7 +992,9 @@ func (m *Manager) UpdateTunnelPort(
 		return nil, fmt.Errorf("error converting port for request: %w", err)
 	}
 
-	response, err := m.sendTunnelRequest(ctx, tunnel, options, http.MethodPut, url, convertedPort, updateFields, hostOrManageAccessTokenScope, true)
+	response, header, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, m.ifMatch(options, port), http.MethodPut, url, convertedPort, updateFields,
+		hostOrManageAccessTokenScope, true)
 	if err != nil {
 		return nil, fmt.Errorf("error sending update tunnel port request: %w", err)
 	}
@@ -417,6 +1004,9 @@ func (m *Manager) UpdateTunnelPort(
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response json to tunnel port: %w", err)
 	}
+	if tp != nil {
+		m.entityTags.set(header, tp, port)
+	}
 
 	// Updated local tunnel ports
 	var newPorts []TunnelPort
@@ -431,6 +1021,29 @@ func (m *Manager) UpdateTunnelPort(
 	return tp, nil
 }
 
+// SetPortAccessControl replaces the access control of a tunnel port, without changing
+// other properties of the port. Inherited entries in accessControl are not sent, and a
+// nil accessControl removes all entries of the port. Unlike UpdateTunnelPort with a port
+// the manager returned, the update is not conditional on the entity tag of the port.
+// Returns the updated port, which also replaces the port in tunnel.Ports.
+func (m *Manager) SetPortAccessControl(
+	ctx context.Context, tunnel *Tunnel, portNumber uint16, accessControl *TunnelAccessControl,
+	options *TunnelRequestOptions,
+) (*TunnelPort, error) {
+	if tunnel == nil {
+		return nil, ErrNoTunnel
+	}
+	if portNumber == 0 {
+		return nil, fmt.Errorf("port number must be set")
+	}
+	if accessControl == nil {
+		accessControl = &TunnelAccessControl{}
+	}
+
+	port := &TunnelPort{PortNumber: portNumber, AccessControl: accessControl}
+	return m.UpdateTunnelPort(ctx, tunnel, port, []string{"AccessControl"}, options)
+}
+
 // Deletes a tunnel port.
 // Returns error if the delete fails.
 func (m *Manager) DeleteTunnelPort(
@@ -459,6 +1072,16 @@ func (m *Manager) DeleteTunnelPort(
 	return nil
 }
 
+// DeletePort deletes a tunnel port like DeleteTunnelPort, taking the port number as an
+// int like GetTunnelPort. Returns an error without sending a request if the port number
+// is not between 1 and 65535.
+func (m *Manager) DeletePort(ctx context.Context, tunnel *Tunnel, portNumber int, options *TunnelRequestOptions) error {
+	if portNumber < 1 || portNumber > math.MaxUint16 {
+		return fmt.Errorf("invalid port number %d, must be between 1 and %d", portNumber, math.MaxUint16)
+	}
+	return m.DeleteTunnelPort(ctx, tunnel, uint16(portNumber), options)
+}
+
 func (m *Manager) sendTunnelRequest(
 	ctx context.Context,
 	tunnel *Tunnel,
@@ -470,101 +1093,134 @@ func (m *Manager) sendTunnelRequest(
 	accessTokenScopes []TunnelAccessScope,
 	allowNotFound bool,
 ) ([]byte, error) {
+	body, _, err := m.sendTunnelRequestWithHeader(
+		ctx, tunnel, tunnelRequestOptions, method, uri, requestObject, partialFields, accessTokenScopes, allowNotFound)
+	return body, err
+}
+
+// sendTunnelRequestWithHeader sends a request like sendTunnelRequest, and also returns
+// the headers of the successful response.
+func (m *Manager) sendTunnelRequestWithHeader(
+	ctx context.Context,
+	tunnel *Tunnel,
+	tunnelRequestOptions *TunnelRequestOptions,
+	method string,
+	uri *url.URL,
+	requestObject interface{},
+	partialFields []string,
+	accessTokenScopes []TunnelAccessScope,
+	allowNotFound bool,
+) (body []byte, header http.Header, err error) {
+	if m.metrics != nil {
+		start := time.Now()
+		defer func() {
+			m.metrics.RecordRequest(requestOperation(method, uri.Path), time.Since(start), err)
+		}()
+	}
+
+	if tunnelRequestOptions != nil && tunnelRequestOptions.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tunnelRequestOptions.Timeout)
+		defer cancel()
+	}
+
 	tunnelJson, err := partialMarshal(requestObject, partialFields)
 	if err != nil {
-		return nil, fmt.Errorf("error converting tunnel to json: %w", err)
+		return nil, nil, fmt.Errorf("error converting tunnel to json: %w", err)
 	}
-	request, err := http.NewRequest(method, uri.String(), bytes.NewBuffer(tunnelJson))
+	request, err := http.NewRequestWithContext(ctx, method, uri.String(), bytes.NewBuffer(tunnelJson))
 	if err != nil {
-		return nil, fmt.Errorf("error creating tunnel request request: %w", err)
+		return nil, nil, fmt.Errorf("error creating tunnel request request: %w", err)
 	}
 
 	//Add authorization header
 	if token := m.getAccessToken(tunnel, tunnelRequestOptions, accessTokenScopes); token != "" {
 		request.Header.Add("Authorization", token)
 	}
-	userAgentString := ""
-	for _, userAgent := range m.userAgents {
-		if len(userAgent.Version) == 0 {
-			userAgent.Version = "unknown"
-		}
-		if len(userAgent.Name) == 0 {
-			return nil, fmt.Errorf("userAgent name cannot be empty")
-		}
-		userAgentString = fmt.Sprintf("%s%s/%s ", userAgentString, userAgent.Name, userAgent.Version)
+	userAgent, err := m.userAgentHeader()
+	if err != nil {
+		return nil, nil, err
 	}
-	userAgentString = strings.TrimSpace(userAgentString)
-	request.Header.Add("User-Agent", fmt.Sprintf("%s %s", goUserAgent, userAgentString))
+	request.Header.Add("User-Agent", userAgent)
 	request.Header.Add("Content-Type", "application/json;charset=UTF-8")
+	request.Header.Add("Accept-Encoding", acceptEncoding)
 
 	// Add additional headers
-	for header, headerValue := range m.additionalHeaders {
-		request.Header.Add(header, headerValue)
-	}
+	m.additionalHeaders.addTo(request.Header)
 	for header, headerValue := range tunnelRequestOptions.AdditionalHeaders {
 		request.Header.Add(header, headerValue)
 	}
 
-	result, err := m.httpClient.Do(request)
-	if err != nil {
-		return nil, fmt.Errorf("error sending request: %w", err)
+	if m.debugLogger != nil {
+		m.dumpRequest(request, tunnelJson)
 	}
 
-	defer result.Body.Close()
-
-	// Handle non 200s responses
-	if result.StatusCode > 300 {
-		errorMessage, err := m.readProblemDetails(result)
-		if err == nil && errorMessage != nil {
-			return nil, fmt.Errorf("unsuccessful request, response: %d %s\n\t%s",
-				result.StatusCode, http.StatusText(result.StatusCode), *errorMessage)
-		} else {
-			return nil, fmt.Errorf("unsuccessful request, response: %d: %s",
-				result.StatusCode, http.StatusText(result.StatusCode))
-		}
+	if m.dryRun && method != http.MethodGet {
+		return nil, nil, &DryRunError{Request: newDryRunRequest(request, tunnelJson)}
 	}
 
-	return io.ReadAll(result.Body)
+	body, response, err := m.doTunnelRequest(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, response.Header, nil
 }
 
-func (m *Manager) readProblemDetails(response *http.Response) (*string, error) {
-	errorBody, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body")
+// userAgentHeader returns the value of the User-Agent header sent with each request.
+func (m *Manager) userAgentHeader() (string, error) {
+	userAgentString := ""
+	for _, userAgent := range m.userAgents {
+		if len(userAgent.Version) == 0 {
+			userAgent.Version = "unknown"
+		}
+		if len(userAgent.Name) == 0 {
+			return "", fmt.Errorf("userAgent name cannot be empty")
+		}
+		userAgentString = fmt.Sprintf("%s%s/%s ", userAgentString, userAgent.Name, userAgent.Version)
 	}
+	userAgentString = strings.TrimSpace(userAgentString)
+	return fmt.Sprintf("%s %s", goUserAgent, userAgentString), nil
+}
 
-	var problemDetails *ProblemDetails
-	err = json.Unmarshal(errorBody, &problemDetails)
+// doTunnelRequest sends the request through the manager's middlewares. It returns the
+// response, whose body has been read and closed, and an error if the request failed.
+func (m *Manager) doTunnelRequest(request *http.Request) ([]byte, *http.Response, error) {
+	result, err := m.send(m.httpClient, request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal ProblemDetails")
+		return nil, nil, fmt.Errorf("error sending request: %w", err)
 	}
 
-	if problemDetails.Title == "" && problemDetails.Detail == "" {
-		return nil, fmt.Errorf("empty ProblemDetails")
+	if err := decompressResponse(result); err != nil {
+		result.Body.Close()
+		return nil, result, err
 	}
+	defer result.Body.Close()
 
-	var errorMessage string
-	if problemDetails.Title != "" {
-		errorMessage += problemDetails.Title
-	}
-	if problemDetails.Detail != "" {
-		if len(errorMessage) > 0 {
-			errorMessage += " "
+	if m.debugLogger != nil {
+		if err := m.dumpResponse(result); err != nil {
+			return nil, result, err
 		}
-		errorMessage += problemDetails.Detail
 	}
-	for errorKey, errorDetail := range problemDetails.Errors {
-		errorMessage += "\n\t" + errorKey + ": "
-		for _, errorDetailMessage := range errorDetail {
-			errorMessage += " "
-			errorMessage += errorDetailMessage
-		}
+
+	// Handle non 200s responses
+	if result.StatusCode > 300 {
+		return nil, result, newTunnelServiceError(result)
 	}
 
-	return &errorMessage, nil
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, result, err
+	}
+	if len(body) > 0 && !json.Valid(body) {
+		return nil, result, invalidJSONError(result, body)
+	}
+	return body, result, nil
 }
 
 func (m *Manager) getAccessToken(tunnel *Tunnel, tunnelRequestOptions *TunnelRequestOptions, scopes []TunnelAccessScope) (token string) {
+	if len(tunnelRequestOptions.TokenScopeOverride) > 0 {
+		scopes = tunnelRequestOptions.TokenScopeOverride
+	}
 	if tunnelRequestOptions.AccessToken != "" {
 		token = fmt.Sprintf("%s %s", tunnelAuthenticationScheme, tunnelRequestOptions.AccessToken)
 	}
@@ -573,7 +1229,7 @@ func (m *Manager) getAccessToken(tunnel *Tunnel, tunnelRequestOptions *TunnelReq
 	}
 	if token == "" && tunnel != nil {
 		for _, scope := range scopes {
-			if tunnelToken, ok := tunnel.AccessTokens[scope]; ok {
+			if tunnelToken, ok := tunnel.AccessToken(scope); ok {
 				token = fmt.Sprintf("%s %s", tunnelAuthenticationScheme, tunnelToken)
 			}
 		}
@@ -582,7 +1238,8 @@ func (m *Manager) getAccessToken(tunnel *Tunnel, tunnelRequestOptions *TunnelReq
 }
 
 func (m *Manager) buildUri(clusterId string, path string, options *TunnelRequestOptions, query string) *url.URL {
-	baseAddress := m.uri
+	// Copy the base URL so that building a request URL does not modify the manager.
+	baseAddress := cloneURL(m.uri)
 	if clusterId != "" {
 		if !strings.HasPrefix(baseAddress.Host, "localhost") && !strings.HasPrefix(baseAddress.Host, clusterId) {
 			// A specific cluster ID was specified (while not running on localhost).
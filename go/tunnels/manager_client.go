@@ -0,0 +1,68 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+)
+
+// NewClient creates a client for the tunnel and connects it to the host with hostID, or
+// to the only host if hostID is empty. If the tunnel does not have a connect access token
+// and endpoints, the manager gets them from the service with its own credentials, so the
+// token does not have to be requested separately. The client dials the relay with the
+// manager's resolver and local address, and logs to the manager's debug logger if set.
+// opts configure the client as in NewClient; it does not accept local connections for
+// forwarded ports.
+func (m *Manager) NewClient(ctx context.Context, tunnel *Tunnel, hostID string, opts ...ClientOption) (*Client, error) {
+	if tunnel == nil {
+		return nil, ErrNoTunnel
+	}
+
+	connectTunnel := tunnel
+	if _, ok := tunnel.AccessToken(TunnelAccessScopeConnect); !ok || len(tunnel.Endpoints) == 0 {
+		requestTunnel := *tunnel
+		if requestTunnel.ClusterID == "" && requestTunnel.TunnelID != "" {
+			if clusterID, ok := m.tunnelClusters.get(requestTunnel.TunnelID); ok {
+				requestTunnel.ClusterID = clusterID
+			}
+		}
+
+		options := &TunnelRequestOptions{TokenScopes: TunnelAccessScopes{TunnelAccessScopeConnect}}
+		t, err := m.GetTunnel(ctx, &requestTunnel, options)
+		if err != nil {
+			return nil, fmt.Errorf("error getting tunnel to connect to: %w", err)
+		}
+		if t == nil {
+			return nil, fmt.Errorf("tunnel to connect to was not found")
+		}
+		if t.ClusterID != "" && t.TunnelID != "" {
+			m.tunnelClusters.set(t.TunnelID, t.ClusterID)
+		}
+		connectTunnel = t
+	}
+
+	logger := m.debugLogger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	var clientOpts []ClientOption
+	if m.resolver != nil {
+		clientOpts = append(clientOpts, WithRelayResolver(m.resolver))
+	}
+	if m.localAddr != nil {
+		clientOpts = append(clientOpts, WithRelayLocalAddr(m.localAddr))
+	}
+
+	c, err := NewClient(logger, connectTunnel, false, append(clientOpts, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Connect(ctx, hostID); err != nil {
+		return nil, fmt.Errorf("error connecting to tunnel: %w", err)
+	}
+	return c, nil
+}
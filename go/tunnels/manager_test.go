@@ -4,13 +4,23 @@
 package tunnels
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,6 +35,40 @@ func getAccessToken() string {
 	return ""
 }
 
+// newTestManager creates a Manager that sends requests to a local fake tunnel service.
+// The returned function shuts down the fake service.
+func newTestManager(t *testing.T, handler http.HandlerFunc, opts ...ManagerOption) (*Manager, func()) {
+	server := httptest.NewServer(handler)
+
+	// Use the localhost host name so that cluster IDs are not prepended to the host,
+	// and always dial the fake service regardless of the requested host.
+	serviceURL, err := url.Parse("http://localhost/")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	managementClient, err := NewManager(userAgentManagerTest, nil, serviceURL, httpClient, opts...)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return managementClient, server.Close
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
 // These tests do not automatically run in the PR check github action
 // beacuse they require authentication. If you want to run these tests
 // you must first generate a tunnels access token and paste it in the
@@ -739,4 +783,1255 @@ func TestResourceStatusUnmarshal(t *testing.T) {
 	if result1.Current != result2.Current {
 		t.Errorf("%d != %d", result1.Current, result2.Current)
 	}
-}
\ No newline at end of file
+}
+
+func TestGetTunnelPortStatus(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/tunnels/test-tunnel/ports/8080" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("includeStatus") != "true" {
+			t.Errorf("expected includeStatus in query %q", r.URL.RawQuery)
+		}
+		writeJSON(w, &TunnelPort{
+			PortNumber: 8080,
+			Status: &TunnelPortStatus{
+				ClientConnectionCount: &ResourceStatus{Current: 3, Limit: 10},
+			},
+		})
+	})
+	defer closeServer()
+
+	tunnel := &Tunnel{Name: "test-tunnel"}
+	options := &TunnelRequestOptions{}
+	status, err := managementClient.GetTunnelPortStatus(ctx, tunnel, 8080, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == nil || status.ClientConnectionCount == nil {
+		t.Fatal("tunnel port status was not returned")
+	}
+	if status.ClientConnectionCount.Current != 3 || status.ClientConnectionCount.Limit != 10 {
+		t.Errorf("unexpected client connection count: %+v", *status.ClientConnectionCount)
+	}
+	if options.IncludePortStatus {
+		t.Error("expected the caller's options not to be modified")
+	}
+
+	if _, err := managementClient.GetTunnelPortStatus(ctx, tunnel, 8081, options); err == nil {
+		t.Error("expected an error for a port that was not found")
+	}
+}
+
+func TestListTunnelPortsWithStatus(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("includeStatus") != "true" {
+			t.Errorf("expected includeStatus in query %q", r.URL.RawQuery)
+		}
+		writeJSON(w, []*TunnelPort{
+			{
+				PortNumber: 8080,
+				Status: &TunnelPortStatus{
+					ClientConnectionCount: &ResourceStatus{Current: 2},
+				},
+			},
+			{PortNumber: 8081},
+		})
+	})
+	defer closeServer()
+
+	tunnel := &Tunnel{Name: "test-tunnel"}
+	options := &TunnelRequestOptions{}
+	ports, err := managementClient.ListTunnelPortsWithStatus(ctx, tunnel, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("expected 2 ports, got %d", len(ports))
+	}
+	if ports[0].Status == nil || ports[0].Status.ClientConnectionCount.Current != 2 {
+		t.Errorf("expected the status of port 8080, got %+v", ports[0].Status)
+	}
+	if ports[1].Status != nil {
+		t.Errorf("expected no status for port 8081, got %+v", ports[1].Status)
+	}
+	if options.IncludePortStatus {
+		t.Error("expected the caller's options not to be modified")
+	}
+}
+
+func TestEnumeratePorts(t *testing.T) {
+	var includePorts string
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		includePorts = r.URL.Query().Get("includePorts")
+		writeJSON(w, []*Tunnel{
+			{
+				Name: "tunnel-a",
+				Ports: []TunnelPort{
+					{PortNumber: 80, Protocol: string(TunnelProtocolHttp)},
+					{PortNumber: 22, Protocol: string(TunnelProtocolSsh)},
+				},
+			},
+			{
+				Name: "tunnel-b",
+				Ports: []TunnelPort{
+					{PortNumber: 8080, Protocol: string(TunnelProtocolHttp)},
+				},
+			},
+		})
+	})
+	defer closeServer()
+
+	options := &TunnelRequestOptions{}
+	var matches []string
+	err := managementClient.EnumeratePorts(ctx, func(tunnel *Tunnel, port *TunnelPort) bool {
+		return port.Protocol == string(TunnelProtocolHttp)
+	}, func(tunnel *Tunnel, port *TunnelPort) error {
+		matches = append(matches, fmt.Sprintf("%s:%d", tunnel.Name, port.PortNumber))
+		return nil
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if includePorts != "true" {
+		t.Errorf("tunnels were not listed with their ports")
+	}
+	if options.IncludePorts {
+		t.Errorf("the caller's options should not be modified")
+	}
+	if len(matches) != 2 || matches[0] != "tunnel-a:80" || matches[1] != "tunnel-b:8080" {
+		t.Errorf("unexpected matching ports: %v", matches)
+	}
+}
+
+func TestEnumeratePortsStopsOnError(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []*Tunnel{
+			{Name: "tunnel-a", Ports: []TunnelPort{{PortNumber: 80}, {PortNumber: 81}}},
+		})
+	})
+	defer closeServer()
+
+	errStop := errors.New("stop")
+	count := 0
+	err := managementClient.EnumeratePorts(ctx, nil, func(tunnel *Tunnel, port *TunnelPort) error {
+		count++
+		return errStop
+	}, &TunnelRequestOptions{})
+	if err != errStop {
+		t.Errorf("expected the callback error, got %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected enumeration to stop after the first port, got %d calls", count)
+	}
+}
+
+func TestListTunnelHosts(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, &Tunnel{
+			Name: "test-tunnel",
+			Endpoints: []TunnelEndpoint{
+				{HostID: "host1", ConnectionMode: TunnelConnectionModeTunnelRelay},
+				{HostID: "host2", ConnectionMode: TunnelConnectionModeTunnelRelay},
+				{HostID: "host1", ConnectionMode: TunnelConnectionModeLocalNetwork},
+			},
+		})
+	})
+	defer closeServer()
+
+	hosts, err := managementClient.ListTunnelHosts(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %d", len(hosts))
+	}
+	if hosts[0].HostID != "host1" || len(hosts[0].Endpoints) != 2 {
+		t.Errorf("unexpected first host: %+v", hosts[0])
+	}
+	if len(hosts[0].ConnectionModes) != 2 ||
+		hosts[0].ConnectionModes[0] != TunnelConnectionModeTunnelRelay ||
+		hosts[0].ConnectionModes[1] != TunnelConnectionModeLocalNetwork {
+		t.Errorf("unexpected connection modes for host1: %v", hosts[0].ConnectionModes)
+	}
+	if hosts[1].HostID != "host2" || len(hosts[1].Endpoints) != 1 {
+		t.Errorf("unexpected second host: %+v", hosts[1])
+	}
+}
+
+func TestManagerWithBaseURL(t *testing.T) {
+	var requestHost string
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requestHost = r.Host
+		writeJSON(w, []*Tunnel{})
+	})
+	defer closeServer()
+
+	otherURL, err := url.Parse("http://other.localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := managementClient.WithBaseURL(otherURL)
+	if _, err := derived.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if requestHost != "other.localhost" {
+		t.Errorf("derived manager sent request to %q, expected other.localhost", requestHost)
+	}
+
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if requestHost != "localhost" {
+		t.Errorf("original manager sent request to %q, expected localhost", requestHost)
+	}
+
+	otherURL.Host = "changed.localhost"
+	if derived.uri.Host != "other.localhost" {
+		t.Errorf("derived manager should not share the url passed to WithBaseURL")
+	}
+}
+
+func TestManagerWithTokenProvider(t *testing.T) {
+	var authorization string
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		writeJSON(w, []*Tunnel{})
+	})
+	defer closeServer()
+
+	derived := managementClient.WithTokenProvider(func() string {
+		return "Bearer other-token"
+	})
+	if _, err := derived.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Bearer other-token" {
+		t.Errorf("derived manager sent authorization %q, expected the new token", authorization)
+	}
+
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		t.Errorf("original manager sent authorization %q, expected none", authorization)
+	}
+}
+
+func TestBuildUriDoesNotModifyManager(t *testing.T) {
+	serviceURL, err := url.Parse("https://global.rel.tunnels.api.visualstudio.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	managementClient, err := NewManager(userAgentManagerTest, nil, serviceURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := managementClient.buildUri("usw2", tunnelsApiPath, nil, "")
+	if uri.Host != "usw2.rel.tunnels.api.visualstudio.com" {
+		t.Errorf("unexpected host %q", uri.Host)
+	}
+	if managementClient.uri.Host != "global.rel.tunnels.api.visualstudio.com" || managementClient.uri.Path != "/" {
+		t.Errorf("building a uri modified the manager base url: %s", managementClient.uri)
+	}
+}
+
+type mapResolver map[string]string
+
+func (r mapResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addr, ok := r[host]; ok {
+		return []string{addr}, nil
+	}
+	return nil, fmt.Errorf("unknown host %s", host)
+}
+
+func TestManagerWithResolver(t *testing.T) {
+	var requestHost string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestHost = r.Host
+		writeJSON(w, []*Tunnel{})
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceURL, err := url.Parse(fmt.Sprintf("http://api.staging.example:%s/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := mapResolver{"api.staging.example": "127.0.0.1"}
+	managementClient, err := NewManager(userAgentManagerTest, nil, serviceURL, nil, WithResolver(resolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if requestHost != serviceURL.Host {
+		t.Errorf("expected request for host %s, got %s", serviceURL.Host, requestHost)
+	}
+}
+
+func TestManagerWithResolverAndHTTPClient(t *testing.T) {
+	resolver := mapResolver{}
+	_, err := NewManager(userAgentManagerTest, nil, nil, &http.Client{}, WithResolver(resolver))
+	if err == nil {
+		t.Errorf("expected an error when combining a resolver with a custom http client")
+	}
+}
+
+func TestManagerWithLocalAddr(t *testing.T) {
+	// Any 127.0.0.0/8 address is assignable on Linux, so use one that differs from
+	// the address the server listens on to see that the connection is bound to it.
+	localIP := net.ParseIP("127.0.0.2")
+	if _, err := localTCPAddr(localIP); err != nil {
+		t.Skipf("local address is not available: %v", err)
+	}
+
+	var remoteHost string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteHost, _, _ = net.SplitHostPort(r.RemoteAddr)
+		writeJSON(w, []*Tunnel{})
+	}))
+	defer server.Close()
+
+	serviceURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managementClient, err := NewManager(userAgentManagerTest, nil, serviceURL, nil, WithLocalAddr(localIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if remoteHost != localIP.String() {
+		t.Errorf("expected request from %s, got %s", localIP, remoteHost)
+	}
+}
+
+func TestManagerWithTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []*Tunnel{})
+	}))
+	defer server.Close()
+
+	serviceURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server's certificate is self-signed, so it is not trusted by default.
+	managementClient, err := NewManager(userAgentManagerTest, nil, serviceURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err == nil {
+		t.Error("expected the self-signed certificate not to be trusted by default")
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	config := &tls.Config{RootCAs: rootCAs}
+	managementClient, err = NewManager(userAgentManagerTest, nil, serviceURL, nil, WithTLSConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Errorf("expected the certificate to be trusted with the TLS config, got %v", err)
+	}
+}
+
+func TestManagerWithTLSConfigAndHTTPClient(t *testing.T) {
+	_, err := NewManager(userAgentManagerTest, nil, nil, &http.Client{}, WithTLSConfig(&tls.Config{}))
+	if err == nil {
+		t.Errorf("expected an error when combining a TLS config with a custom http client")
+	}
+}
+
+func TestManagerWithUnassignableLocalAddr(t *testing.T) {
+	_, err := NewManager(userAgentManagerTest, nil, nil, nil, WithLocalAddr(net.ParseIP("192.0.2.1")))
+	if err == nil || !strings.Contains(err.Error(), "not assignable") {
+		t.Errorf("expected an error for an unassignable local address, got %v", err)
+	}
+}
+
+func TestGetServiceProperties(t *testing.T) {
+	requests := 0
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/serviceProperties" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		writeJSON(w, &TunnelServiceProperties{
+			ServiceURI:        "http://localhost/",
+			ServiceAppID:      "live-app-id",
+			GitHubAppClientID: "live-github-client-id",
+		})
+	})
+	defer closeServer()
+
+	properties, err := managementClient.GetServiceProperties(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if properties.ServiceAppID != "live-app-id" || properties.GitHubAppClientID != "live-github-client-id" {
+		t.Errorf("fetched properties did not override the defaults: %+v", properties)
+	}
+
+	properties.ServiceAppID = "modified"
+	properties, err = managementClient.GetServiceProperties(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the cached properties to be used, got %d requests", requests)
+	}
+	if properties.ServiceAppID != "live-app-id" {
+		t.Errorf("cached properties were modified through a returned value")
+	}
+}
+
+func TestGetServicePropertiesFallsBackToDefaults(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	defer closeServer()
+
+	properties, err := managementClient.GetServiceProperties(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if properties.ServiceAppID != ServiceProperties.ServiceAppID {
+		t.Errorf("expected the compiled-in app ID, got %s", properties.ServiceAppID)
+	}
+	if properties.ServiceURI != "http://localhost/" {
+		t.Errorf("expected the manager's service URI, got %s", properties.ServiceURI)
+	}
+
+	ppeURL, err := url.Parse(PpeServiceProperties.ServiceURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties = managementClient.WithBaseURL(ppeURL).defaultServiceProperties()
+	if *properties != PpeServiceProperties {
+		t.Errorf("expected the PPE service properties, got %+v", properties)
+	}
+}
+
+func TestGetServicePropertiesReturnsServiceErrors(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer closeServer()
+
+	_, err := managementClient.GetServiceProperties(ctx, nil)
+	var serviceErr *TunnelServiceError
+	if !errors.As(err, &serviceErr) || serviceErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the service error to be returned, got %v", err)
+	}
+}
+
+func TestGetServicePropertiesDoesNotBlockWhileSending(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Slow") != "" {
+			close(started)
+			<-release
+		}
+		writeJSON(w, &TunnelServiceProperties{ServiceAppID: "live-app-id"})
+	})
+	defer closeServer()
+	defer close(release)
+
+	slowCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go managementClient.GetServiceProperties(slowCtx, &TunnelRequestOptions{AdditionalHeaders: map[string]string{"X-Slow": "true"}})
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := managementClient.GetServiceProperties(ctx, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a request not to wait for a slow request in progress")
+	}
+}
+
+func TestManagerDebugDump(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, &Tunnel{
+			Name:         "test-tunnel",
+			AccessTokens: map[TunnelAccessScope]string{TunnelAccessScopeConnect: "secret-connect-token"},
+		})
+	}))
+	defer server.Close()
+
+	serviceURL, err := url.Parse("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	var dump bytes.Buffer
+	getToken := func() string { return "Bearer secret-user-token" }
+	managementClient, err := NewManager(
+		userAgentManagerTest, getToken, serviceURL, httpClient, WithDebugDump(log.New(&dump, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.AccessTokens[TunnelAccessScopeConnect] != "secret-connect-token" {
+		t.Errorf("response body was not readable after the dump")
+	}
+
+	output := dump.String()
+	if !strings.Contains(output, "GET http://localhost/api/v1/tunnels/test-tunnel") {
+		t.Errorf("dump does not include the request URL:\n%s", output)
+	}
+	if !strings.Contains(output, "Response: 200 OK") {
+		t.Errorf("dump does not include the response status:\n%s", output)
+	}
+	if strings.Contains(output, "secret-user-token") || strings.Contains(output, "secret-connect-token") {
+		t.Errorf("dump includes a token:\n%s", output)
+	}
+	if !strings.Contains(output, "Authorization: <redacted>") {
+		t.Errorf("dump does not include the redacted authorization header:\n%s", output)
+	}
+}
+
+func TestManagerDryRun(t *testing.T) {
+	serviceURL, err := url.Parse("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				t.Errorf("dry run dialed %s", addr)
+				return nil, errors.New("dry run must not send requests")
+			},
+		},
+	}
+
+	getToken := func() string { return "Bearer secret-user-token" }
+	managementClient, err := NewManager(userAgentManagerTest, getToken, serviceURL, httpClient, WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = managementClient.CreateTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	var dryRunErr *DryRunError
+	if !errors.As(err, &dryRunErr) {
+		t.Fatalf("expected a DryRunError, got %v", err)
+	}
+
+	request := dryRunErr.Request
+	if request.Method != http.MethodPost {
+		t.Errorf("expected method %s, got %s", http.MethodPost, request.Method)
+	}
+	if request.URL != "http://localhost/api/v1/tunnels" {
+		t.Errorf("unexpected request URL %s", request.URL)
+	}
+	if authorization := request.Header.Get("Authorization"); authorization != "<redacted>" {
+		t.Errorf("expected a redacted authorization header, got %q", authorization)
+	}
+	var body Tunnel
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Name != "test-tunnel" {
+		t.Errorf("expected the tunnel in the request body, got %s", request.Body)
+	}
+}
+
+func TestTokenScopeOverride(t *testing.T) {
+	var authorization string
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		writeJSON(w, &TunnelPort{PortNumber: 8080})
+	})
+	defer closeServer()
+
+	tunnel := &Tunnel{
+		Name: "test-tunnel",
+		AccessTokens: map[TunnelAccessScope]string{
+			TunnelAccessScopeHost: "host-token",
+		},
+	}
+
+	// Updating a tunnel requires a manage token by default, so the host token is not used.
+	if _, err := managementClient.UpdateTunnel(ctx, tunnel, nil, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		t.Errorf("expected no authorization without an override, got %q", authorization)
+	}
+
+	options := &TunnelRequestOptions{
+		TokenScopeOverride: TunnelAccessScopes{TunnelAccessScopeHost},
+	}
+	if _, err := managementClient.UpdateTunnel(ctx, tunnel, nil, options); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Tunnel host-token" {
+		t.Errorf("expected the host token to be selected by the override, got %q", authorization)
+	}
+
+	port := NewTunnelPort(8080, "", "", TunnelProtocolAuto)
+	tunnel.AccessTokens[TunnelAccessScopeManage] = "manage-token"
+	if _, err := managementClient.CreateTunnelPort(ctx, tunnel, port, options); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Tunnel host-token" {
+		t.Errorf("expected the host token for creating a port, got %q", authorization)
+	}
+}
+
+func TestUpdateTunnelEndpointReplacesReturnedEndpoint(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, &TunnelEndpoint{HostID: "host1", ConnectionMode: TunnelConnectionModeTunnelRelay})
+	})
+	defer closeServer()
+
+	tunnel := &Tunnel{
+		Name: "test-tunnel",
+		Endpoints: []TunnelEndpoint{
+			{HostID: "host1", ConnectionMode: TunnelConnectionModeTunnelRelay},
+			{HostID: "host2", ConnectionMode: TunnelConnectionModeTunnelRelay},
+		},
+	}
+
+	// The service fills in the connection mode that the request left empty.
+	endpoint := &TunnelEndpoint{HostID: "host1"}
+	if _, err := managementClient.UpdateTunnelEndpoint(ctx, tunnel, endpoint, nil, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if count := tunnel.EndpointCountForHost("host1"); count != 1 {
+		t.Errorf("expected 1 endpoint for host1, got %d: %+v", count, tunnel.Endpoints)
+	}
+	if count := tunnel.EndpointCountForHost("host2"); count != 1 {
+		t.Errorf("expected the endpoint for host2 to be kept, got %d", count)
+	}
+}
+
+func TestUpdateTunnelEndpointEnforcesMaxEndpointsPerHost(t *testing.T) {
+	requests := 0
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, &TunnelEndpoint{HostID: "host1"})
+	})
+	defer closeServer()
+
+	tunnel := &Tunnel{Name: "test-tunnel"}
+	for i := 0; i < MaxEndpointsPerHost; i++ {
+		tunnel.Endpoints = append(tunnel.Endpoints, TunnelEndpoint{
+			HostID:         "host1",
+			ConnectionMode: TunnelConnectionMode(fmt.Sprintf("mode%d", i)),
+		})
+	}
+
+	endpoint := &TunnelEndpoint{HostID: "host1", ConnectionMode: TunnelConnectionModeTunnelRelay}
+	if _, err := managementClient.UpdateTunnelEndpoint(ctx, tunnel, endpoint, nil, &TunnelRequestOptions{}); err == nil {
+		t.Error("expected an error when the host has the maximum number of endpoints")
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to be sent, got %d", requests)
+	}
+
+	// Updating one of the existing endpoints is still allowed.
+	endpoint = &TunnelEndpoint{HostID: "host1", ConnectionMode: "mode0"}
+	if _, err := managementClient.UpdateTunnelEndpoint(ctx, tunnel, endpoint, nil, &TunnelRequestOptions{}); err != nil {
+		t.Errorf("expected an existing endpoint to be updatable, got %v", err)
+	}
+
+	// Other hosts are not limited by the endpoints of host1.
+	endpoint = &TunnelEndpoint{HostID: "host2", ConnectionMode: TunnelConnectionModeTunnelRelay}
+	if _, err := managementClient.UpdateTunnelEndpoint(ctx, tunnel, endpoint, nil, &TunnelRequestOptions{}); err != nil {
+		t.Errorf("expected another host to be able to add an endpoint, got %v", err)
+	}
+}
+
+func TestRenameTunnel(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if r.URL.Path != "/api/v1/tunnels/abc123" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("forceRename") != "true" {
+			t.Errorf("expected forceRename in query %q", r.URL.RawQuery)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if len(body) != 1 || body["name"] != "new-name" {
+			t.Errorf("expected only the name to be updated, got %v", body)
+		}
+		writeJSON(w, Tunnel{ClusterID: "usw2", TunnelID: "abc123", Name: "new-name"})
+	})
+	defer done()
+
+	tunnel := &Tunnel{ClusterID: "usw2", TunnelID: "abc123", Name: "old-name"}
+	options := &TunnelRequestOptions{}
+	renamed, err := managementClient.RenameTunnel(ctx, tunnel, "new-name", true, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "new-name" {
+		t.Errorf("expected renamed tunnel to have the new name, got %q", renamed.Name)
+	}
+	if tunnel.Name != "new-name" {
+		t.Errorf("expected tunnel name to be updated in place, got %q", tunnel.Name)
+	}
+	if options.ForceRename {
+		t.Error("expected the caller's options not to be modified")
+	}
+}
+
+func TestRenameTunnelWithInvalidName(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	})
+	defer done()
+
+	tunnel := &Tunnel{ClusterID: "usw2", TunnelID: "abc123", Name: "old-name"}
+	if _, err := managementClient.RenameTunnel(ctx, tunnel, "Invalid Name!", false, nil); err == nil {
+		t.Fatal("expected an error for an invalid name")
+	}
+	if tunnel.Name != "old-name" {
+		t.Errorf("expected tunnel name to be unchanged, got %q", tunnel.Name)
+	}
+}
+
+func TestListTunnelsFollowsContinuationTokens(t *testing.T) {
+	pages := map[string][]Tunnel{
+		"":      {{TunnelID: "tunnel1"}, {TunnelID: "tunnel2"}},
+		"page2": {{TunnelID: "tunnel3"}},
+	}
+	nextTokens := map[string]string{"": "page2"}
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Ms-Continuation")
+		page, ok := pages[token]
+		if !ok {
+			t.Errorf("unexpected continuation token %q", token)
+		}
+		if next := nextTokens[token]; next != "" {
+			w.Header().Set("X-Ms-Continuation", next)
+		}
+		writeJSON(w, page)
+	})
+	defer done()
+
+	firstPage, nextToken, err := managementClient.ListTunnelsPage(ctx, "", "", "", &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(firstPage) != 2 || nextToken != "page2" {
+		t.Errorf("expected 2 tunnels and a continuation token, got %d tunnels and token %q", len(firstPage), nextToken)
+	}
+
+	options := &TunnelRequestOptions{}
+	tunnels, err := managementClient.ListTunnels(ctx, "", "", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 3 || tunnels[2].TunnelID != "tunnel3" {
+		t.Errorf("expected all 3 tunnels, got %d", len(tunnels))
+	}
+	if options.AdditionalHeaders != nil {
+		t.Error("expected the caller's options not to be modified")
+	}
+}
+
+func TestListTunnelsStopsAfterPageLimit(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Continuation", "more")
+		writeJSON(w, []Tunnel{{TunnelID: "tunnel"}})
+	})
+	defer done()
+
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err == nil {
+		t.Fatal("expected an error when the service returns too many pages")
+	}
+}
+
+func TestNewManagerWithOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Trace-Id"); got != "trace" {
+			t.Errorf("expected additional header, got %q", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("expected token from the token provider, got %q", got)
+		}
+		writeJSON(w, []Tunnel{})
+	}))
+	defer server.Close()
+
+	serviceURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managementClient, err := NewManagerWithOptions(
+		userAgentManagerTest,
+		WithServiceURL(serviceURL),
+		WithTokenProvider(func() string { return "Bearer token" }),
+		WithHTTPClient(server.Client()),
+		WithAdditionalHeaders(map[string]string{"X-Trace-Id": "trace"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewManagerWithOptionsRequiresUserAgents(t *testing.T) {
+	if _, err := NewManagerWithOptions(nil); err == nil {
+		t.Fatal("expected an error without user agents")
+	}
+}
+
+func TestSetAndRemoveDefaultHeader(t *testing.T) {
+	var tenant string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header.Get("X-Corp-Tenant")
+		writeJSON(w, []Tunnel{})
+	})
+	defer done()
+
+	managementClient.SetDefaultHeader("X-Corp-Tenant", "contoso")
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "contoso" {
+		t.Errorf("expected the default header to be sent, got %q", tenant)
+	}
+
+	managementClient.RemoveDefaultHeader("X-Corp-Tenant")
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "" {
+		t.Errorf("expected the default header to be removed, got %q", tenant)
+	}
+}
+
+func TestSetDefaultHeaderDuringRequests(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []Tunnel{})
+	})
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			managementClient.SetDefaultHeader("X-Request-Number", strconv.Itoa(i))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSearchTunnels(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if tags := query["tags"]; len(tags) != 2 || tags[0] != "ci" || tags[1] != "cleanup" {
+			t.Errorf("unexpected tags query %v", tags)
+		}
+		if query.Get("allTags") != "true" {
+			t.Errorf("expected allTags in query %q", r.URL.RawQuery)
+		}
+		writeJSON(w, []Tunnel{{TunnelID: "tunnel1", Tags: []string{"ci", "cleanup"}}})
+	})
+	defer done()
+
+	options := &TunnelRequestOptions{}
+	tunnels, err := managementClient.SearchTunnels(ctx, []string{"ci", "cleanup"}, true, "", "", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].TunnelID != "tunnel1" {
+		t.Errorf("expected the matching tunnel, got %v", tunnels)
+	}
+	if options.Tags != nil {
+		t.Error("expected the caller's options not to be modified")
+	}
+}
+
+func TestSearchTunnelsRejectsInvalidTags(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	})
+	defer done()
+
+	for _, tag := range []string{"", "has space", "has,comma"} {
+		if _, err := managementClient.SearchTunnels(ctx, []string{tag}, false, "", "", nil); err == nil {
+			t.Errorf("expected an error for tag %q", tag)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer done()
+	defer close(release)
+
+	start := time.Now()
+	_, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the request to time out promptly, took %v", elapsed)
+	}
+}
+
+func TestRequestTimeoutKeepsParentCancellation(t *testing.T) {
+	release := make(chan struct{})
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer done()
+	defer close(release)
+
+	parent, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := managementClient.GetTunnel(parent, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{Timeout: time.Minute})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be cancelled with its parent context, got %v", err)
+	}
+}
+
+func TestListTunnelsIncludeAccessControl(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("includeAccessControl") != "true" {
+			t.Errorf("expected includeAccessControl in query %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"tunnelId":"tunnel1","accessControl":{"entries":[
+			{"type":"Users","provider":"github","subjects":["583231"],"scopes":["connect"]},
+			{"type":"Anonymous","subjects":[],"scopes":["connect"],"isInherited":true}]}}]`))
+	})
+	defer done()
+
+	tunnels, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{IncludeAccessControl: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].AccessControl == nil {
+		t.Fatalf("expected a tunnel with access control, got %v", tunnels)
+	}
+	entries := tunnels[0].AccessControl.Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 access control entries, got %d", len(entries))
+	}
+	if entries[0].Type != TunnelAccessControlEntryTypeUsers || entries[0].Provider != "github" ||
+		len(entries[0].Subjects) != 1 || entries[0].IsInherited {
+		t.Errorf("unexpected first entry %+v", entries[0])
+	}
+	if entries[1].Type != TunnelAccessControlEntryTypeAnonymous || !entries[1].IsInherited {
+		t.Errorf("expected an inherited anonymous entry, got %+v", entries[1])
+	}
+}
+
+func TestGetTunnelIncludeAccessControlUsesManageToken(t *testing.T) {
+	var authorization string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		writeJSON(w, Tunnel{TunnelID: "tunnel1"})
+	})
+	defer done()
+
+	tunnel := &Tunnel{
+		TunnelID:  "tunnel1",
+		ClusterID: "usw2",
+		AccessTokens: map[TunnelAccessScope]string{
+			TunnelAccessScopeConnect: "connect-token",
+			TunnelAccessScopeManage:  "manage-token",
+		},
+	}
+	if _, err := managementClient.GetTunnel(ctx, tunnel, &TunnelRequestOptions{IncludeAccessControl: true}); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != tunnelAuthenticationScheme+" manage-token" {
+		t.Errorf("expected the manage token, got %q", authorization)
+	}
+}
+
+func TestCreateTunnelValidatesBeforeSending(t *testing.T) {
+	requests := 0
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"})
+	})
+	defer done()
+
+	// By default an invalid tunnel or port is rejected without sending a request.
+	tunnel := &Tunnel{Tags: []string{"bad tag"}}
+	_, err := managementClient.CreateTunnel(ctx, tunnel, nil)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+	if _, err := managementClient.UpdateTunnel(
+		ctx, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2", Tags: []string{"bad tag"}}, []string{"Tags"}, &TunnelRequestOptions{},
+	); !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors for the update, got %v", err)
+	}
+	if _, err := managementClient.CreateTunnelPort(
+		ctx, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}, &TunnelPort{}, &TunnelRequestOptions{},
+	); !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors for the port, got %v", err)
+	}
+	if _, err := managementClient.UpdateTunnelPort(
+		ctx, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}, &TunnelPort{PortNumber: 8080, Tags: []string{"bad tag"}}, []string{"Tags"}, nil,
+	); !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors for the port update, got %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("expected no request to be sent for an invalid tunnel or port, got %d requests", requests)
+	}
+
+	// Skipping client validation sends the tunnel for the service to validate.
+	if _, err := managementClient.CreateTunnel(ctx, tunnel, &TunnelRequestOptions{SkipClientValidation: true}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the request to be sent, got %d requests", requests)
+	}
+}
+
+func TestUpdateTunnelSendsETag(t *testing.T) {
+	var ifMatch []string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+			if r.Header.Get("If-Match") == `"v1"` {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		w.Header().Set("ETag", `"v1"`)
+		writeJSON(w, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"})
+	})
+	defer done()
+
+	tunnel, err := managementClient.GetTunnel(ctx, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = managementClient.UpdateTunnel(ctx, tunnel, nil, &TunnelRequestOptions{})
+	if !errors.Is(err, ErrConcurrencyConflict) {
+		t.Fatalf("expected a concurrency conflict, got %v", err)
+	}
+	var serviceErr *TunnelServiceError
+	if !errors.As(err, &serviceErr) || serviceErr.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected a precondition failed service error, got %v", err)
+	}
+
+	if _, err := managementClient.UpdateTunnel(ctx, tunnel, nil, &TunnelRequestOptions{SkipConcurrencyCheck: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ifMatch) != 2 || ifMatch[0] != `"v1"` || ifMatch[1] != "" {
+		t.Errorf("expected If-Match only on the conditional update, got %q", ifMatch)
+	}
+
+	// Another copy of the tunnel was not read by the manager, so its update is not conditional.
+	if _, err := managementClient.UpdateTunnel(ctx, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}, nil, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ifMatch) != 3 || ifMatch[2] != "" {
+		t.Errorf("expected no If-Match for a tunnel the manager did not return, got %q", ifMatch)
+	}
+}
+
+func TestRenameTunnelSendsETag(t *testing.T) {
+	var ifMatch []string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("ETag", `"v1"`)
+		} else {
+			ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+			w.Header().Set("ETag", `"v2"`)
+		}
+		writeJSON(w, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"})
+	})
+	defer done()
+
+	tunnel, err := managementClient.GetTunnel(ctx, &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.RenameTunnel(ctx, tunnel, "renamed", false, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := managementClient.RenameTunnel(ctx, tunnel, "renamed-again", false, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ifMatch) != 2 || ifMatch[0] != `"v1"` || ifMatch[1] != `"v2"` {
+		t.Errorf("expected If-Match to be the ETag of the tunnel when it was last read, got %q", ifMatch)
+	}
+}
+
+func TestUpdateTunnelPortSendsETag(t *testing.T) {
+	var ifMatch []string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("ETag", `"v1"`)
+		} else {
+			ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+			w.Header().Set("ETag", `"v2"`)
+		}
+		writeJSON(w, &TunnelPort{PortNumber: 8080})
+	})
+	defer done()
+
+	tunnel := &Tunnel{TunnelID: "tunnel1", ClusterID: "usw2"}
+	port, err := managementClient.GetTunnelPort(ctx, tunnel, 8080, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if port, err = managementClient.UpdateTunnelPort(ctx, tunnel, port, nil, &TunnelRequestOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ifMatch) != 2 || ifMatch[0] != `"v1"` || ifMatch[1] != `"v2"` {
+		t.Errorf("expected If-Match to be the ETag of the port when it was last read, got %q", ifMatch)
+	}
+
+	if _, err := managementClient.UpdateTunnelPort(ctx, tunnel, &TunnelPort{PortNumber: 8080}, nil, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ifMatch) != 3 || ifMatch[2] != "" {
+		t.Errorf("expected no If-Match for a port the manager did not return, got %q", ifMatch)
+	}
+}
+
+func TestDeletePort(t *testing.T) {
+	var paths []string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	})
+	defer done()
+
+	tunnel := &Tunnel{
+		TunnelID:  "tunnel1",
+		ClusterID: "usw2",
+		Ports:     []TunnelPort{{PortNumber: 80}, {PortNumber: 443}},
+	}
+	for _, portNumber := range []int{0, -1, 65536} {
+		if err := managementClient.DeletePort(ctx, tunnel, portNumber, &TunnelRequestOptions{}); err == nil {
+			t.Errorf("expected an error for port number %d", portNumber)
+		}
+	}
+	if len(paths) != 0 {
+		t.Fatalf("expected no request for invalid port numbers, got %v", paths)
+	}
+
+	if err := managementClient.DeletePort(ctx, tunnel, 443, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], "/ports/443") {
+		t.Errorf("expected a request to delete port 443, got %v", paths)
+	}
+	if len(tunnel.Ports) != 1 || tunnel.Ports[0].PortNumber != 80 {
+		t.Errorf("expected port 443 to be removed from the tunnel, got %v", tunnel.Ports)
+	}
+}
+
+func TestSetPortAccessControl(t *testing.T) {
+	var body map[string]interface{}
+	var ifMatch string
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("ETag", `"v1"`)
+			writeJSON(w, &TunnelPort{PortNumber: 8080, Protocol: "http"})
+			return
+		}
+		if r.Method != http.MethodPut || !strings.HasSuffix(r.URL.Path, "/ports/8080") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		ifMatch = r.Header.Get("If-Match")
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		writeJSON(w, &TunnelPort{PortNumber: 8080, Protocol: "http"})
+	})
+	defer done()
+
+	tunnel := &Tunnel{
+		TunnelID:  "tunnel1",
+		ClusterID: "usw2",
+		Ports:     []TunnelPort{{PortNumber: 8080, Protocol: "http"}},
+	}
+	if _, err := managementClient.GetTunnelPort(ctx, tunnel, 8080, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	accessControl := &TunnelAccessControl{
+		Entries: []TunnelAccessControlEntry{
+			{Type: TunnelAccessControlEntryTypeAnonymous, Scopes: []string{string(TunnelAccessScopeConnect)}},
+			{Type: TunnelAccessControlEntryTypeUsers, IsInherited: true, Subjects: []string{"user1"}},
+		},
+	}
+	port, err := managementClient.SetPortAccessControl(ctx, tunnel, 8080, accessControl, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body) != 1 {
+		t.Errorf("expected only the access control to be sent, got %v", body)
+	}
+	entries := body["accessControl"].(map[string]interface{})["entries"].([]interface{})
+	if len(entries) != 1 || entries[0].(map[string]interface{})["type"] != string(TunnelAccessControlEntryTypeAnonymous) {
+		t.Errorf("expected only the entry that is not inherited to be sent, got %v", entries)
+	}
+	if ifMatch != "" {
+		t.Errorf("expected no If-Match for a port number, got %q", ifMatch)
+	}
+	if port.PortNumber != 8080 || len(tunnel.Ports) != 1 || tunnel.Ports[0].Protocol != "http" {
+		t.Errorf("expected the updated port in the tunnel, got %v", tunnel.Ports)
+	}
+}
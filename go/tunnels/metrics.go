@@ -0,0 +1,152 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsRecorder receives measurements from a Manager or Client, for example to
+// export them to a monitoring system. Its methods may be called concurrently.
+type MetricsRecorder interface {
+	// RecordRequest records a tunnel service request. operation is the HTTP method and
+	// the API path with IDs replaced, such as "GET /tunnels/{id}/ports".
+	RecordRequest(operation string, duration time.Duration, err error)
+
+	// SetForwardedPorts records the number of ports the host currently forwards.
+	SetForwardedPorts(count int)
+
+	// AddBytes records data sent to and received from forwarded ports.
+	AddBytes(sent, received int64)
+}
+
+// WithMetrics makes the manager record each tunnel service request with recorder.
+func WithMetrics(recorder MetricsRecorder) ManagerOption {
+	return func(m *Manager) {
+		m.metrics = recorder
+	}
+}
+
+// WithClientMetrics makes the client record the forwarded ports and the data sent
+// over forwarded connections with recorder.
+func WithClientMetrics(recorder MetricsRecorder) ClientOption {
+	return func(c *Client) {
+		c.metrics = recorder
+	}
+}
+
+// RequestMetrics holds the totals for one tunnel service operation.
+type RequestMetrics struct {
+	Count        int64
+	Errors       int64
+	TotalLatency time.Duration
+}
+
+// MetricsSnapshot holds the values recorded by Metrics at one point in time.
+type MetricsSnapshot struct {
+	// Requests holds the request totals by operation.
+	Requests       map[string]RequestMetrics
+	ForwardedPorts int64
+	BytesSent      int64
+	BytesReceived  int64
+}
+
+// Metrics is a MetricsRecorder that keeps running totals in memory, for the caller
+// to read with Snapshot and register with a metrics library such as Prometheus.
+type Metrics struct {
+	requestsMu sync.Mutex
+	requests   map[string]RequestMetrics
+
+	forwardedPorts int64
+	bytesSent      int64
+	bytesReceived  int64
+}
+
+// NewMetrics returns a Metrics with all values at zero.
+func NewMetrics() *Metrics {
+	return &Metrics{requests: make(map[string]RequestMetrics)}
+}
+
+func (m *Metrics) RecordRequest(operation string, duration time.Duration, err error) {
+	m.requestsMu.Lock()
+	defer m.requestsMu.Unlock()
+
+	r := m.requests[operation]
+	r.Count++
+	if err != nil {
+		r.Errors++
+	}
+	r.TotalLatency += duration
+	m.requests[operation] = r
+}
+
+func (m *Metrics) SetForwardedPorts(count int) {
+	atomic.StoreInt64(&m.forwardedPorts, int64(count))
+}
+
+func (m *Metrics) AddBytes(sent, received int64) {
+	atomic.AddInt64(&m.bytesSent, sent)
+	atomic.AddInt64(&m.bytesReceived, received)
+}
+
+// Snapshot returns the current values.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.requestsMu.Lock()
+	requests := make(map[string]RequestMetrics, len(m.requests))
+	for operation, r := range m.requests {
+		requests[operation] = r
+	}
+	m.requestsMu.Unlock()
+
+	return MetricsSnapshot{
+		Requests:       requests,
+		ForwardedPorts: atomic.LoadInt64(&m.forwardedPorts),
+		BytesSent:      atomic.LoadInt64(&m.bytesSent),
+		BytesReceived:  atomic.LoadInt64(&m.bytesReceived),
+	}
+}
+
+// apiCollections are the path segments of the tunnel service API that are not IDs.
+var apiCollections = map[string]bool{
+	"tunnels":           true,
+	"ports":             true,
+	"endpoints":         true,
+	"subjects":          true,
+	"clusters":          true,
+	"serviceProperties": true,
+	"status":            true,
+}
+
+// requestOperation returns the operation name of a request, with the IDs in its path
+// replaced so that requests for different tunnels share an operation.
+func requestOperation(method string, path string) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(path, apiV1Path), "/"), "/")
+	for i, segment := range segments {
+		if segment != "" && !apiCollections[segment] {
+			segments[i] = "{id}"
+		}
+	}
+	return method + " /" + strings.Join(segments, "/")
+}
+
+// bytesWriter records the bytes written through it as sent or received.
+type bytesWriter struct {
+	w        io.Writer
+	metrics  MetricsRecorder
+	received bool
+}
+
+func (b *bytesWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	if b.received {
+		b.metrics.AddBytes(0, int64(n))
+	} else {
+		b.metrics.AddBytes(int64(n), 0)
+	}
+	return n, err
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	tunnelstest "github.com/microsoft/dev-tunnels/go/tunnels/test"
+)
+
+func TestRequestOperation(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/api/v1/tunnels":                             "GET /tunnels",
+		"/api/v1/tunnels/my-tunnel":                   "GET /tunnels/{id}",
+		"/api/v1/tunnels/my-tunnel/ports/8080":        "GET /tunnels/{id}/ports/{id}",
+		"/api/v1/tunnels/my-tunnel/endpoints/h1/mode": "GET /tunnels/{id}/endpoints/{id}/{id}",
+	} {
+		if operation := requestOperation(http.MethodGet, path); operation != expected {
+			t.Errorf("expected operation %q for %s, got %q", expected, path, operation)
+		}
+	}
+}
+
+func TestManagerRecordsRequestMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/tunnels/missing" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, &Tunnel{Name: "test-tunnel"})
+	}))
+	defer server.Close()
+
+	serviceURL, err := url.Parse("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		},
+	}
+
+	metrics := NewMetrics()
+	managementClient, err := NewManager(userAgentManagerTest, nil, serviceURL, httpClient, WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test-tunnel", "other-tunnel", "missing"} {
+		managementClient.GetTunnel(ctx, &Tunnel{Name: name}, &TunnelRequestOptions{})
+	}
+
+	requests := metrics.Snapshot().Requests["GET /tunnels/{id}"]
+	if requests.Count != 3 || requests.Errors != 1 {
+		t.Errorf("expected 3 requests and 1 error, got %+v", requests)
+	}
+}
+
+func TestClientRecordsForwardingMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayServer, err := tunnelstest.NewRelayServer(tunnelstest.WithEchoStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := Tunnel{
+		Endpoints: []TunnelEndpoint{
+			{
+				HostID:         "host1",
+				HostPublicKeys: relayServer.HostPublicKeys(),
+				TunnelRelayTunnelEndpoint: TunnelRelayTunnelEndpoint{
+					ClientRelayURI: strings.Replace(relayServer.URL(), "http://", "ws://", 1),
+				},
+			},
+		},
+	}
+
+	metrics := NewMetrics()
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	c, err := NewClient(logger, &tunnel, false, WithClientMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx, ""); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+
+	streamPort := uint16(8008)
+	if err := relayServer.ForwardPort(ctx, streamPort); err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	pf, err := c.ForwardPort(ctx, streamPort, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("forward port failed: %v", err)
+	}
+	defer pf.Stop()
+
+	conn, err := net.DialTimeout("tcp", pf.LocalAddr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := []byte("metrics-data")
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bytes received are recorded just after they are written to the local connection.
+	snapshot := metrics.Snapshot()
+	for snapshot.BytesReceived < int64(len(data)) && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		snapshot = metrics.Snapshot()
+	}
+	if snapshot.ForwardedPorts != 1 {
+		t.Errorf("expected 1 forwarded port, got %d", snapshot.ForwardedPorts)
+	}
+	if snapshot.BytesSent != int64(len(data)) || snapshot.BytesReceived != int64(len(data)) {
+		t.Errorf("expected %d bytes sent and received, got %+v", len(data), snapshot)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import "net/http"
+
+// RequestHandler sends a request to the tunnel service and returns its response.
+type RequestHandler func(request *http.Request) (*http.Response, error)
+
+// Middleware wraps the handler that sends requests to the tunnel service, for example to
+// log, measure or modify requests. A middleware may return a response without calling
+// next to short-circuit the request.
+type Middleware func(next RequestHandler) RequestHandler
+
+// WithMiddleware adds middlewares around each request the manager sends to the tunnel
+// service. Middlewares run in the order they are added, so the first one added is the
+// outermost. Middlewares added after WithRetryPolicy run once for each attempt.
+func WithMiddleware(middlewares ...Middleware) ManagerOption {
+	return func(m *Manager) {
+		m.middlewares = append(m.middlewares, middlewares...)
+	}
+}
+
+// send sends the request with the http client through the manager's middlewares.
+func (m *Manager) send(httpClient *http.Client, request *http.Request) (*http.Response, error) {
+	handler := RequestHandler(httpClient.Do)
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		handler = m.middlewares[i](handler)
+	}
+	return handler(request)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewaresRunInOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return func(request *http.Request) (*http.Response, error) {
+				calls = append(calls, name+" before")
+				response, err := next(request)
+				calls = append(calls, name+" after")
+				return response, err
+			}
+		}
+	}
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "service")
+		writeJSON(w, []Tunnel{})
+	}, WithMiddleware(record("first"), record("second")))
+	defer done()
+
+	if _, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "first before,second before,service,second after,first after"
+	if got := strings.Join(calls, ","); got != expected {
+		t.Errorf("expected calls %q, got %q", expected, got)
+	}
+}
+
+func TestMiddlewareShortCircuitsRequest(t *testing.T) {
+	var innerCalled bool
+	cached := func(next RequestHandler) RequestHandler {
+		return func(request *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(`[{"tunnelId":"cached"}]`)),
+				Request:    request,
+			}, nil
+		}
+	}
+	inner := func(next RequestHandler) RequestHandler {
+		return func(request *http.Request) (*http.Response, error) {
+			innerCalled = true
+			return next(request)
+		}
+	}
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to the service %s %s", r.Method, r.URL)
+	}, WithMiddleware(cached, inner))
+	defer done()
+
+	tunnels, err := managementClient.ListTunnels(ctx, "", "", &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].TunnelID != "cached" {
+		t.Errorf("expected the cached tunnel, got %v", tunnels)
+	}
+	if innerCalled {
+		t.Error("expected the inner middleware not to run")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+)
+
+// PortForwarder forwards connections accepted on a local address to a remote port
+// of the tunnel. It is returned by Client.ForwardPort.
+type PortForwarder struct {
+	remotePort uint16
+	listener   net.Listener
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// RemotePort returns the remote port that local connections are forwarded to.
+func (pf *PortForwarder) RemotePort() uint16 {
+	return pf.remotePort
+}
+
+// LocalAddr returns the local address that accepts connections.
+func (pf *PortForwarder) LocalAddr() net.Addr {
+	return pf.listener.Addr()
+}
+
+// Stop stops accepting local connections and closes the connections that are
+// currently being forwarded. It is safe to call Stop more than once.
+func (pf *PortForwarder) Stop() error {
+	pf.stopOnce.Do(func() {
+		pf.cancel()
+		pf.stopErr = pf.listener.Close()
+		<-pf.done
+	})
+	return pf.stopErr
+}
+
+func (pf *PortForwarder) acceptConnections(ctx context.Context, c *Client) {
+	defer close(pf.done)
+
+	for {
+		conn, err := pf.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				c.logger.Error("Failed to accept local connection", "port", pf.remotePort, "error", err)
+			}
+			return
+		}
+
+		go func() {
+			err := c.handleConnection(ctx, conn, pf.remotePort)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				c.logger.Error("Failed to forward connection", "port", pf.remotePort, "error", err)
+			}
+		}()
+	}
+}
+
+// AllPortsForwarder forwards every port the host forwards to the client, following
+// ports as the host adds and removes them. It is returned by Client.ForwardAllPorts.
+type AllPortsForwarder struct {
+	client *Client
+	mapper func(remotePort uint16) string
+
+	mu         sync.Mutex
+	forwarders map[uint16]*PortForwarder
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// Forwarders returns the forwarders for the ports that are currently forwarded,
+// ordered by remote port.
+func (f *AllPortsForwarder) Forwarders() []*PortForwarder {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	forwarders := make([]*PortForwarder, 0, len(f.forwarders))
+	for _, pf := range f.forwarders {
+		forwarders = append(forwarders, pf)
+	}
+	sort.Slice(forwarders, func(i, j int) bool {
+		return forwarders[i].remotePort < forwarders[j].remotePort
+	})
+	return forwarders
+}
+
+// Stop stops following the host's ports and stops all port forwarders.
+// It is safe to call Stop more than once.
+func (f *AllPortsForwarder) Stop() error {
+	f.stopOnce.Do(func() {
+		f.cancel()
+		<-f.done
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for port, pf := range f.forwarders {
+			if err := pf.Stop(); err != nil && f.stopErr == nil {
+				f.stopErr = err
+			}
+			delete(f.forwarders, port)
+		}
+	})
+	return f.stopErr
+}
+
+// followPorts adds and removes port forwarders as the host adds and removes ports.
+// Ports are handled one at a time, which bounds the work done for a burst of changes.
+func (f *AllPortsForwarder) followPorts(
+	ctx context.Context, notifications <-chan remoteForwardedPortNotification, unsubscribe func(),
+) {
+	defer close(f.done)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notifications:
+			switch n.notificationType {
+			case remoteForwardedPortNotificationTypeAdd:
+				f.add(ctx, n.port)
+			case remoteForwardedPortNotificationTypeRemove:
+				f.remove(n.port)
+			}
+		}
+	}
+}
+
+func (f *AllPortsForwarder) add(ctx context.Context, port uint16) {
+	f.mu.Lock()
+	_, ok := f.forwarders[port]
+	f.mu.Unlock()
+	if ok {
+		return
+	}
+
+	localAddr := f.mapper(port)
+	if localAddr == "" {
+		return
+	}
+	pf, err := f.client.ForwardPort(ctx, port, localAddr)
+	if err != nil {
+		if ctx.Err() == nil {
+			f.client.logger.Error("Failed to forward port", "port", port, "error", err)
+		}
+		return
+	}
+
+	f.mu.Lock()
+	f.forwarders[port] = pf
+	f.mu.Unlock()
+}
+
+func (f *AllPortsForwarder) remove(port uint16) {
+	f.mu.Lock()
+	pf, ok := f.forwarders[port]
+	delete(f.forwarders, port)
+	f.mu.Unlock()
+
+	if ok {
+		if err := pf.Stop(); err != nil {
+			f.client.logger.Error("Failed to stop forwarding port", "port", port, "error", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+// ResolvedProtocol returns the concrete protocol of the port, such as http or tcp, and true,
+// or false if the protocol is auto and has not yet been detected by the service.
+func (tp *TunnelPort) ResolvedProtocol() (TunnelProtocol, bool) {
+	if tp.Protocol == "" || TunnelProtocol(tp.Protocol) == TunnelProtocolAuto {
+		return "", false
+	}
+	return TunnelProtocol(tp.Protocol), true
+}
+
+// WithPortProtocolResolved sets a function that is called when the service reports a
+// concrete protocol for a port that the local tunnel still has with the auto protocol,
+// so that a UI can update the scheme it displays for the port.
+func WithPortProtocolResolved(handler func(tunnel *Tunnel, port *TunnelPort)) ManagerOption {
+	return func(m *Manager) {
+		m.portProtocolResolved = handler
+	}
+}
+
+// updateResolvedProtocols updates the protocols of the tunnel's local ports that the
+// service has resolved from auto, and notifies the manager's handler of each one.
+func (m *Manager) updateResolvedProtocols(tunnel *Tunnel, ports ...*TunnelPort) {
+	if tunnel == nil {
+		return
+	}
+	for _, port := range ports {
+		if port == nil {
+			continue
+		}
+		protocol, ok := port.ResolvedProtocol()
+		if !ok {
+			continue
+		}
+		for i := range tunnel.Ports {
+			local := &tunnel.Ports[i]
+			if local.PortNumber != port.PortNumber {
+				continue
+			}
+			if _, resolved := local.ResolvedProtocol(); resolved {
+				break
+			}
+			local.Protocol = string(protocol)
+			if m.portProtocolResolved != nil {
+				m.portProtocolResolved(tunnel, port)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolvedProtocol(t *testing.T) {
+	tests := map[string]bool{
+		"":                          false,
+		string(TunnelProtocolAuto):  false,
+		string(TunnelProtocolHttps): true,
+	}
+	for protocol, expected := range tests {
+		port := TunnelPort{Protocol: protocol}
+		if _, ok := port.ResolvedProtocol(); ok != expected {
+			t.Errorf("ResolvedProtocol() for %q returned %v, expected %v", protocol, ok, expected)
+		}
+	}
+}
+
+func TestGetTunnelPortReportsResolvedProtocol(t *testing.T) {
+	var resolved []*TunnelPort
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, TunnelPort{PortNumber: 3000, Protocol: string(TunnelProtocolHttp)})
+	}, WithPortProtocolResolved(func(tunnel *Tunnel, port *TunnelPort) {
+		resolved = append(resolved, port)
+	}))
+	defer done()
+
+	tunnel := &Tunnel{
+		ClusterID: "usw2",
+		TunnelID:  "abc123",
+		Ports:     []TunnelPort{{PortNumber: 3000, Protocol: string(TunnelProtocolAuto)}},
+	}
+	for i := 0; i < 2; i++ {
+		port, err := managementClient.GetTunnelPort(ctx, tunnel, 3000, &TunnelRequestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol, ok := port.ResolvedProtocol(); !ok || protocol != TunnelProtocolHttp {
+			t.Errorf("expected resolved protocol http, got %q", protocol)
+		}
+	}
+
+	if protocol, ok := tunnel.Ports[0].ResolvedProtocol(); !ok || protocol != TunnelProtocolHttp {
+		t.Errorf("expected the local port protocol to be updated, got %q", tunnel.Ports[0].Protocol)
+	}
+	if len(resolved) != 1 {
+		t.Errorf("expected one notification, got %d", len(resolved))
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"strconv"
+	"strings"
+)
+
+// BuildPortURI returns the URI where a web client can connect to port through the
+// endpoint, by replacing PortToken in PortURIFormat with the port number.
+// Returns false if the endpoint does not have a port URI format.
+func (e *TunnelEndpoint) BuildPortURI(port uint16) (string, bool) {
+	return formatPort(e.PortURIFormat, port)
+}
+
+// BuildPortSSHCommand returns the command an ssh client can run to connect to port
+// through the endpoint, by replacing PortToken in PortSshCommandFormat with the port
+// number. Returns false if the endpoint does not have an ssh command format.
+func (e *TunnelEndpoint) BuildPortSSHCommand(port uint16) (string, bool) {
+	return formatPort(e.PortSshCommandFormat, port)
+}
+
+func formatPort(format string, port uint16) (string, bool) {
+	if format == "" {
+		return "", false
+	}
+	return strings.Replace(format, PortToken, strconv.Itoa(int(port)), -1), true
+}
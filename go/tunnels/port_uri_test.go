@@ -0,0 +1,28 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import "testing"
+
+func TestBuildPortURI(t *testing.T) {
+	endpoint := &TunnelEndpoint{
+		PortURIFormat:        "https://abc123-{port}.usw2.devtunnels.ms/",
+		PortSshCommandFormat: "ssh -p {port} abc123.usw2.devtunnels.ms",
+	}
+
+	if uri, ok := endpoint.BuildPortURI(8080); !ok || uri != "https://abc123-8080.usw2.devtunnels.ms/" {
+		t.Errorf("unexpected port uri %q", uri)
+	}
+	if command, ok := endpoint.BuildPortSSHCommand(22); !ok || command != "ssh -p 22 abc123.usw2.devtunnels.ms" {
+		t.Errorf("unexpected ssh command %q", command)
+	}
+
+	empty := &TunnelEndpoint{}
+	if uri, ok := empty.BuildPortURI(8080); ok || uri != "" {
+		t.Errorf("expected no port uri without a format, got %q", uri)
+	}
+	if command, ok := empty.BuildPortSSHCommand(22); ok || command != "" {
+		t.Errorf("expected no ssh command without a format, got %q", command)
+	}
+}
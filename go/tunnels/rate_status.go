@@ -0,0 +1,21 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+// Generated from ../../../cs/src/Contracts/RateStatus.cs
+
+package tunnels
+
+// Current value and limit information for a rate-limited operation related to a tunnel or
+// port.
+type RateStatus struct {
+	ResourceStatus
+
+	// Gets or sets the length of each period, in seconds, over which the rate is measured.
+	//
+	// For rates that are limited by month (or billing period), this value may represent an
+	// estimate, since the actual duration may vary by the calendar.
+	PeriodSeconds uint32 `json:"periodSeconds,omitempty"`
+
+	// Gets or sets the number of seconds until the current measurement period ends and the
+	// current rate value resets.
+	ResetSeconds  uint32 `json:"resetSeconds,omitempty"`
+}
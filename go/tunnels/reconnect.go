@@ -0,0 +1,199 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultReconnectInitialBackoff = 1 * time.Second
+	defaultReconnectMaxBackoff     = 30 * time.Second
+)
+
+// ReconnectPolicy configures how a client reconnects to the relay when its connection
+// drops, for example because a relay node was recycled or the network failed briefly.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of times reconnecting is attempted after a drop before
+	// the client gives up, or 0 to keep trying until the context is done.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first attempt. The delay doubles after each
+	// failed attempt. Defaults to 1 second.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the longest delay between attempts. Defaults to 30 seconds.
+	MaxBackoff time.Duration
+}
+
+// WithAutoReconnect makes the client reconnect to the relay when the connection drops,
+// and restore the forwarded ports once the host forwards them again. Reconnection stops
+// when the client is closed or the context passed to Connect is done.
+// Use ReconnectEvents to observe the attempts.
+func WithAutoReconnect(policy ReconnectPolicy) ClientOption {
+	return func(c *Client) {
+		if policy.InitialBackoff <= 0 {
+			policy.InitialBackoff = defaultReconnectInitialBackoff
+		}
+		if policy.MaxBackoff <= 0 {
+			policy.MaxBackoff = defaultReconnectMaxBackoff
+		}
+		c.reconnectPolicy = &policy
+	}
+}
+
+// ReconnectEventType is the type of a ReconnectEvent.
+type ReconnectEventType int
+
+const (
+	// ReconnectEventAttempt is sent before each attempt to reconnect.
+	ReconnectEventAttempt ReconnectEventType = iota
+
+	// ReconnectEventSucceeded is sent when the client has reconnected.
+	ReconnectEventSucceeded
+
+	// ReconnectEventFailed is sent when the client gives up reconnecting.
+	ReconnectEventFailed
+)
+
+// ReconnectEvent reports progress reconnecting to the relay.
+type ReconnectEvent struct {
+	Type ReconnectEventType
+
+	// Attempt is the number of the attempt since the connection dropped, starting at 1.
+	Attempt int
+
+	// Err is the error from the last attempt when Type is ReconnectEventFailed.
+	Err error
+}
+
+// ReconnectEvents returns a channel that receives an event for each attempt to reconnect
+// and its outcome. The channel is closed when the client stops reconnecting. Events are
+// dropped if the receiver falls behind. Returns nil if WithAutoReconnect was not used.
+func (c *Client) ReconnectEvents() <-chan ReconnectEvent {
+	return c.reconnectEvents
+}
+
+// startReconnecting starts watching the connection to clientRelayURI, if reconnecting is
+// enabled and the client is not already watching it.
+func (c *Client) startReconnecting(ctx context.Context, clientRelayURI string) {
+	c.sshMu.Lock()
+	defer c.sshMu.Unlock()
+	if c.reconnectPolicy == nil || c.reconnecting {
+		return
+	}
+	c.reconnecting = true
+	go c.reconnectLoop(ctx, clientRelayURI)
+}
+
+func (c *Client) reconnectLoop(ctx context.Context, clientRelayURI string) {
+	defer close(c.reconnectEvents)
+	for {
+		session := c.session()
+		err := session.Wait()
+		if c.isClosed() || ctx.Err() != nil {
+			return
+		}
+		c.logger.Warn("Connection to the relay was lost, reconnecting", "error", err)
+		c.sendConnectionEvent(ConnectionStateDisconnected, clientRelayURI, err)
+		session.Close()
+
+		if err := c.reconnect(ctx, clientRelayURI); err != nil {
+			c.logger.Error("Failed to reconnect to the relay", "error", err)
+			c.sendConnectionEvent(ConnectionStateDisconnected, clientRelayURI, err)
+			return
+		}
+	}
+}
+
+// reconnect connects to the relay again, retrying as allowed by the reconnect policy,
+// then restores the ports that were forwarded before the connection dropped.
+func (c *Client) reconnect(ctx context.Context, clientRelayURI string) error {
+	ports := c.remoteForwardedPorts.list()
+
+	// Subscribe before connecting, so that ports forwarded on the new connection are not missed.
+	notifications, unsubscribe := c.remoteForwardedPorts.subscribe()
+	defer unsubscribe()
+	forwarded := make(map[uint16]bool)
+	collected := make(chan struct{})
+	stopCollecting := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case n := <-notifications:
+				if n.notificationType == remoteForwardedPortNotificationTypeAdd {
+					forwarded[n.port] = true
+				}
+			case <-stopCollecting:
+				return
+			}
+		}
+	}()
+	defer func() {
+		select {
+		case <-stopCollecting:
+		default:
+			close(stopCollecting)
+			<-collected
+		}
+	}()
+
+	policy := c.reconnectPolicy
+	delay := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := waitToRetry(ctx, delay); err != nil {
+			c.sendReconnectEvent(ReconnectEvent{Type: ReconnectEventFailed, Attempt: attempt, Err: err})
+			return err
+		}
+		if delay *= 2; delay > policy.MaxBackoff {
+			delay = policy.MaxBackoff
+		}
+
+		c.sendReconnectEvent(ReconnectEvent{Type: ReconnectEventAttempt, Attempt: attempt})
+		c.sendConnectionEvent(ConnectionStateReconnecting, clientRelayURI, nil)
+		err := c.connectToRelay(ctx, clientRelayURI)
+		if err == nil {
+			c.sendReconnectEvent(ReconnectEvent{Type: ReconnectEventSucceeded, Attempt: attempt})
+			c.sendConnectionEvent(ConnectionStateConnected, clientRelayURI, nil)
+			break
+		}
+		if c.isClosed() || ctx.Err() != nil || (policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts) {
+			err = fmt.Errorf("failed to reconnect after %d attempts: %w", attempt, err)
+			c.sendReconnectEvent(ReconnectEvent{Type: ReconnectEventFailed, Attempt: attempt, Err: err})
+			return err
+		}
+		c.logger.Warn("Failed to reconnect to the relay, retrying", "error", err)
+	}
+
+	// The host forwards its current ports before it replies to a refresh, so any port
+	// that it has not forwarded again by then was removed while the client was away.
+	if err := c.session().RefreshPorts(ctx); err != nil {
+		c.logger.Warn("Failed to refresh ports after reconnecting, keeping the previous ports", "error", err)
+		return nil
+	}
+	close(stopCollecting)
+	<-collected
+	for _, port := range ports {
+		if !forwarded[port] {
+			c.remoteForwardedPorts.Remove(port)
+		}
+	}
+	return nil
+}
+
+func (c *Client) isClosed() bool {
+	c.sshMu.Lock()
+	defer c.sshMu.Unlock()
+	return c.closed
+}
+
+func (c *Client) sendReconnectEvent(event ReconnectEvent) {
+	select {
+	case c.reconnectEvents <- event:
+	default:
+	}
+}
@@ -3,13 +3,31 @@
 
 package tunnels
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
+
+// ForwardedPortsDiff describes how the ports forwarded by the host changed.
+type ForwardedPortsDiff struct {
+	// Added lists the ports that are newly forwarded, in ascending order.
+	Added []uint16
+
+	// Removed lists the ports that are no longer forwarded, in ascending order.
+	Removed []uint16
+}
+
+// notificationBufferSize is the number of notifications buffered for each subscriber.
+// Notifications are dropped for subscribers that fall further behind.
+const notificationBufferSize = 64
 
 type remoteForwardedPorts struct {
 	portsMu sync.RWMutex
 	ports   map[uint16]bool
+	metrics MetricsRecorder
 
-	notify chan remoteForwardedPortNotification
+	subscribersMu sync.Mutex
+	subscribers   map[chan remoteForwardedPortNotification]struct{}
 }
 
 type remoteForwardedPortNotification struct {
@@ -26,8 +44,8 @@ const (
 
 func newRemoteForwardedPorts() *remoteForwardedPorts {
 	return &remoteForwardedPorts{
-		ports:  make(map[uint16]bool),
-		notify: make(chan remoteForwardedPortNotification),
+		ports:       make(map[uint16]bool),
+		subscribers: make(map[chan remoteForwardedPortNotification]struct{}),
 	}
 }
 
@@ -36,16 +54,24 @@ func (r *remoteForwardedPorts) Add(port uint16) {
 	defer r.portsMu.Unlock()
 
 	r.ports[port] = true
-
-	notification := remoteForwardedPortNotification{
-		port:             port,
-		notificationType: remoteForwardedPortNotificationTypeAdd,
+	if r.metrics != nil {
+		r.metrics.SetForwardedPorts(len(r.ports))
 	}
+	r.notify(port, remoteForwardedPortNotificationTypeAdd)
+}
 
-	select {
-	case r.notify <- notification:
-	default:
+func (r *remoteForwardedPorts) Remove(port uint16) {
+	r.portsMu.Lock()
+	defer r.portsMu.Unlock()
+
+	if !r.ports[port] {
+		return
 	}
+	delete(r.ports, port)
+	if r.metrics != nil {
+		r.metrics.SetForwardedPorts(len(r.ports))
+	}
+	r.notify(port, remoteForwardedPortNotificationTypeRemove)
 }
 
 func (r *remoteForwardedPorts) hasPort(port uint16) bool {
@@ -54,3 +80,71 @@ func (r *remoteForwardedPorts) hasPort(port uint16) bool {
 
 	return r.ports[port]
 }
+
+// list returns the forwarded ports in ascending order.
+func (r *remoteForwardedPorts) list() []uint16 {
+	r.portsMu.RLock()
+	defer r.portsMu.RUnlock()
+
+	ports := make([]uint16, 0, len(r.ports))
+	for port := range r.ports {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// subscribe returns a channel that receives a notification for each port that is added
+// or removed, and a function that stops the notifications.
+func (r *remoteForwardedPorts) subscribe() (<-chan remoteForwardedPortNotification, func()) {
+	notifications := make(chan remoteForwardedPortNotification, notificationBufferSize)
+
+	r.subscribersMu.Lock()
+	r.subscribers[notifications] = struct{}{}
+	r.subscribersMu.Unlock()
+
+	return notifications, func() {
+		r.subscribersMu.Lock()
+		delete(r.subscribers, notifications)
+		r.subscribersMu.Unlock()
+	}
+}
+
+func (r *remoteForwardedPorts) notify(port uint16, notificationType remoteForwardedPortNotificationType) {
+	notification := remoteForwardedPortNotification{
+		port:             port,
+		notificationType: notificationType,
+	}
+
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	for subscriber := range r.subscribers {
+		select {
+		case subscriber <- notification:
+		default:
+		}
+	}
+}
+
+// diffForwardedPorts returns the ports in after that are not in before as added,
+// and the ports in before that are not in after as removed.
+func diffForwardedPorts(before, after []uint16) *ForwardedPortsDiff {
+	diff := &ForwardedPortsDiff{}
+	inBefore := make(map[uint16]bool, len(before))
+	for _, port := range before {
+		inBefore[port] = true
+	}
+	inAfter := make(map[uint16]bool, len(after))
+	for _, port := range after {
+		inAfter[port] = true
+		if !inBefore[port] {
+			diff.Added = append(diff.Added, port)
+		}
+	}
+	for _, port := range before {
+		if !inAfter[port] {
+			diff.Removed = append(diff.Removed, port)
+		}
+	}
+	return diff
+}
@@ -5,6 +5,7 @@ package tunnels
 
 import (
 	"net/url"
+	"time"
 )
 
 // Options that are sent in requests to the tunnels service.
@@ -21,6 +22,14 @@ type TunnelRequestOptions struct {
 	// Flag that requests tunnel ports when retrieving a tunnel object.
 	IncludePorts bool
 
+	// Flag that requests the status of each port when listing tunnel ports.
+	IncludePortStatus bool
+
+	// Flag that requests the access control of tunnels when retrieving or listing them.
+	// The service only returns access control to callers with the manage scope, so the
+	// request is authorized with a tunnel manage token when one is used.
+	IncludeAccessControl bool
+
 	// Optional list of tags to filter the requested tunnels or ports.
 	// By default, an item is included if ANY tag matches; set `requireAllTags` to match
 	// ALL tags instead.
@@ -36,8 +45,29 @@ type TunnelRequestOptions struct {
 	// List of token scopes that are requested when retrieving a tunnel or tunnel port object.
 	TokenScopes TunnelAccessScopes
 
+	// Scopes of the tunnel access token used to authorize the request, instead of the scopes
+	// the request uses by default. Set this when the tunnel only has a token with other scopes
+	// that the service still accepts for the request, such as a host token for creating a port.
+	TokenScopeOverride TunnelAccessScopes
+
 	// If there is another tunnel with the name requested in updateTunnel, try to acquire the name from the other tunnel.
 	ForceRename bool
+
+	// Timeout of the request, including retries, or 0 for no timeout other than the
+	// deadline of the context passed with the request. The request is still cancelled if
+	// the context is done first, so a sooner context deadline always wins.
+	Timeout time.Duration
+
+	// Flag that skips validating a tunnel or port with Tunnel.Validate or TunnelPort.Validate
+	// before it is created or updated. By default an invalid tunnel or port is not sent, and
+	// ValidationErrors are returned instead of a request that the service would reject.
+	SkipClientValidation bool
+
+	// Flag that sends an update without the entity tag of the tunnel or port, so that the
+	// update overwrites any changes made since the tunnel or port was read. By default an
+	// update of a *Tunnel or *TunnelPort that the manager returned, or last updated, is
+	// conditional on the entity tag the service returned with it.
+	SkipConcurrencyCheck bool
 }
 
 func (options *TunnelRequestOptions) queryString() string {
@@ -45,6 +75,12 @@ func (options *TunnelRequestOptions) queryString() string {
 	if options.IncludePorts {
 		queryOptions.Set("includePorts", "true")
 	}
+	if options.IncludePortStatus {
+		queryOptions.Set("includeStatus", "true")
+	}
+	if options.IncludeAccessControl {
+		queryOptions.Set("includeAccessControl", "true")
+	}
 	if options.Scopes != nil {
 		if err := options.Scopes.valid(nil); err == nil {
 			for _, scope := range options.Scopes {
@@ -75,3 +111,37 @@ func (options *TunnelRequestOptions) queryString() string {
 
 	return queryOptions.Encode()
 }
+
+// withAdditionalHeader returns a copy of the options with an additional request header,
+// leaving the original options unchanged.
+func (options *TunnelRequestOptions) withAdditionalHeader(name, value string) *TunnelRequestOptions {
+	result := TunnelRequestOptions{}
+	if options != nil {
+		result = *options
+	}
+	result.AdditionalHeaders = make(map[string]string, len(result.AdditionalHeaders)+1)
+	if options != nil {
+		for header, headerValue := range options.AdditionalHeaders {
+			result.AdditionalHeaders[header] = headerValue
+		}
+	}
+	result.AdditionalHeaders[name] = value
+	return &result
+}
+
+// readTunnelAccessTokenScopes returns the scopes of tunnel access tokens that can
+// authorize reading tunnels with the options.
+func (options *TunnelRequestOptions) readTunnelAccessTokenScopes() []TunnelAccessScope {
+	if options != nil && options.IncludeAccessControl {
+		return manageAccessTokenScope
+	}
+	return readAccessTokenScope
+}
+
+// validate returns an error if v is invalid, unless options skip client validation.
+func (options *TunnelRequestOptions) validate(v interface{ Validate() error }) error {
+	if options != nil && options.SkipClientValidation {
+		return nil
+	}
+	return v.Validate()
+}
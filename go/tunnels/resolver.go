@@ -0,0 +1,50 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Resolver resolves host names to IP addresses. It allows overriding how the tunnel
+// service and relay host names are resolved, for example to direct a host name to a
+// staging or test server. *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// resolvingDialContext returns a dial function that resolves the host with resolver,
+// then dials each resolved address in turn until a connection succeeds.
+func resolvingDialContext(resolver Resolver, dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving host %s: %w", host, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("error resolving host %s: no addresses", host)
+		}
+
+		var dialErr error
+		for _, a := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+		}
+		return nil, dialErr
+	}
+}
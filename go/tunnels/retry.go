@@ -0,0 +1,190 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy configures how a Manager retries requests that fail with a transient error:
+// a network error, 429 Too Many Requests, or a 5xx server error.
+// Requests are retried with exponential backoff and jitter, or after the delay in the
+// response's Retry-After header when there is one.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Requests are not retried if it is less than 2.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, doubled for each later retry.
+	// Defaults to 500ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits the delay between retries. Defaults to 30s.
+	MaxBackoff time.Duration
+
+	// RetryPost enables retrying POST requests such as CreateTunnel, which are not
+	// idempotent, so a retry may repeat a request that the service already applied.
+	RetryPost bool
+}
+
+// WithRetryPolicy makes the manager retry idempotent requests that fail with a transient
+// error, as described by policy. It adds RetryMiddleware(policy) to the manager's
+// middlewares, so middlewares added before it run once for each request and middlewares
+// added after it run for each attempt.
+func WithRetryPolicy(policy RetryPolicy) ManagerOption {
+	return WithMiddleware(RetryMiddleware(policy))
+}
+
+// RetryMiddleware returns a middleware that retries idempotent requests that fail with a
+// transient error, as described by policy. Retries stop when the request's context is
+// done, or when the delay before the next attempt would pass the context's deadline.
+// Requests that fail with a transient error return a *RetryError, which wraps the
+// *TunnelServiceError or the error sending the request of the last attempt.
+func RetryMiddleware(policy RetryPolicy) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(request *http.Request) (*http.Response, error) {
+			if !policy.appliesTo(request.Method) {
+				return next(request)
+			}
+			return policy.send(next, request)
+		}
+	}
+}
+
+// RetryError is returned when a request that the retry policy applies to fails.
+type RetryError struct {
+	// Attempts is the number of times the request was sent.
+	Attempts int
+
+	// Err is the error from the last attempt.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v (after %d attempts)", e.Err, e.Attempts)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (p *RetryPolicy) appliesTo(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return p.MaxAttempts > 1
+	case http.MethodPost:
+		return p.MaxAttempts > 1 && p.RetryPost
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the retry that follows attempt.
+func (p *RetryPolicy) backoff(attempt int, response *http.Response) time.Duration {
+	if response != nil {
+		if delay, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			return delay
+		}
+	}
+
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	delay := max
+	if attempt < 32 {
+		if d := initial << uint(attempt-1); d > 0 && d < max {
+			delay = d
+		}
+	}
+
+	// Use a random delay between half and all of the backoff, so that clients that
+	// failed together do not retry together.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func isTransientResponse(response *http.Response) bool {
+	return response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode >= http.StatusInternalServerError
+}
+
+// isTransportError reports whether err is an error from the http client sending the
+// request, such as a failure to connect, rather than an error from a middleware or a
+// canceled request.
+func isTransportError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// send sends the request with next, retrying it as allowed by the policy.
+func (p *RetryPolicy) send(next RequestHandler, request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, &RetryError{Attempts: attempt - 1, Err: err}
+			}
+			request.Body = body
+		}
+
+		response, err := next(request)
+		if err != nil && !isTransportError(err) {
+			return nil, err
+		}
+		if err == nil && !isTransientResponse(response) {
+			return response, nil
+		}
+		if err == nil {
+			// Read the failed response into an error, in case it is the last attempt.
+			if err = decompressResponse(response); err == nil {
+				err = newTunnelServiceError(response)
+			}
+			response.Body.Close()
+		}
+
+		if attempt >= p.MaxAttempts {
+			return nil, &RetryError{Attempts: attempt, Err: err}
+		}
+		delay := p.backoff(attempt, response)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return nil, &RetryError{Attempts: attempt, Err: err}
+		}
+		if waitErr := waitToRetry(ctx, delay); waitErr != nil {
+			return nil, &RetryError{Attempts: attempt, Err: err}
+		}
+	}
+}
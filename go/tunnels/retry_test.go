@@ -0,0 +1,181 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetriesTransientFailures(t *testing.T) {
+	requests := 0
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, &Tunnel{Name: "test-tunnel"})
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	defer closeServer()
+
+	tunnel, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Name != "test-tunnel" || requests != 3 {
+		t.Errorf("expected the tunnel after 3 requests, got %d requests", requests)
+	}
+}
+
+func TestReturnsRetryErrorWhenAttemptsAreExhausted(t *testing.T) {
+	requests := 0
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+	defer closeServer()
+
+	_, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 2 {
+		t.Errorf("expected a RetryError after 2 attempts, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestDoesNotRetryPostOrPermanentFailures(t *testing.T) {
+	requests := 0
+	status := http.StatusServiceUnavailable
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	defer closeServer()
+
+	if _, err := managementClient.CreateTunnel(ctx, &Tunnel{}, &TunnelRequestOptions{}); err == nil {
+		t.Error("expected create tunnel to fail")
+	}
+	if requests != 1 {
+		t.Errorf("expected a POST not to be retried, got %d requests", requests)
+	}
+
+	requests = 0
+	status = http.StatusNotFound
+	if _, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{}); err == nil {
+		t.Error("expected get tunnel to fail")
+	}
+	if requests != 1 {
+		t.Errorf("expected a 404 not to be retried, got %d requests", requests)
+	}
+}
+
+func TestDoesNotRetryPastContextDeadline(t *testing.T) {
+	requests := 0
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	defer closeServer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 1 {
+		t.Errorf("expected a RetryError after 1 attempt, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to stop without waiting for the Retry-After delay, took %v", elapsed)
+	}
+}
+
+func TestRetriesTransportErrors(t *testing.T) {
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {},
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+	closeServer()
+
+	_, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 2 {
+		t.Errorf("expected a RetryError after 2 attempts, got %v", err)
+	}
+}
+
+func TestDoesNotRetryMiddlewareErrors(t *testing.T) {
+	errRejectedByMiddleware := errors.New("rejected by middleware")
+	requests := 0
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+		WithMiddleware(func(next RequestHandler) RequestHandler {
+			return func(request *http.Request) (*http.Response, error) {
+				return nil, errRejectedByMiddleware
+			}
+		}))
+	defer closeServer()
+
+	_, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{})
+	var retryErr *RetryError
+	if !errors.Is(err, errRejectedByMiddleware) || errors.As(err, &retryErr) {
+		t.Errorf("expected the middleware error without retrying, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests, got %d", requests)
+	}
+}
+
+func TestRetryMiddlewareOrder(t *testing.T) {
+	requests := 0
+	var outer, inner int
+	count := func(n *int) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return func(request *http.Request) (*http.Response, error) {
+				*n++
+				return next(request)
+			}
+		}
+	}
+	managementClient, closeServer := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, &Tunnel{Name: "test-tunnel"})
+	}, WithMiddleware(
+		count(&outer),
+		RetryMiddleware(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+		count(&inner),
+	))
+	defer closeServer()
+
+	if _, err := managementClient.GetTunnel(ctx, &Tunnel{Name: "test-tunnel"}, &TunnelRequestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if outer != 1 || inner != 3 {
+		t.Errorf("expected the outer middleware to run once and the inner one for each attempt, got %d and %d", outer, inner)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if delay, ok := parseRetryAfter("2"); !ok || delay != 2*time.Second {
+		t.Errorf("expected 2s, got %v", delay)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if delay, ok := parseRetryAfter(date); !ok || delay <= 58*time.Second || delay > time.Minute {
+		t.Errorf("expected about 1m for %s, got %v", date, delay)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error("expected an invalid Retry-After value to be ignored")
+	}
+}
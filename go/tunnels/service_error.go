@@ -0,0 +1,166 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrConcurrencyConflict is matched by the TunnelServiceError returned when an update
+// fails because the tunnel or port was changed since it was read. Get the tunnel or port
+// again and retry the update, or set TunnelRequestOptions.SkipConcurrencyCheck.
+var ErrConcurrencyConflict = errors.New("the tunnel or port was changed since it was read")
+
+// maxBodySnippetLength is the number of body bytes included in errors about a response.
+const maxBodySnippetLength = 256
+
+// jwtPattern matches JSON web tokens, which are redacted from body snippets.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// TunnelServiceError is returned when the tunnel service responds to a request with an
+// unsuccessful status code. Use errors.As to inspect the status code and problem details,
+// for example to handle http.StatusTooManyRequests or http.StatusNotFound.
+type TunnelServiceError struct {
+	// StatusCode is the HTTP status code of the service's response.
+	StatusCode int
+
+	// ProblemDetails holds the error details returned by the service,
+	// or nil if the response did not include any.
+	ProblemDetails *ProblemDetails
+
+	// ProblemStatus is the status code in the problem details, or 0 if the service did not
+	// include one. It differs from StatusCode if a proxy changed the status of the response.
+	ProblemStatus int
+
+	// Instance is the URI reference in the problem details that identifies the occurrence
+	// of the problem, or empty if the service did not include one.
+	Instance string
+
+	// Body is the raw body of the service's response.
+	Body []byte
+
+	// ContentType is the Content-Type header of the service's response.
+	ContentType string
+}
+
+// newTunnelServiceError reads the body of an unsuccessful response into an error.
+func newTunnelServiceError(response *http.Response) *TunnelServiceError {
+	e := &TunnelServiceError{StatusCode: response.StatusCode, ContentType: response.Header.Get("Content-Type")}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return e
+	}
+	e.Body = body
+
+	if problemDetails, err := ParseProblemDetails(body); err == nil {
+		e.ProblemDetails = &problemDetails.ProblemDetails
+		e.ProblemStatus = problemDetails.Status
+		e.Instance = problemDetails.Instance
+	}
+	return e
+}
+
+// ServiceProblemDetails is the error details the service returns with unsuccessful
+// responses, with the standard RFC 7807 members that are not part of the ProblemDetails
+// contract.
+type ServiceProblemDetails struct {
+	ProblemDetails
+
+	// Status is the status code in the problem details, or 0 if the service did not
+	// include one.
+	Status int `json:"status,omitempty"`
+
+	// Instance is the URI reference that identifies the occurrence of the problem, or
+	// empty if the service did not include one.
+	Instance string `json:"instance,omitempty"`
+}
+
+// ParseProblemDetails parses the body of a response from the tunnel service into the
+// error details the service returns with unsuccessful responses. It is the parsing used
+// by TunnelServiceError, for callers that read responses in their own middleware or
+// transport. Returns an error if the body is not JSON or has no title or detail.
+func ParseProblemDetails(body []byte) (*ServiceProblemDetails, error) {
+	var problemDetails ServiceProblemDetails
+	if err := json.Unmarshal(body, &problemDetails); err != nil {
+		return nil, fmt.Errorf("error parsing problem details: %w", err)
+	}
+	if problemDetails.Title == "" && problemDetails.Detail == "" {
+		return nil, errors.New("response body does not contain problem details")
+	}
+	return &problemDetails, nil
+}
+
+func (e *TunnelServiceError) Error() string {
+	if e.ProblemDetails == nil && len(e.Body) > 0 {
+		// Include the body, such as an HTML error page from a proxy, to help diagnose the failure.
+		return fmt.Sprintf("unsuccessful request, response: %d: %s\n\tcontent type %q, body: %s",
+			e.StatusCode, http.StatusText(e.StatusCode), e.ContentType, bodySnippet(e.Body))
+	}
+	if e.ProblemDetails == nil {
+		return fmt.Sprintf("unsuccessful request, response: %d: %s",
+			e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("unsuccessful request, response: %d %s\n\t%s",
+		e.StatusCode, http.StatusText(e.StatusCode), e.ProblemDetails.message())
+}
+
+// Is reports whether the error is ErrConcurrencyConflict, for a precondition failed
+// response to a conditional update.
+func (e *TunnelServiceError) Is(target error) bool {
+	return target == ErrConcurrencyConflict && e.StatusCode == http.StatusPreconditionFailed
+}
+
+// message formats the problem details as a human-readable message.
+func (problemDetails *ProblemDetails) message() string {
+	var errorMessage string
+	if problemDetails.Title != "" {
+		errorMessage += problemDetails.Title
+	}
+	if problemDetails.Detail != "" {
+		if len(errorMessage) > 0 {
+			errorMessage += " "
+		}
+		errorMessage += problemDetails.Detail
+	}
+	for errorKey, errorDetail := range problemDetails.Errors {
+		errorMessage += "\n\t" + errorKey + ": "
+		for _, errorDetailMessage := range errorDetail {
+			errorMessage += " "
+			errorMessage += errorDetailMessage
+		}
+	}
+	return errorMessage
+}
+
+// invalidJSONError returns an error for a successful response whose body is not valid
+// JSON, for example an HTML page returned by a misrouting proxy.
+func invalidJSONError(response *http.Response, body []byte) error {
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	return fmt.Errorf("invalid JSON in response: %d %s, content type %q, body: %s: %w",
+		response.StatusCode, http.StatusText(response.StatusCode),
+		response.Header.Get("Content-Type"), bodySnippet(body), err)
+}
+
+// bodySnippet returns the start of a response body for an error message, quoted, with
+// tokens redacted.
+func bodySnippet(body []byte) string {
+	snippet := string(body)
+	truncated := len(snippet) > maxBodySnippetLength
+	if truncated {
+		snippet = snippet[:maxBodySnippetLength]
+	}
+	snippet = jwtPattern.ReplaceAllString(snippet, redacted)
+	snippet = strings.Join(strings.Fields(snippet), " ")
+	if truncated {
+		return fmt.Sprintf("%q... (%d bytes)", snippet, len(body))
+	}
+	return fmt.Sprintf("%q", snippet)
+}
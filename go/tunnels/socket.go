@@ -6,10 +6,14 @@ package tunnels
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,30 +27,120 @@ type socket struct {
 
 	conn   *websocket.Conn
 	reader io.Reader
+
+	// resolver, if set, resolves the relay host name instead of the system resolver.
+	resolver Resolver
+
+	// localAddr, if set, is the local address the relay connection is bound to.
+	localAddr *net.TCPAddr
+
+	// proxy, if set, returns the proxy for the websocket upgrade request instead of the
+	// proxy configured by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	proxy func(*http.Request) (*url.URL, error)
+
+	// writeTimeout bounds how long a single write may block on a slow or stuck relay.
+	// Zero means writes only time out at the deadline set by SetWriteDeadline.
+	writeTimeout time.Duration
+
+	writeDeadlineMu sync.Mutex
+	writeDeadline   time.Time
+}
+
+// ErrRelayWriteTimeout is returned when a write to the relay connection does not complete
+// within the write timeout, for example because the relay is not reading.
+var ErrRelayWriteTimeout = errors.New("timed out writing to the tunnel relay connection")
+
+// ErrRelayProtocolMismatch is returned when the relay accepts the websocket connection
+// without selecting the relay protocol the SDK offered, for example because the relay
+// requires a newer protocol version.
+var ErrRelayProtocolMismatch = errors.New("the tunnel relay does not support the offered relay protocol")
+
+// RelayConnectError is returned when the relay rejects the websocket upgrade request.
+type RelayConnectError struct {
+	// StatusCode is the HTTP status code of the relay's response.
+	StatusCode int
+}
+
+func (e *RelayConnectError) Error() string {
+	return fmt.Sprintf("handshake failed with status %d", e.StatusCode)
+}
+
+// Retryable reports whether the connection may succeed if it is retried later,
+// for example when the relay is throttling or temporarily unavailable.
+// Authentication and authorization failures are not retryable.
+func (e *RelayConnectError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
 }
 
 func newSocket(uri string, protocols []string, headers http.Header, tlsConfig *tls.Config) *socket {
 	return &socket{addr: uri, protocols: protocols, headers: headers, tlsConfig: tlsConfig}
 }
 
+// NewRelayTransport returns a transport for ConnectWithTransport that exchanges data
+// over ws, an already connected websocket to the tunnel relay.
+// Returns an error if ws is nil or negotiated a protocol other than the client relay protocol.
+func NewRelayTransport(ws *websocket.Conn) (net.Conn, error) {
+	if ws == nil {
+		return nil, ErrNoTransport
+	}
+	if p := ws.Subprotocol(); p != "" && p != clientWebSocketSubProtocol {
+		return nil, fmt.Errorf("unexpected websocket protocol %q, expected %q", p, clientWebSocketSubProtocol)
+	}
+	return &socket{conn: ws, writeTimeout: defaultRelayWriteTimeout}, nil
+}
+
 func (s *socket) connect(ctx context.Context) error {
+	proxy := s.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
 	dialer := websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
+		Proxy:            proxy,
 		HandshakeTimeout: 45 * time.Second,
 		TLSClientConfig:  s.tlsConfig,
 		Subprotocols:     s.protocols,
 	}
+	netDialer := &net.Dialer{}
+	if s.localAddr != nil {
+		netDialer.LocalAddr = s.localAddr
+		dialer.NetDialContext = netDialer.DialContext
+	}
+	if s.resolver != nil {
+		dialer.NetDialContext = resolvingDialContext(s.resolver, netDialer)
+	}
 	ws, resp, err := dialer.Dial(s.addr, s.headers)
 	if err != nil {
-		if err == websocket.ErrBadHandshake {
-			return fmt.Errorf("handshake failed with status %d", resp.StatusCode)
+		if err == websocket.ErrBadHandshake && resp != nil {
+			return &RelayConnectError{StatusCode: resp.StatusCode}
 		}
 		return err
 	}
+	if len(s.protocols) > 0 && !containsString(s.protocols, ws.Subprotocol()) {
+		ws.Close()
+		return fmt.Errorf("%w: offered %q, relay selected %q",
+			ErrRelayProtocolMismatch, strings.Join(s.protocols, ", "), ws.Subprotocol())
+	}
 	s.conn = ws
 	return nil
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *socket) Read(b []byte) (int, error) {
 	if s.reader == nil {
 		_, reader, err := s.conn.NextReader()
@@ -70,15 +164,45 @@ func (s *socket) Read(b []byte) (int, error) {
 }
 
 func (s *socket) Write(b []byte) (int, error) {
+	if s.writeTimeout > 0 {
+		if err := s.conn.SetWriteDeadline(s.nextWriteDeadline()); err != nil {
+			return 0, err
+		}
+	}
+
 	nextWriter, err := s.conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
-		return 0, err
+		return 0, s.writeError(err)
 	}
 
 	bytesWritten, err := nextWriter.Write(b)
-	nextWriter.Close()
+	// Closing the writer flushes the message, so it can fail even when the write succeeded.
+	if closeErr := nextWriter.Close(); err == nil {
+		err = closeErr
+	}
+
+	return bytesWritten, s.writeError(err)
+}
 
-	return bytesWritten, err
+// nextWriteDeadline returns the deadline for a write starting now,
+// which is the earlier of the write timeout and any deadline set by the caller.
+func (s *socket) nextWriteDeadline() time.Time {
+	deadline := time.Now().Add(s.writeTimeout)
+
+	s.writeDeadlineMu.Lock()
+	defer s.writeDeadlineMu.Unlock()
+	if !s.writeDeadline.IsZero() && s.writeDeadline.Before(deadline) {
+		return s.writeDeadline
+	}
+	return deadline
+}
+
+func (s *socket) writeError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrRelayWriteTimeout, err)
+	}
+	return err
 }
 
 func (s *socket) Close() error {
@@ -106,5 +230,9 @@ func (s *socket) SetReadDeadline(t time.Time) error {
 }
 
 func (s *socket) SetWriteDeadline(t time.Time) error {
+	s.writeDeadlineMu.Lock()
+	s.writeDeadline = t
+	s.writeDeadlineMu.Unlock()
+
 	return s.conn.SetWriteDeadline(t)
 }
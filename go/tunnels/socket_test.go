@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSocketWriteTimesOutWhenRelayIsNotReading(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Never read, so that the client's writes eventually block.
+		<-done
+	}))
+	defer server.Close()
+
+	sock := newSocket(strings.Replace(server.URL, "http://", "ws://", 1), nil, nil, nil)
+	sock.writeTimeout = 100 * time.Millisecond
+	if err := sock.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	data := make([]byte, 1024*1024)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := sock.Write(data); err != nil {
+			if !errors.Is(err, ErrRelayWriteTimeout) {
+				t.Errorf("expected ErrRelayWriteTimeout, got %v", err)
+			}
+			return
+		}
+	}
+	t.Fatal("write did not time out while the relay was not reading")
+}
+
+func TestSocketWriteHonorsEarlierDeadline(t *testing.T) {
+	sock := &socket{writeTimeout: time.Hour}
+	deadline := time.Now().Add(time.Second)
+	sock.writeDeadline = deadline
+
+	if d := sock.nextWriteDeadline(); !d.Equal(deadline) {
+		t.Errorf("expected the caller's deadline %v, got %v", deadline, d)
+	}
+
+	sock.writeDeadline = time.Time{}
+	if d := sock.nextWriteDeadline(); d.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("expected the write timeout to set the deadline, got %v", d)
+	}
+}
+
+func TestSocketConnectRejectsRelayProtocolMismatch(t *testing.T) {
+	for _, selected := range []string{"", "tunnel-relay-client-v2"} {
+		upgrader := websocket.Upgrader{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var header http.Header
+			if selected != "" {
+				header = http.Header{"Sec-Websocket-Protocol": {selected}}
+			}
+			conn, err := upgrader.Upgrade(w, r, header)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+
+		sock := newSocket(strings.Replace(server.URL, "http://", "ws://", 1), []string{clientWebSocketSubProtocol}, nil, nil)
+		err := sock.connect(ctx)
+		server.Close()
+		if !errors.Is(err, ErrRelayProtocolMismatch) {
+			t.Errorf("expected ErrRelayProtocolMismatch when the relay selects %q, got %v", selected, err)
+		}
+	}
+}
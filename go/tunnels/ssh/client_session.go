@@ -6,15 +6,16 @@ package tunnelssh
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/microsoft/dev-tunnels/go/tunnels/ssh/messages"
@@ -23,42 +24,109 @@ import (
 
 type portForwardingManager interface {
 	Add(port uint16)
+	Remove(port uint16)
 }
 
+// DefaultLocalBindAddress is the address that listeners for forwarded ports bind to by
+// default, so that forwarded ports are only reachable from this machine.
+const DefaultLocalBindAddress = "127.0.0.1"
+
 type ClientSSHSession struct {
 	*SSHSession
 	pf              portForwardingManager
 	listenersMu     sync.Mutex
-	listeners       []net.Listener
+	listeners       map[uint16]net.Listener
+	closed          bool
 	channels        uint32
 	acceptLocalConn bool
-	forwardedPorts  map[uint16]uint16
+
+	// ctx is canceled when the session is closed, to stop forwarding local connections.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	forwardedPortsMu sync.Mutex
+	forwardedPorts   map[uint16]uint16
+
+	localBindAddress    string
+	localPorts          map[uint16]uint16
+	preferredLocalPorts map[uint16]uint16
+	onLocalListener     func(remotePort uint16, localAddr net.Addr)
+
+	hostKeyCallback ssh.HostKeyCallback
+	copyBuffers     *CopyBufferPool
 }
 
-func NewClientSSHSession(socket net.Conn, pf portForwardingManager, acceptLocalConn bool, logger *log.Logger) *ClientSSHSession {
+func NewClientSSHSession(socket net.Conn, pf portForwardingManager, acceptLocalConn bool, logger Logger) *ClientSSHSession {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ClientSSHSession{
 		SSHSession: &SSHSession{
 			socket: socket,
 			logger: logger,
 		},
-		pf:              pf,
-		acceptLocalConn: acceptLocalConn,
-		listeners:       make([]net.Listener, 0),
-		forwardedPorts:  make(map[uint16]uint16),
+		pf:               pf,
+		acceptLocalConn:  acceptLocalConn,
+		listeners:        make(map[uint16]net.Listener),
+		ctx:              ctx,
+		cancel:           cancel,
+		forwardedPorts:   make(map[uint16]uint16),
+		localBindAddress: DefaultLocalBindAddress,
 	}
 }
 
+// SetHostKeyCallback sets the callback used to verify the host key during the SSH
+// handshake. By default the host key is not verified.
+func (s *ClientSSHSession) SetHostKeyCallback(callback ssh.HostKeyCallback) {
+	s.hostKeyCallback = callback
+}
+
+// SetCopyBufferPool sets the pool of buffers used to copy data between local
+// connections and their channels. By default each copy allocates its own buffer.
+func (s *ClientSSHSession) SetCopyBufferPool(pool *CopyBufferPool) {
+	s.copyBuffers = pool
+}
+
+// SetLocalBindAddress sets the address that listeners for forwarded ports bind to.
+// By default they bind to DefaultLocalBindAddress.
+func (s *ClientSSHSession) SetLocalBindAddress(address string) {
+	s.localBindAddress = address
+}
+
+// SetLocalPortMapping sets the local ports to listen on for forwarded host ports. A host
+// port in ports is forwarded only to its mapped local port, and fails to forward if
+// that port is in use. Other host ports are forwarded to automatically chosen ports.
+func (s *ClientSSHSession) SetLocalPortMapping(ports map[uint16]uint16) {
+	s.localPorts = ports
+}
+
+// SetPreferredLocalPorts sets the local ports to try first for forwarded host ports, such
+// as the ports a previous session listened on. Unlike SetLocalPortMapping, another local
+// port is chosen if a preferred port is in use.
+func (s *ClientSSHSession) SetPreferredLocalPorts(ports map[uint16]uint16) {
+	s.preferredLocalPorts = ports
+}
+
+// SetLocalListenerCallback sets a function that is called with the local address the
+// client listens on for each forwarded host port.
+func (s *ClientSSHSession) SetLocalListenerCallback(callback func(remotePort uint16, localAddr net.Addr)) {
+	s.onLocalListener = callback
+}
+
 func (s *ClientSSHSession) Connect(ctx context.Context) error {
+	hostKeyCallback := s.hostKeyCallback
+	if hostKeyCallback == nil {
+		// TODO: Validate host public keys match those published to the service?
+		// For now, the assumption is only a host with access to the tunnel can get a token
+		// that enables listening for tunnel connections.
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
 	clientConfig := ssh.ClientConfig{
 		// For now, the client is allowed to skip SSH authentication;
 		// they must have a valid tunnel access token already to get this far.
 		User:    "tunnel",
 		Timeout: 10 * time.Second,
 
-		// TODO: Validate host public keys match those published to the service?
-		// For now, the assumption is only a host with access to the tunnel can get a token
-		// that enables listening for tunnel connections.
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 	}
 
 	sshClientConn, chans, reqs, err := ssh.NewClientConn(s.socket, "", &clientConfig)
@@ -92,6 +160,8 @@ func (s *ClientSSHSession) handleGlobalRequests(incoming <-chan *ssh.Request) {
 		switch r.Type {
 		case messages.PortForwardRequestType:
 			s.handlePortForwardRequest(r)
+		case messages.PortForwardCancelRequestType:
+			s.handlePortForwardCancelRequest(r)
 		default:
 			// This handles keepalive messages and matches
 			// the behaviour of OpenSSH.
@@ -111,7 +181,7 @@ func (s *ClientSSHSession) handlePortForwardRequest(r *ssh.Request) {
 
 	s.pf.Add(uint16(req.Port()))
 	if s.acceptLocalConn {
-		go s.forwardPort(context.Background(), uint16(req.Port()))
+		go s.forwardPort(s.ctx, uint16(req.Port()))
 	}
 
 	reply := messages.NewPortForwardSuccess(req.Port())
@@ -125,6 +195,45 @@ func (s *ClientSSHSession) handlePortForwardRequest(r *ssh.Request) {
 	r.Reply(true, b)
 }
 
+func (s *ClientSSHSession) handlePortForwardCancelRequest(r *ssh.Request) {
+	req := new(messages.PortForwardRequest)
+	buf := bytes.NewReader(r.Payload)
+	if err := req.Unmarshal(buf); err != nil {
+		s.logger.Printf("error unmarshalling cancel port forward request: %v", err)
+		r.Reply(false, nil)
+		return
+	}
+
+	port := uint16(req.Port())
+	s.removeListener(port)
+	s.pf.Remove(port)
+	r.Reply(true, nil)
+}
+
+// RefreshPorts asks the host to refresh the forwarded ports. The host forwards new ports
+// and cancels forwarding of removed ports before it replies to the request.
+func (s *ClientSSHSession) RefreshPorts(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		ok, _, err := s.conn.SendRequest(messages.RefreshPortsRequestType, true, nil)
+		if err == nil && !ok {
+			err = fmt.Errorf("refresh ports request was rejected")
+		}
+		errc <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errc:
+		return err
+	}
+}
+
 func (s *ClientSSHSession) OpenChannel(ctx context.Context, channelType string, data []byte) (ssh.Channel, error) {
 	channel, reqs, err := s.conn.OpenChannel(channelType, data)
 	if err != nil {
@@ -136,34 +245,12 @@ func (s *ClientSSHSession) OpenChannel(ctx context.Context, channelType string,
 }
 
 func (s *ClientSSHSession) forwardPort(ctx context.Context, port uint16) error {
-	var listener net.Listener
-
-	var i uint16 = 0
-	for i < 10 {
-		portNum := port + i
-		innerListener, err := net.Listen("tcp", fmt.Sprintf(":%d", portNum))
-		if err == nil {
-			listener = innerListener
-			break
-		}
-		i++
+	listener, err := s.addListener(port)
+	if err != nil || listener == nil {
+		return err
 	}
-	if listener == nil {
-		innerListener, err := net.Listen("tcp", ":0")
-		if err != nil {
-			return fmt.Errorf("error creating listener: %w", err)
-		}
-		listener = innerListener
-	}
-	addressSlice := strings.Split(listener.Addr().String(), ":")
-	portNum, err := strconv.ParseUint(addressSlice[len(addressSlice)-1], 10, 16)
-	if err != nil {
-		return fmt.Errorf("error getting port number: %w", err)
-	}
-	if portNum > 0 && portNum <= math.MaxUint16 {
-		s.forwardedPorts[port] = uint16(portNum)
-	} else {
-		return fmt.Errorf("port number %d is out of bounds", portNum)
+	if s.onLocalListener != nil {
+		s.onLocalListener(port, listener.Addr())
 	}
 
 	errc := make(chan error, 1)
@@ -175,7 +262,7 @@ func (s *ClientSSHSession) forwardPort(ctx context.Context, port uint16) error {
 		default:
 		}
 	}
-	fmt.Printf("Client connected at %v to host port %v\n", listener.Addr(), port)
+	s.logger.Printf("Client connected at %v to host port %v", listener.Addr(), port)
 
 	go func() {
 		for {
@@ -184,9 +271,6 @@ func (s *ClientSSHSession) forwardPort(ctx context.Context, port uint16) error {
 				sendError(err)
 				return
 			}
-			s.listenersMu.Lock()
-			s.listeners = append(s.listeners, listener)
-			s.listenersMu.Unlock()
 
 			go func() {
 				if err := s.handleConnection(ctx, conn, port); err != nil {
@@ -199,6 +283,141 @@ func (s *ClientSSHSession) forwardPort(ctx context.Context, port uint16) error {
 	return awaitError(ctx, errc)
 }
 
+// addListener listens for connections to the forwarded host port and registers the
+// listener, so that it is closed with the session or when forwarding of the port is
+// canceled. It returns a nil listener if the port is already forwarded.
+func (s *ClientSSHSession) addListener(port uint16) (net.Listener, error) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("session is closed")
+	}
+	if _, ok := s.listeners[port]; ok {
+		return nil, nil
+	}
+
+	listener, portNum, err := s.listenForForwardedPort(port)
+	if err != nil {
+		return nil, err
+	}
+	s.listeners[port] = listener
+	s.forwardedPortsMu.Lock()
+	s.forwardedPorts[port] = portNum
+	s.forwardedPortsMu.Unlock()
+	return listener, nil
+}
+
+// removeListener closes the listener for the forwarded host port, if there is one.
+func (s *ClientSSHSession) removeListener(port uint16) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if listener, ok := s.listeners[port]; ok {
+		listener.Close()
+		delete(s.listeners, port)
+	}
+	s.forwardedPortsMu.Lock()
+	delete(s.forwardedPorts, port)
+	s.forwardedPortsMu.Unlock()
+}
+
+// LocalForwardedPorts returns the local port the client listens on for each forwarded
+// host port.
+func (s *ClientSSHSession) LocalForwardedPorts() map[uint16]uint16 {
+	s.forwardedPortsMu.Lock()
+	defer s.forwardedPortsMu.Unlock()
+	ports := make(map[uint16]uint16, len(s.forwardedPorts))
+	for remotePort, localPort := range s.forwardedPorts {
+		ports[remotePort] = localPort
+	}
+	return ports
+}
+
+// LocalForwardedPort returns the local port the client listens on for connections to
+// remotePort on the host, or false if the client is not listening for the port.
+func (s *ClientSSHSession) LocalForwardedPort(remotePort uint16) (uint16, bool) {
+	s.forwardedPortsMu.Lock()
+	defer s.forwardedPortsMu.Unlock()
+	localPort, ok := s.forwardedPorts[remotePort]
+	return localPort, ok
+}
+
+// listenForForwardedPort listens on the local bind address, on the local port mapped to
+// the forwarded host port if there is one. Otherwise it listens on the preferred local
+// port for the host port if it is available, or on the same local port number as the
+// host port, or the next available of the following 9 ports, or else an ephemeral port.
+// When the preferred port is in use, the local port that was used instead is logged.
+func (s *ClientSSHSession) listenForForwardedPort(port uint16) (net.Listener, uint16, error) {
+	if localPort, ok := s.localPorts[port]; ok {
+		listener, err := net.Listen("tcp", s.localAddress(localPort))
+		if err != nil {
+			return nil, 0, fmt.Errorf("error creating listener for local port %d: %w", localPort, err)
+		}
+		return listener, localPort, nil
+	}
+
+	var listener net.Listener
+	var preferredErr error
+	preferredPort := port
+	if localPort, ok := s.preferredLocalPorts[port]; ok && localPort != port {
+		preferredPort = localPort
+		innerListener, err := net.Listen("tcp", s.localAddress(localPort))
+		if err == nil {
+			listener = innerListener
+		} else {
+			preferredErr = err
+		}
+	}
+
+	var i uint16 = 0
+	for listener == nil && i < 10 {
+		portNum := port + i
+		innerListener, err := net.Listen("tcp", s.localAddress(portNum))
+		if err == nil {
+			listener = innerListener
+			break
+		}
+		if i == 0 && preferredErr == nil {
+			preferredErr = err
+		}
+		i++
+	}
+	if listener == nil {
+		innerListener, err := net.Listen("tcp", s.localAddress(0))
+		if err != nil {
+			return nil, 0, fmt.Errorf("error creating listener: %w", err)
+		}
+		listener = innerListener
+	}
+	addressSlice := strings.Split(listener.Addr().String(), ":")
+	portNum, err := strconv.ParseUint(addressSlice[len(addressSlice)-1], 10, 16)
+	if err != nil {
+		listener.Close()
+		return nil, 0, fmt.Errorf("error getting port number: %w", err)
+	}
+	if portNum == 0 || portNum > math.MaxUint16 {
+		listener.Close()
+		return nil, 0, fmt.Errorf("port number %d is out of bounds", portNum)
+	}
+
+	if errors.Is(preferredErr, syscall.EADDRINUSE) {
+		s.logger.Printf(
+			"Port %d is in use by another process, forwarding host port %d to local port %d instead",
+			preferredPort, port, portNum,
+		)
+	} else if preferredErr != nil {
+		s.logger.Printf(
+			"Failed to listen on port %d (%v), forwarding host port %d to local port %d instead",
+			preferredPort, preferredErr, port, portNum,
+		)
+	}
+	return listener, uint16(portNum), nil
+}
+
+// localAddress returns the address to listen on for local port number port.
+func (s *ClientSSHSession) localAddress(port uint16) string {
+	return net.JoinHostPort(s.localBindAddress, strconv.Itoa(int(port)))
+}
+
 func (s *ClientSSHSession) handleConnection(ctx context.Context, conn io.ReadWriteCloser, port uint16) (err error) {
 	defer safeClose(conn, &err)
 
@@ -219,7 +438,7 @@ func (s *ClientSSHSession) handleConnection(ctx context.Context, conn io.ReadWri
 
 	errs := make(chan error, 2)
 	copyConn := func(w io.Writer, r io.Reader) {
-		_, err := io.Copy(w, r)
+		_, err := s.copyBuffers.Copy(w, r)
 		errs <- err
 	}
 
@@ -266,7 +485,14 @@ func (s *ClientSSHSession) openStreamingChannel(ctx context.Context, port uint16
 	return channel, nil
 }
 
+// Wait blocks until the SSH connection is closed, by either side or because the
+// underlying connection failed, and returns the error that closed it.
+func (s *ClientSSHSession) Wait() error {
+	return s.conn.Wait()
+}
+
 func (s *ClientSSHSession) Close() error {
+	s.cancel()
 	if s.Session != nil {
 		s.Session.Close()
 	}
@@ -276,6 +502,9 @@ func (s *ClientSSHSession) Close() error {
 	if s.socket != nil {
 		s.socket.Close()
 	}
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.closed = true
 	for _, listener := range s.listeners {
 		listener.Close()
 	}
@@ -0,0 +1,66 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnelssh
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestListenForForwardedPortReportsPortInUse(t *testing.T) {
+	inUse, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inUse.Close()
+	port := uint16(inUse.Addr().(*net.TCPAddr).Port)
+
+	var logs bytes.Buffer
+	s := NewClientSSHSession(nil, nil, true, log.New(&logs, "", 0))
+	listener, localPort, err := s.listenForForwardedPort(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if localPort == port {
+		t.Fatalf("expected a different local port than the port in use %d", port)
+	}
+	expected := fmt.Sprintf("Port %d is in use by another process", port)
+	if !strings.Contains(logs.String(), expected) {
+		t.Errorf("expected log to contain %q, got %q", expected, logs.String())
+	}
+	expected = fmt.Sprintf("to local port %d instead", localPort)
+	if !strings.Contains(logs.String(), expected) {
+		t.Errorf("expected log to contain %q, got %q", expected, logs.String())
+	}
+}
+
+func TestListenForForwardedPortUsesPreferredPort(t *testing.T) {
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(free.Addr().(*net.TCPAddr).Port)
+	free.Close()
+
+	var logs bytes.Buffer
+	s := NewClientSSHSession(nil, nil, true, log.New(&logs, "", 0))
+	listener, localPort, err := s.listenForForwardedPort(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if localPort != port {
+		t.Errorf("expected local port %d, got %d", port, localPort)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("expected no fallback to be reported, got %q", logs.String())
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnelssh
+
+import (
+	"io"
+	"sync"
+)
+
+// CopyBufferPool reuses fixed-size buffers for copying data between forwarded connections
+// and their channels, which bounds the memory used by many concurrent streams.
+// A nil *CopyBufferPool copies with io.Copy, which allocates a buffer for each copy.
+type CopyBufferPool struct {
+	pool sync.Pool
+}
+
+// NewCopyBufferPool returns a pool of buffers of size bytes.
+func NewCopyBufferPool(size int) *CopyBufferPool {
+	return &CopyBufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		},
+	}
+}
+
+// Copy copies from src to dst until EOF or an error, as io.Copy does,
+// using a buffer from the pool.
+func (p *CopyBufferPool) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	if p == nil {
+		return io.Copy(dst, src)
+	}
+	b := p.pool.Get().(*[]byte)
+	defer p.pool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
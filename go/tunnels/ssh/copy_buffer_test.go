@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnelssh
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// writerOnly hides any ReadFrom method, so that copies use the buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+func TestCopyBufferPoolCopiesLargePayload(t *testing.T) {
+	payload := make([]byte, 5*1024*1024+123)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	pool := NewCopyBufferPool(32 * 1024)
+	for i := 0; i < 2; i++ {
+		var dst bytes.Buffer
+		// HalfReader returns short reads, like a network connection.
+		n, err := pool.Copy(writerOnly{&dst}, iotest.HalfReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(payload)) || !bytes.Equal(dst.Bytes(), payload) {
+			t.Fatalf("copied %d bytes that do not match the %d byte payload", n, len(payload))
+		}
+	}
+}
+
+func TestNilCopyBufferPoolCopies(t *testing.T) {
+	var pool *CopyBufferPool
+	var dst bytes.Buffer
+	if _, err := pool.Copy(&dst, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != "data" {
+		t.Errorf("unexpected copied data %q", dst.String())
+	}
+}
+
+func benchmarkConcurrentCopies(b *testing.B, pool *CopyBufferPool) {
+	const streams = 100
+	payload := make([]byte, 64*1024)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for s := 0; s < streams; s++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pool.Copy(writerOnly{io.Discard}, iotest.HalfReader(bytes.NewReader(payload)))
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkConcurrentCopiesWithoutPool(b *testing.B) {
+	benchmarkConcurrentCopies(b, nil)
+}
+
+func BenchmarkConcurrentCopiesWithPool(b *testing.B) {
+	benchmarkConcurrentCopies(b, NewCopyBufferPool(32*1024))
+}
@@ -21,10 +21,11 @@ type localPortForwarder struct {
 	channelType string
 	localIP     string
 	localPort   int
+	copyBuffers *CopyBufferPool
 }
 
 func newLocalPortForwarder(co channelOpener, channelType string, localIP string, localPort int) *localPortForwarder {
-	return &localPortForwarder{co, channelType, localIP, localPort}
+	return &localPortForwarder{co: co, channelType: channelType, localIP: localIP, localPort: localPort}
 }
 
 func (l *localPortForwarder) startForwarding(ctx context.Context) (err error) {
@@ -124,7 +125,7 @@ func (l *localPortForwarder) handleConnection(ctx context.Context, conn net.Conn
 
 	errs := make(chan error, 2)
 	copyConn := func(w io.Writer, r io.Reader) {
-		_, err := io.Copy(w, r)
+		_, err := l.copyBuffers.Copy(w, r)
 		errs <- err
 	}
 
@@ -10,7 +10,9 @@ import (
 )
 
 const (
-	PortForwardRequestType = "tcpip-forward"
+	PortForwardRequestType       = "tcpip-forward"
+	PortForwardCancelRequestType = "cancel-tcpip-forward"
+	RefreshPortsRequestType      = "RefreshPorts"
 )
 
 type PortForwardRequest struct {
@@ -7,7 +7,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
@@ -147,6 +146,11 @@ func (s *Session) handleRequests(ctx context.Context, reqs <-chan SSHRequest) {
 	}
 }
 
+// Logger logs failures of an SSH session. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // TODO(josebalius): Deprecate SSHSession struct.
 type SSHSession struct {
 	*ssh.Session
@@ -154,7 +158,7 @@ type SSHSession struct {
 	conn   ssh.Conn
 	reader io.Reader
 	writer io.Writer
-	logger *log.Logger
+	logger Logger
 }
 
 func (s *SSHSession) Read(p []byte) (n int, err error) {
@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MaxResolveSubjects is the number of names ResolveSubjects resolves in one call. The
+// tunnel contracts do not define this limit; it keeps each request to a size the service
+// accepts.
+const MaxResolveSubjects = 100
+
+var (
+	// ErrSubjectNotFound is the error of a ResolvedSubject whose name did not match any
+	// subject of the identity provider.
+	ErrSubjectNotFound = errors.New("subject not found")
+
+	// ErrAmbiguousSubject is the error of a ResolvedSubject whose partial name matched more
+	// than one subject. The candidates are in the Matches of the subject.
+	ErrAmbiguousSubject = errors.New("subject name matches more than one subject")
+)
+
+// ResolvedSubject is the result of resolving one subject name with ResolveSubjects.
+type ResolvedSubject struct {
+	// Name is the name that was resolved.
+	Name string
+
+	// Subject is the subject returned by the service, with its ID and full name if the
+	// name was resolved, or the possible matches if it was ambiguous. It is nil if the
+	// name was not sent to the service.
+	Subject *TunnelAccessSubject
+
+	// Err is the reason the name was not resolved to a single subject ID, or nil.
+	Err error
+}
+
+// ID returns the resolved subject ID, or an empty string if the name was not resolved.
+func (r *ResolvedSubject) ID() string {
+	if r.Err != nil || r.Subject == nil {
+		return ""
+	}
+	return r.Subject.ID
+}
+
+// Resolves subject names, such as GitHub usernames or AAD UPNs, to the subject IDs used
+// in the subjects of a TunnelAccessControlEntry. Names are resolved by the identity
+// provider the caller is authenticated with.
+// Returns a result for each name in the same order. A name that is invalid, not found or
+// ambiguous has an error in its result without failing the others. Returns an error if
+// there are more than MaxResolveSubjects names or the request fails.
+func (m *Manager) ResolveSubjects(
+	ctx context.Context, names []string, options *TunnelRequestOptions,
+) ([]ResolvedSubject, error) {
+	if len(names) > MaxResolveSubjects {
+		return nil, fmt.Errorf("cannot resolve %d subjects, more than the limit of %d",
+			len(names), MaxResolveSubjects)
+	}
+	if options == nil {
+		options = &TunnelRequestOptions{}
+	}
+
+	results := make([]ResolvedSubject, len(names))
+	var requestSubjects []TunnelAccessSubject
+	var requestIndexes []int
+	for i, name := range names {
+		results[i].Name = name
+		if strings.TrimSpace(name) == "" {
+			results[i].Err = fmt.Errorf("subject name must not be empty")
+			continue
+		}
+		requestSubjects = append(requestSubjects, TunnelAccessSubject{
+			Type: TunnelAccessControlEntryTypeNone,
+			Name: name,
+		})
+		requestIndexes = append(requestIndexes, i)
+	}
+	if len(requestSubjects) == 0 {
+		return results, nil
+	}
+
+	uri := m.buildUri("", subjectsApiPath+"/resolve", options, "")
+	response, err := m.sendTunnelRequest(ctx, nil, options, http.MethodPost, uri, requestSubjects, nil, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("error sending resolve subjects request: %w", err)
+	}
+
+	var resolved []TunnelAccessSubject
+	if err := json.Unmarshal(response, &resolved); err != nil {
+		return nil, fmt.Errorf("error parsing response json to subjects: %w", err)
+	}
+	if len(resolved) != len(requestSubjects) {
+		return nil, fmt.Errorf("resolved %d subjects, expected %d", len(resolved), len(requestSubjects))
+	}
+
+	for j, i := range requestIndexes {
+		subject := resolved[j]
+		results[i].Subject = &subject
+		switch {
+		case subject.ID != "":
+		case len(subject.Matches) > 0:
+			results[i].Err = fmt.Errorf("%w: %q matches %d subjects", ErrAmbiguousSubject, names[i], len(subject.Matches))
+		default:
+			results[i].Err = fmt.Errorf("%w: %q", ErrSubjectNotFound, names[i])
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestResolveSubjects(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != subjectsApiPath+"/resolve" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if _, ok := r.URL.Query()["provider"]; ok {
+			t.Errorf("expected no provider parameter, got %q", r.URL.RawQuery)
+		}
+		var subjects []TunnelAccessSubject
+		if err := json.NewDecoder(r.Body).Decode(&subjects); err != nil {
+			t.Fatal(err)
+		}
+		if len(subjects) != 3 {
+			t.Fatalf("expected the 3 valid names to be sent, got %v", subjects)
+		}
+		writeJSON(w, []TunnelAccessSubject{
+			{Name: "octocat", ID: "583231"},
+			{Name: "octo"},
+			{Name: "oct", Matches: []TunnelAccessSubject{{Name: "octocat"}, {Name: "octodog"}}},
+		})
+	})
+	defer done()
+
+	names := []string{"octocat", " ", "octo", "oct"}
+	results, err := managementClient.ResolveSubjects(ctx, names, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(names) {
+		t.Fatalf("expected a result per name, got %d", len(results))
+	}
+	if results[0].Err != nil || results[0].ID() != "583231" {
+		t.Errorf("expected octocat to be resolved, got %v %q", results[0].Err, results[0].ID())
+	}
+	if results[1].Err == nil || results[1].Subject != nil {
+		t.Errorf("expected the invalid name to fail without a request, got %+v", results[1])
+	}
+	if !errors.Is(results[2].Err, ErrSubjectNotFound) {
+		t.Errorf("expected ErrSubjectNotFound, got %v", results[2].Err)
+	}
+	if !errors.Is(results[3].Err, ErrAmbiguousSubject) || len(results[3].Subject.Matches) != 2 {
+		t.Errorf("expected ErrAmbiguousSubject with the matches, got %v", results[3].Err)
+	}
+}
+
+func TestResolveSubjectsRejectsTooManyNames(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	})
+	defer done()
+
+	names := make([]string, MaxResolveSubjects+1)
+	for i := range names {
+		names[i] = "user"
+	}
+	if _, err := managementClient.ResolveSubjects(ctx, names, nil); err == nil {
+		t.Error("expected an error for too many names")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MaxTags is the number of tags SetTags and ApplyTags allow on a tunnel or port. The
+// tunnel contracts do not define this limit; it keeps tag lists to a size the service
+// accepts.
+const MaxTags = 100
+
+// applyTagsConcurrency is the number of tunnels ApplyTags updates at the same time.
+const applyTagsConcurrency = 8
+
+// NormalizeTags trims spaces from each tag, lowercases the tags if lowercase is true,
+// and removes empty and duplicate tags, keeping the first occurrence of each.
+// Tags that differ only in case are duplicates only when lowercase is true.
+func NormalizeTags(tags []string, lowercase bool) []string {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if lowercase {
+			tag = strings.ToLower(tag)
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// SetTags sets the tags of the tunnel, removing exact duplicates. Use NormalizeTags
+// first to also ignore surrounding spaces and case.
+// Returns an error if a tag is not valid or there are more than MaxTags.
+func (t *Tunnel) SetTags(tags []string) error {
+	tags, err := uniqueValidTags(tags)
+	if err != nil {
+		return err
+	}
+	t.Tags = tags
+	return nil
+}
+
+// SetTags sets the tags of the port, removing exact duplicates. Use NormalizeTags
+// first to also ignore surrounding spaces and case.
+// Returns an error if a tag is not valid or there are more than MaxTags.
+func (tp *TunnelPort) SetTags(tags []string) error {
+	tags, err := uniqueValidTags(tags)
+	if err != nil {
+		return err
+	}
+	tp.Tags = tags
+	return nil
+}
+
+func uniqueValidTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	unique := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !isValidTag(tag) {
+			return nil, fmt.Errorf("invalid tag: %q", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+	if len(unique) > MaxTags {
+		return nil, fmt.Errorf("%d tags is more than the limit of %d", len(unique), MaxTags)
+	}
+	return unique, nil
+}
+
+// ApplyTags adds and removes tags on each of the tunnels, sending partial updates of only
+// the tags for several tunnels at a time. Tunnels whose tags would not change are not
+// updated. The tags of each tunnel that is updated successfully are set in place.
+// Returns the errors for tunnels that could not be updated, including tunnels that would
+// have more than MaxTags, or nil if all tunnels were updated.
+func (m *Manager) ApplyTags(
+	ctx context.Context, tunnels []*Tunnel, add []string, remove []string, options *TunnelRequestOptions,
+) map[*Tunnel]error {
+	var (
+		mu   sync.Mutex
+		errs map[*Tunnel]error
+		wg   sync.WaitGroup
+	)
+	setErr := func(tunnel *Tunnel, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errs == nil {
+			errs = make(map[*Tunnel]error)
+		}
+		errs[tunnel] = err
+	}
+
+	sem := make(chan struct{}, applyTagsConcurrency)
+	seen := make(map[*Tunnel]bool, len(tunnels))
+	for _, tunnel := range tunnels {
+		if tunnel == nil || seen[tunnel] {
+			continue
+		}
+		seen[tunnel] = true
+
+		tags, err := applyTags(tunnel.Tags, add, remove)
+		if err != nil {
+			setErr(tunnel, err)
+			continue
+		}
+		if equalTags(tags, tunnel.Tags) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(tunnel *Tunnel, tags []string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				setErr(tunnel, ctx.Err())
+				return
+			}
+
+			updated := *tunnel
+			updated.Tags = tags
+			if _, err := m.UpdateTunnel(ctx, &updated, []string{"Tags"}, options); err != nil {
+				setErr(tunnel, err)
+				return
+			}
+			tunnel.Tags = tags
+		}(tunnel, tags)
+	}
+	wg.Wait()
+	return errs
+}
+
+// applyTags returns the tags with the added tags appended and the removed tags left out.
+func applyTags(tags []string, add []string, remove []string) ([]string, error) {
+	removed := make(map[string]bool, len(remove))
+	for _, tag := range remove {
+		removed[tag] = true
+	}
+	result := make([]string, 0, len(tags)+len(add))
+	for _, tag := range tags {
+		if !removed[tag] {
+			result = append(result, tag)
+		}
+	}
+	for _, tag := range add {
+		if !removed[tag] {
+			result = append(result, tag)
+		}
+	}
+	return uniqueValidTags(result)
+}
+
+func equalTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
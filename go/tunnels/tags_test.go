@@ -0,0 +1,109 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags := []string{"Web", "web", "web ", " ", "api"}
+
+	if normalized := NormalizeTags(tags, true); !reflect.DeepEqual(normalized, []string{"web", "api"}) {
+		t.Errorf("unexpected lowercase normalized tags %q", normalized)
+	}
+	if normalized := NormalizeTags(tags, false); !reflect.DeepEqual(normalized, []string{"Web", "web", "api"}) {
+		t.Errorf("unexpected normalized tags %q", normalized)
+	}
+}
+
+func TestSetTagsRemovesDuplicates(t *testing.T) {
+	tunnel := &Tunnel{}
+	if err := tunnel.SetTags([]string{"Web", "web", "Web"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tunnel.Tags, []string{"Web", "web"}) {
+		t.Errorf("expected exact values without duplicates, got %q", tunnel.Tags)
+	}
+}
+
+func TestSetTagsRejectsInvalidTag(t *testing.T) {
+	port := &TunnelPort{Tags: []string{"existing"}}
+	if err := port.SetTags([]string{"valid", "not valid"}); err == nil {
+		t.Error("expected an error for a tag with a space")
+	}
+	if !reflect.DeepEqual(port.Tags, []string{"existing"}) {
+		t.Errorf("expected tags to be unchanged after an error, got %q", port.Tags)
+	}
+}
+
+func TestSetTagsEnforcesMaxTags(t *testing.T) {
+	var tags []string
+	for i := 0; i <= MaxTags; i++ {
+		tags = append(tags, fmt.Sprintf("tag%d", i))
+	}
+
+	tunnel := &Tunnel{}
+	if err := tunnel.SetTags(tags); err == nil {
+		t.Errorf("expected an error for %d tags", len(tags))
+	}
+	if err := tunnel.SetTags(tags[:MaxTags]); err != nil {
+		t.Errorf("expected %d tags to be allowed, got %v", MaxTags, err)
+	}
+}
+
+func TestApplyTags(t *testing.T) {
+	var mu sync.Mutex
+	updates := map[string][]string{}
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string][]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if _, ok := body["tags"]; !ok || len(body) != 1 {
+			t.Errorf("expected only the tags to be updated, got %v", body)
+		}
+		tunnelID := strings.TrimPrefix(r.URL.Path, "/api/v1/tunnels/")
+		mu.Lock()
+		updates[tunnelID] = body["tags"]
+		mu.Unlock()
+		writeJSON(w, Tunnel{TunnelID: tunnelID, Tags: body["tags"]})
+	})
+	defer done()
+
+	full := make([]string, MaxTags)
+	for i := range full {
+		full[i] = fmt.Sprintf("tag%d", i)
+	}
+	tunnels := []*Tunnel{
+		{ClusterID: "usw2", TunnelID: "ci1", Tags: []string{"ci", "old"}},
+		{ClusterID: "usw2", TunnelID: "ci2", Tags: []string{"ci"}},
+		{ClusterID: "usw2", TunnelID: "done", Tags: []string{"ci", "cleanup"}},
+		{ClusterID: "usw2", TunnelID: "bad", Tags: []string{"ci", "bad tag"}},
+		{ClusterID: "usw2", TunnelID: "full", Tags: full},
+	}
+	errs := managementClient.ApplyTags(ctx, tunnels, []string{"cleanup"}, []string{"old"}, &TunnelRequestOptions{})
+
+	if len(errs) != 2 || errs[tunnels[3]] == nil || errs[tunnels[4]] == nil {
+		t.Errorf("expected only the tunnels with an invalid tag or too many tags to fail, got %v", errs)
+	}
+	expected := map[string][]string{
+		"ci1": {"ci", "cleanup"},
+		"ci2": {"ci", "cleanup"},
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("expected updates %v, got %v", expected, updates)
+	}
+	for _, tunnel := range tunnels[:3] {
+		if !reflect.DeepEqual(tunnel.Tags, []string{"ci", "cleanup"}) {
+			t.Errorf("expected tags of %s to be updated in place, got %v", tunnel.TunnelID, tunnel.Tags)
+		}
+	}
+}
@@ -6,10 +6,15 @@ package tunnelstest
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/microsoft/dev-tunnels/go/tunnels/ssh/messages"
@@ -36,10 +41,22 @@ type RelayServer struct {
 	httpServer  *httptest.Server
 	errc        chan error
 	sshConfig   *ssh.ServerConfig
+	hostKeys    []ssh.PublicKey
 	channels    map[string]channelHandler
 	accessToken string
+	anonymous   bool
 
-	serverConn *ssh.ServerConn
+	failedHandshakesMu sync.Mutex
+	failedHandshakes   int
+	rejectStatusCodes  []int
+
+	portsMu          sync.Mutex
+	ports            map[uint16]bool
+	refreshedPorts   []uint16
+	forwardOnConnect bool
+
+	serverConnMu sync.Mutex
+	serverConn   *ssh.ServerConn
 }
 
 type RelayServerOption func(*RelayServer)
@@ -47,7 +64,8 @@ type channelHandler func(context.Context, ssh.NewChannel) error
 
 func NewRelayServer(opts ...RelayServerOption) (*RelayServer, error) {
 	server := &RelayServer{
-		errc: make(chan error),
+		errc:  make(chan error),
+		ports: make(map[uint16]bool),
 		sshConfig: &ssh.ServerConfig{
 			NoClientAuth: true,
 		},
@@ -58,6 +76,7 @@ func NewRelayServer(opts ...RelayServerOption) (*RelayServer, error) {
 		return nil, fmt.Errorf("error parsing private key: %w", err)
 	}
 	server.sshConfig.AddHostKey(privateKey)
+	server.hostKeys = []ssh.PublicKey{privateKey.PublicKey()}
 
 	server.httpServer = httptest.NewServer(http.HandlerFunc(makeConnection(server)))
 
@@ -99,7 +118,131 @@ func WithForwardedStream(pfc *messages.PortForwardChannel, port uint16, data *by
 	}
 }
 
+// WithEchoStreams makes the relay server accept any number of concurrent port
+// forward channels, writing back all data that is received on each channel.
+func WithEchoStreams() RelayServerOption {
+	return func(server *RelayServer) {
+		if server.channels == nil {
+			server.channels = make(map[string]channelHandler)
+		}
+
+		server.channels[messages.PortForwardChannelType] = func(ctx context.Context, ch ssh.NewChannel) error {
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				return fmt.Errorf("error accepting channel: %w", err)
+			}
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				defer channel.Close()
+				io.Copy(channel, channel)
+			}()
+			return nil
+		}
+	}
+}
+
+// WithReplyOnEOFStreams makes the relay server accept any number of concurrent port
+// forward channels, reading each until EOF and then writing back the data that was
+// received followed by reply, as a server that only responds to a complete request does.
+func WithReplyOnEOFStreams(reply []byte) RelayServerOption {
+	return func(server *RelayServer) {
+		if server.channels == nil {
+			server.channels = make(map[string]channelHandler)
+		}
+
+		server.channels[messages.PortForwardChannelType] = func(ctx context.Context, ch ssh.NewChannel) error {
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				return fmt.Errorf("error accepting channel: %w", err)
+			}
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				defer channel.Close()
+				request, err := io.ReadAll(channel)
+				if err != nil {
+					return
+				}
+				channel.Write(append(request, reply...))
+			}()
+			return nil
+		}
+	}
+}
+
+// WithTLSEchoStreams makes the relay server accept any number of concurrent port
+// forward channels, terminating TLS on each with config and writing back all data
+// that is received.
+func WithTLSEchoStreams(config *tls.Config) RelayServerOption {
+	return func(server *RelayServer) {
+		if server.channels == nil {
+			server.channels = make(map[string]channelHandler)
+		}
+
+		server.channels[messages.PortForwardChannelType] = func(ctx context.Context, ch ssh.NewChannel) error {
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				return fmt.Errorf("error accepting channel: %w", err)
+			}
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				conn := tls.Server(&channelConn{Channel: channel}, config)
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+			return nil
+		}
+	}
+}
+
+// channelConn adapts an SSH channel to net.Conn so that TLS can run over it.
+type channelConn struct {
+	ssh.Channel
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *channelConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// WithRejectedChannels makes the relay server reject every port forward channel
+// with the given reason and message.
+func WithRejectedChannels(reason ssh.RejectionReason, message string) RelayServerOption {
+	return func(server *RelayServer) {
+		if server.channels == nil {
+			server.channels = make(map[string]channelHandler)
+		}
+
+		server.channels[messages.PortForwardChannelType] = func(ctx context.Context, ch ssh.NewChannel) error {
+			return ch.Reject(reason, message)
+		}
+	}
+}
+
+// lockedReadWriter serializes reads and writes of a stream that is copied to and from
+// a channel at the same time, such as a bytes.Buffer.
+type lockedReadWriter struct {
+	mu     sync.Mutex
+	stream io.ReadWriter
+}
+
+func (rw *lockedReadWriter) Read(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.stream.Read(p)
+}
+
+func (rw *lockedReadWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.stream.Write(p)
+}
+
 func forwardStream(ctx context.Context, stream io.ReadWriter, channel ssh.Channel) (err error) {
+	stream = &lockedReadWriter{stream: stream}
 	defer func() {
 		if closeErr := channel.Close(); err == nil && closeErr != io.EOF {
 			err = closeErr
@@ -124,14 +267,118 @@ func WithAccessToken(accessToken string) func(*RelayServer) {
 	}
 }
 
+// WithAnonymousAccess makes the relay server reject connections that send an
+// Authorization header, like a relay for a tunnel that allows anonymous connections
+// would accept connections without one.
+func WithAnonymousAccess() RelayServerOption {
+	return func(server *RelayServer) {
+		server.anonymous = true
+	}
+}
+
+// WithFailedHandshakes makes the relay server close the first count websocket
+// connections before the SSH handshake completes.
+func WithFailedHandshakes(count int) RelayServerOption {
+	return func(server *RelayServer) {
+		server.failedHandshakes = count
+	}
+}
+
+func (rs *RelayServer) failHandshake() bool {
+	rs.failedHandshakesMu.Lock()
+	defer rs.failedHandshakesMu.Unlock()
+
+	if rs.failedHandshakes > 0 {
+		rs.failedHandshakes--
+		return true
+	}
+	return false
+}
+
+// WithRejectedConnections makes the relay server reject the first websocket upgrade
+// requests with the given HTTP status codes, one status code per request.
+func WithRejectedConnections(statusCodes ...int) RelayServerOption {
+	return func(server *RelayServer) {
+		server.rejectStatusCodes = statusCodes
+	}
+}
+
+func (rs *RelayServer) rejectConnection() (int, bool) {
+	rs.failedHandshakesMu.Lock()
+	defer rs.failedHandshakesMu.Unlock()
+
+	if len(rs.rejectStatusCodes) > 0 {
+		statusCode := rs.rejectStatusCodes[0]
+		rs.rejectStatusCodes = rs.rejectStatusCodes[1:]
+		return statusCode, true
+	}
+	return 0, false
+}
+
+// WithHostSigner makes the relay server authenticate with signer as its only host key,
+// for example a signer for an SSH host certificate.
+func WithHostSigner(signer ssh.Signer) RelayServerOption {
+	return func(server *RelayServer) {
+		server.sshConfig = &ssh.ServerConfig{
+			NoClientAuth: true,
+		}
+		server.sshConfig.AddHostKey(signer)
+		server.hostKeys = []ssh.PublicKey{signer.PublicKey()}
+	}
+}
+
+// WithRefreshedPorts makes the relay server respond to RefreshPorts requests by
+// forwarding exactly the given ports: ports that are not yet forwarded are forwarded,
+// and forwarding of any other port is canceled.
+func WithRefreshedPorts(ports ...uint16) RelayServerOption {
+	return func(server *RelayServer) {
+		server.refreshedPorts = ports
+	}
+}
+
+// WithPortsForwardedOnConnect makes the relay server forward the ports it has forwarded
+// before to each new connection, as a host does when a client connects.
+func WithPortsForwardedOnConnect() RelayServerOption {
+	return func(server *RelayServer) {
+		server.forwardOnConnect = true
+	}
+}
+
 func (rs *RelayServer) URL() string {
 	return rs.httpServer.URL
 }
 
+// HostPublicKeys returns the public keys of the relay server's host keys, base64-encoded
+// as a tunnel endpoint publishes them, so that clients can verify the host.
+func (rs *RelayServer) HostPublicKeys() []string {
+	keys := make([]string, len(rs.hostKeys))
+	for i, key := range rs.hostKeys {
+		keys[i] = base64.StdEncoding.EncodeToString(key.Marshal())
+	}
+	return keys
+}
+
 func (rs *RelayServer) Err() <-chan error {
 	return rs.errc
 }
 
+// DropConnection closes the current connection to the client, as if the relay dropped it.
+// The relay server keeps accepting new connections.
+func (rs *RelayServer) DropConnection() error {
+	return rs.conn().Close()
+}
+
+// Close stops the relay server from accepting connections.
+func (rs *RelayServer) Close() {
+	rs.httpServer.Close()
+}
+
+func (rs *RelayServer) conn() *ssh.ServerConn {
+	rs.serverConnMu.Lock()
+	defer rs.serverConnMu.Unlock()
+	return rs.serverConn
+}
+
 func (rs *RelayServer) sendError(err error) {
 	select {
 	case rs.errc <- err:
@@ -147,7 +394,7 @@ func (rs *RelayServer) ForwardPort(ctx context.Context, port uint16) error {
 		return fmt.Errorf("error marshaling port forward request: %w", err)
 	}
 
-	replied, data, err := rs.serverConn.SendRequest(messages.PortForwardRequestType, true, b)
+	replied, data, err := rs.conn().SendRequest(messages.PortForwardRequestType, true, b)
 	if err != nil {
 		return fmt.Errorf("error sending port forward request: %w", err)
 	}
@@ -160,22 +407,107 @@ func (rs *RelayServer) ForwardPort(ctx context.Context, port uint16) error {
 		return fmt.Errorf("no data returned")
 	}
 
+	rs.portsMu.Lock()
+	rs.ports[port] = true
+	rs.portsMu.Unlock()
+	return nil
+}
+
+// CancelForwardPort cancels forwarding of the port to the client.
+func (rs *RelayServer) CancelForwardPort(ctx context.Context, port uint16) error {
+	pfr := messages.NewPortForwardRequest("127.0.0.1", uint32(port))
+	b, err := pfr.Marshal()
+	if err != nil {
+		return fmt.Errorf("error marshaling cancel port forward request: %w", err)
+	}
+
+	replied, _, err := rs.conn().SendRequest(messages.PortForwardCancelRequestType, true, b)
+	if err != nil {
+		return fmt.Errorf("error sending cancel port forward request: %w", err)
+	}
+
+	if !replied {
+		return fmt.Errorf("cancel port forward request not replied")
+	}
+
+	rs.portsMu.Lock()
+	delete(rs.ports, port)
+	rs.portsMu.Unlock()
 	return nil
 }
 
-var upgrader = websocket.Upgrader{}
+func (rs *RelayServer) handleRequests(ctx context.Context, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != messages.RefreshPortsRequestType || rs.refreshedPorts == nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		err := rs.refreshPorts(ctx)
+		if err != nil {
+			rs.sendError(fmt.Errorf("error refreshing ports: %w", err))
+		}
+		req.Reply(err == nil, nil)
+	}
+}
+
+func (rs *RelayServer) refreshPorts(ctx context.Context) error {
+	refreshed := make(map[uint16]bool)
+	for _, port := range rs.refreshedPorts {
+		refreshed[port] = true
+	}
+
+	rs.portsMu.Lock()
+	var added, removed []uint16
+	for _, port := range rs.refreshedPorts {
+		if !rs.ports[port] {
+			added = append(added, port)
+		}
+	}
+	for port := range rs.ports {
+		if !refreshed[port] {
+			removed = append(removed, port)
+		}
+	}
+	rs.portsMu.Unlock()
+
+	for _, port := range added {
+		if err := rs.ForwardPort(ctx, port); err != nil {
+			return err
+		}
+	}
+	for _, port := range removed {
+		if err := rs.CancelForwardPort(ctx, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var upgrader = websocket.Upgrader{Subprotocols: []string{"tunnel-relay-client"}}
 
 func makeConnection(server *RelayServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
+		if statusCode, ok := server.rejectConnection(); ok {
+			w.WriteHeader(statusCode)
+			return
+		}
+
 		if server.accessToken != "" {
 			if r.Header.Get("Authorization") != server.accessToken {
 				server.sendError(fmt.Errorf("invalid access token"))
 				return
 			}
 		}
+		if server.anonymous && r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -188,22 +520,52 @@ func makeConnection(server *RelayServer) http.HandlerFunc {
 			}
 		}()
 
-		socketConn := newSocketConn(c)
-		serverConn, chans, reqs, err := ssh.NewServerConn(socketConn, server.sshConfig)
-		if err != nil {
-			server.sendError(fmt.Errorf("error creating ssh server conn: %w", err))
+		if server.failHandshake() {
 			return
 		}
-		go ssh.DiscardRequests(reqs)
 
-		server.serverConn = serverConn
-		if err := handleChannels(ctx, server, chans); err != nil {
-			server.sendError(fmt.Errorf("error handling channels: %w", err))
+		if err := server.ServeConn(ctx, newSocketConn(c)); err != nil {
+			server.sendError(err)
 			return
 		}
 	}
 }
 
+// ServeConn acts as the host over conn, an already established connection to a client,
+// until ctx is canceled or the connection fails. This allows serving a client without a
+// websocket, for example over a loopback connection.
+func (rs *RelayServer) ServeConn(ctx context.Context, conn net.Conn) error {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, rs.sshConfig)
+	if err != nil {
+		return fmt.Errorf("error creating ssh server conn: %w", err)
+	}
+	rs.serverConnMu.Lock()
+	rs.serverConn = serverConn
+	rs.serverConnMu.Unlock()
+	go rs.handleRequests(ctx, reqs)
+
+	if rs.forwardOnConnect {
+		rs.portsMu.Lock()
+		ports := make([]uint16, 0, len(rs.ports))
+		for port := range rs.ports {
+			ports = append(ports, port)
+		}
+		rs.portsMu.Unlock()
+		go func() {
+			for _, port := range ports {
+				if err := rs.ForwardPort(ctx, port); err != nil {
+					rs.sendError(fmt.Errorf("error forwarding port %d on connect: %w", port, err))
+				}
+			}
+		}()
+	}
+
+	if err := handleChannels(ctx, rs, chans); err != nil {
+		return fmt.Errorf("error handling channels: %w", err)
+	}
+	return nil
+}
+
 func handleChannels(ctx context.Context, server *RelayServer, chans <-chan ssh.NewChannel) error {
 	errc := make(chan error, 1)
 	go func() {
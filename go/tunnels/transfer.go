@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTransferInterval = 1 * time.Second
+
+// TransferDirection is the direction of data on connections to a forwarded port.
+type TransferDirection int
+
+const (
+	// TransferDirectionSent is data sent from local connections to the forwarded port.
+	TransferDirectionSent TransferDirection = iota
+
+	// TransferDirectionReceived is data received from the forwarded port.
+	TransferDirectionReceived
+)
+
+// TransferObserver receives the cumulative bytes transferred in one direction over all
+// connections to a forwarded port since the client was created. It may be called
+// concurrently for connections to the same port.
+type TransferObserver func(port uint16, direction TransferDirection, bytes int64)
+
+// WithTransferObserver makes the client report the data transferred over connections to
+// each forwarded port to observer, every interval while a connection is open and once
+// more when it closes. An interval of zero reports every second.
+func WithTransferObserver(interval time.Duration, observer TransferObserver) ClientOption {
+	return func(c *Client) {
+		if interval <= 0 {
+			interval = defaultTransferInterval
+		}
+		c.transferObserver = observer
+		c.transferInterval = interval
+	}
+}
+
+// transferCounter holds the bytes transferred over connections to a port.
+type transferCounter struct {
+	sent     int64
+	received int64
+}
+
+// portTransfers holds the transfer counters of the forwarded ports.
+type portTransfers struct {
+	mu       sync.Mutex
+	counters map[uint16]*transferCounter
+}
+
+func (t *portTransfers) counter(port uint16) *transferCounter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counters == nil {
+		t.counters = make(map[uint16]*transferCounter)
+	}
+	counter, ok := t.counters[port]
+	if !ok {
+		counter = &transferCounter{}
+		t.counters[port] = counter
+	}
+	return counter
+}
+
+// reportTransfer reports the bytes transferred over connections to port to the observer.
+func (c *Client) reportTransfer(port uint16, counter *transferCounter) {
+	c.transferObserver(port, TransferDirectionSent, atomic.LoadInt64(&counter.sent))
+	c.transferObserver(port, TransferDirectionReceived, atomic.LoadInt64(&counter.received))
+}
+
+// countingWriter adds the bytes written through it to a counter.
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
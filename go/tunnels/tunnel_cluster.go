@@ -0,0 +1,116 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type tunnelClusterCache struct {
+	mu       sync.Mutex
+	clusters map[string]string
+}
+
+func (c *tunnelClusterCache) get(tunnelID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clusterID, ok := c.clusters[tunnelID]
+	return clusterID, ok
+}
+
+func (c *tunnelClusterCache) set(tunnelID, clusterID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clusters == nil {
+		c.clusters = make(map[string]string)
+	}
+	c.clusters[tunnelID] = clusterID
+}
+
+// ResolveTunnelCluster returns the ID of the home cluster of the tunnel with the given ID,
+// without fetching the tunnel. It sends a HEAD request for the tunnel to the manager's
+// service URI and takes the cluster from the host the service redirects to, or from the
+// service URI itself if that is already the tunnel's cluster.
+// Resolved clusters are cached, so later calls for the same tunnel do not send a request.
+func (m *Manager) ResolveTunnelCluster(ctx context.Context, tunnelID string, options *TunnelRequestOptions) (clusterID string, err error) {
+	if tunnelID == "" {
+		return "", fmt.Errorf("tunnel ID cannot be empty")
+	}
+	if clusterID, ok := m.tunnelClusters.get(tunnelID); ok {
+		return clusterID, nil
+	}
+
+	if options == nil {
+		options = &TunnelRequestOptions{}
+	}
+	uri := m.buildUri("", fmt.Sprintf("%s/%s", tunnelsApiPath, tunnelID), options, "")
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, uri.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating resolve tunnel cluster request: %w", err)
+	}
+	if token := m.getAccessToken(&Tunnel{TunnelID: tunnelID}, options, readAccessTokenScope); token != "" {
+		request.Header.Add("Authorization", token)
+	}
+	userAgent, err := m.userAgentHeader()
+	if err != nil {
+		return "", err
+	}
+	request.Header.Add("User-Agent", userAgent)
+	m.additionalHeaders.addTo(request.Header)
+	for header, headerValue := range options.AdditionalHeaders {
+		request.Header.Add(header, headerValue)
+	}
+
+	// Copy the client so that the redirect is returned instead of followed.
+	client := *m.httpClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	response, err := m.send(&client, request)
+	if err != nil {
+		return "", fmt.Errorf("error sending resolve tunnel cluster request: %w", err)
+	}
+	response.Body.Close()
+
+	var host string
+	switch {
+	case response.StatusCode >= 300 && response.StatusCode < 400:
+		location, err := response.Location()
+		if err != nil {
+			return "", fmt.Errorf("error reading resolve tunnel cluster redirect: %w", err)
+		}
+		host = location.Hostname()
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		host = uri.Hostname()
+	default:
+		return "", fmt.Errorf("error sending resolve tunnel cluster request: %w",
+			&TunnelServiceError{StatusCode: response.StatusCode})
+	}
+
+	clusterID = clusterFromHost(host)
+	if clusterID == "" {
+		return "", fmt.Errorf("unable to resolve cluster of tunnel %s from host %q", tunnelID, host)
+	}
+	m.tunnelClusters.set(tunnelID, clusterID)
+	return clusterID, nil
+}
+
+// clusterFromHost returns the cluster ID prefix of a cluster-specific service host name,
+// such as "usw2" for "usw2.rel.tunnels.api.visualstudio.com", or "" if the host is not
+// specific to a cluster.
+func clusterFromHost(host string) string {
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	labels := strings.SplitN(host, ".", 2)
+	if len(labels) < 2 || labels[0] == "global" || strings.HasPrefix(labels[0], "localhost") {
+		return ""
+	}
+	return labels[0]
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResolveTunnelClusterFromRedirect(t *testing.T) {
+	var requests int32
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method != http.MethodHead {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if r.URL.Path != "/api/v1/tunnels/abc123" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		http.Redirect(w, r, "https://usw2.rel.tunnels.api.visualstudio.com/api/v1/tunnels/abc123", http.StatusTemporaryRedirect)
+	})
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		clusterID, err := managementClient.ResolveTunnelCluster(ctx, "abc123", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clusterID != "usw2" {
+			t.Errorf("expected cluster usw2, got %q", clusterID)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the resolved cluster to be cached, got %d requests", n)
+	}
+}
+
+func TestResolveTunnelClusterNotFound(t *testing.T) {
+	managementClient, done := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer done()
+
+	if _, err := managementClient.ResolveTunnelCluster(ctx, "abc123", nil); err == nil {
+		t.Fatal("expected an error for an unknown tunnel")
+	}
+}
+
+func TestClusterFromHost(t *testing.T) {
+	tests := map[string]string{
+		"usw2.rel.tunnels.api.visualstudio.com":   "usw2",
+		"global.rel.tunnels.api.visualstudio.com": "",
+		"localhost": "",
+		"127.0.0.1": "",
+	}
+	for host, expected := range tests {
+		if clusterID := clusterFromHost(host); clusterID != expected {
+			t.Errorf("clusterFromHost(%q) = %q, expected %q", host, clusterID, expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+// MaxEndpointsPerHost is the number of endpoints a host may publish on a tunnel, after
+// which UpdateTunnelEndpoint refuses to add endpoints for the host. The tunnel contracts
+// do not define this limit; it guards against a misbehaving host flooding the tunnel.
+const MaxEndpointsPerHost = 10
+
+// TunnelHost describes one host that accepts connections to a tunnel,
+// derived from the endpoints the host published.
+type TunnelHost struct {
+	// HostID is the ID of the host.
+	HostID string
+
+	// ConnectionModes lists the connection modes the host accepts connections on,
+	// in the order its endpoints were published.
+	ConnectionModes []TunnelConnectionMode
+
+	// Endpoints are the endpoints published by the host.
+	Endpoints []TunnelEndpoint
+}
+
+// Hosts returns the hosts of the tunnel, grouped from the tunnel's endpoints.
+// Hosts are returned in the order their first endpoint appears in the tunnel.
+func (t *Tunnel) Hosts() []TunnelHost {
+	var hosts []TunnelHost
+	indexes := make(map[string]int)
+	for _, endpoint := range t.Endpoints {
+		i, ok := indexes[endpoint.HostID]
+		if !ok {
+			i = len(hosts)
+			indexes[endpoint.HostID] = i
+			hosts = append(hosts, TunnelHost{HostID: endpoint.HostID})
+		}
+		hosts[i].ConnectionModes = append(hosts[i].ConnectionModes, endpoint.ConnectionMode)
+		hosts[i].Endpoints = append(hosts[i].Endpoints, endpoint)
+	}
+	return hosts
+}
+
+// EndpointCountForHost returns the number of endpoints published by the host with hostID.
+func (t *Tunnel) EndpointCountForHost(hostID string) int {
+	count := 0
+	for _, endpoint := range t.Endpoints {
+		if endpoint.HostID == hostID {
+			count++
+		}
+	}
+	return count
+}
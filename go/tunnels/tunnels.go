@@ -5,13 +5,26 @@ package tunnels
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/rodaine/table"
 )
 
 const PackageVersion = "0.0.4"
 
+var (
+	// ErrGloballyAvailableRequiresName is returned when global availability is enabled
+	// for a tunnel that does not have a name.
+	ErrGloballyAvailableRequiresName = errors.New("a tunnel must have a name to be globally available")
+
+	// ErrNameRequiredWhenGloballyAvailable is returned when the name of a globally
+	// available tunnel is cleared.
+	ErrNameRequiredWhenGloballyAvailable = errors.New("the name of a globally available tunnel cannot be cleared")
+)
+
 func (tunnel *Tunnel) requestObject() (*Tunnel, error) {
 	convertedTunnel := &Tunnel{
 		Name:        tunnel.Name,
@@ -46,16 +59,50 @@ func (tunnel *Tunnel) requestObject() (*Tunnel, error) {
 	return convertedTunnel, nil
 }
 
+// SetName sets the short name (alias) of the tunnel.
+// Returns an error if the name is not valid, or if the name is cleared
+// while the tunnel is globally available.
+func (t *Tunnel) SetName(name string) error {
+	if name == "" {
+		if t.Options != nil && t.Options.IsGloballyAvailable {
+			return ErrNameRequiredWhenGloballyAvailable
+		}
+	} else if !isValidTunnelName(name) {
+		return fmt.Errorf("invalid tunnel name: %s", name)
+	}
+	t.Name = name
+	return nil
+}
+
+// SetGloballyAvailable sets whether web-forwarding of the tunnel can run on any
+// cluster without redirecting to the home cluster.
+// Global availability only applies to named tunnels, so the tunnel name must be
+// set before enabling it.
+func (t *Tunnel) SetGloballyAvailable(available bool) error {
+	if available && t.Name == "" {
+		return ErrGloballyAvailableRequiresName
+	}
+	if t.Options == nil {
+		if !available {
+			return nil
+		}
+		t.Options = &TunnelOptions{}
+	}
+	t.Options.IsGloballyAvailable = available
+	return nil
+}
+
+func isValidTunnelName(name string) bool {
+	return TunnelConstraintsTunnelNameRegex.FindString(name) == name &&
+		!(len(name) == TunnelConstraintsTunnelIDLength && TunnelConstraintsTunnelIDRegex.MatchString(name))
+}
+
 func (t *Tunnel) Table() table.Table {
 	tbl := table.New("Tunnel Properties", " ")
 
-	var accessTokens string
-	for scope := range t.AccessTokens {
-		if len(accessTokens) == 0 {
-			accessTokens += string(scope)
-		} else {
-			accessTokens += fmt.Sprintf(", %s", scope)
-		}
+	var accessTokens []string
+	for _, scope := range t.AvailableScopes() {
+		accessTokens = append(accessTokens, string(scope))
 	}
 
 	var ports string
@@ -75,22 +122,32 @@ func (t *Tunnel) Table() table.Table {
 		tbl.AddRow("Access Control", fmt.Sprintf("%v", *t.AccessControl))
 	}
 	tbl.AddRow("Ports", ports)
-	tbl.AddRow("Host Connections", t.Status.HostConnectionCount)
-	tbl.AddRow("Client Connections", t.Status.ClientConnectionCount)
-	tbl.AddRow("Available Scopes", accessTokens)
+	if t.Status != nil {
+		tbl.AddRow("Host Connections", t.Status.HostConnectionCount)
+		tbl.AddRow("Client Connections", t.Status.ClientConnectionCount)
+		if t.Status.ClientConnectionRate != nil {
+			tbl.AddRow("Client Connection Rate", t.Status.ClientConnectionRate)
+		}
+		if t.Status.DataTransferRate != nil {
+			tbl.AddRow("Data Transfer Rate", t.Status.DataTransferRate)
+		}
+		if t.Status.ApiReadRate != nil {
+			tbl.AddRow("API Read Rate", t.Status.ApiReadRate)
+		}
+		if t.Status.ApiUpdateRate != nil {
+			tbl.AddRow("API Update Rate", t.Status.ApiUpdateRate)
+		}
+	}
+	tbl.AddRow("Available Scopes", strings.Join(accessTokens, ", "))
 	return tbl
 }
 
 func (tp *TunnelPort) Table() table.Table {
 	tbl := table.New("TunnelPort Properties", " ")
 
-	var accessTokens string
-	for scope := range tp.AccessTokens {
-		if len(accessTokens) == 0 {
-			accessTokens += string(scope)
-		} else {
-			accessTokens += fmt.Sprintf(", %s", scope)
-		}
+	var accessTokens []string
+	for _, scope := range tp.AvailableScopes() {
+		accessTokens = append(accessTokens, string(scope))
 	}
 
 	tbl.AddRow("ClusterId", tp.ClusterID)
@@ -100,8 +157,17 @@ func (tp *TunnelPort) Table() table.Table {
 	if tp.AccessControl != nil {
 		tbl.AddRow("Access Control", fmt.Sprintf("%v", *tp.AccessControl))
 	}
-	tbl.AddRow("Client Connections", tp.Status.ClientConnectionCount)
-	tbl.AddRow("Last Connection Time", tp.Status.LastClientConnectionTime)
+	if tp.Status != nil {
+		tbl.AddRow("Client Connections", tp.Status.ClientConnectionCount)
+		tbl.AddRow("Last Connection Time", tp.Status.LastClientConnectionTime)
+		if tp.Status.ClientConnectionRate != nil {
+			tbl.AddRow("Client Connection Rate", tp.Status.ClientConnectionRate)
+		}
+		if tp.Status.HttpRequestRate != nil {
+			tbl.AddRow("HTTP Request Rate", tp.Status.HttpRequestRate)
+		}
+	}
+	tbl.AddRow("Available Scopes", strings.Join(accessTokens, ", "))
 	return tbl
 }
 
@@ -160,3 +226,73 @@ func (rs *ResourceStatus) UnmarshalJSON(data []byte) (err error) {
 	}
 	return err
 }
+
+func (rs *RateStatus) UnmarshalJSON(data []byte) (err error) {
+	// The current value and limit may be a simple number, like a ResourceStatus.
+	err = rs.ResourceStatus.UnmarshalJSON(data)
+	if err != nil {
+		return err
+	}
+
+	var period struct {
+		PeriodSeconds uint32 `json:"periodSeconds"`
+		ResetSeconds  uint32 `json:"resetSeconds"`
+	}
+	if json.Unmarshal(data, &period) == nil {
+		rs.PeriodSeconds = period.PeriodSeconds
+		rs.ResetSeconds = period.ResetSeconds
+	}
+	return nil
+}
+
+// PercentUsed returns the current value as a percentage of the limit.
+// Returns 0 if there is no limit.
+func (rs ResourceStatus) PercentUsed() float64 {
+	if rs.Limit == 0 {
+		return 0
+	}
+	return float64(rs.Current) / float64(rs.Limit) * 100
+}
+
+func (rs ResourceStatus) String() string {
+	if rs.Limit == 0 {
+		return fmt.Sprintf("%d", rs.Current)
+	}
+	return fmt.Sprintf("%d/%d (%.0f%%)", rs.Current, rs.Limit, rs.PercentUsed())
+}
+
+// Period returns the length of the period over which the rate is measured,
+// or 0 if the period is not known.
+func (rs RateStatus) Period() time.Duration {
+	return time.Duration(rs.PeriodSeconds) * time.Second
+}
+
+// ResetIn returns the time until the current measurement period ends and the rate resets,
+// or 0 if it is not known.
+func (rs RateStatus) ResetIn() time.Duration {
+	return time.Duration(rs.ResetSeconds) * time.Second
+}
+
+func (rs RateStatus) String() string {
+	s := rs.ResourceStatus.String()
+	if rs.PeriodSeconds > 0 {
+		s += fmt.Sprintf(" per %s", formatSeconds(rs.PeriodSeconds))
+	}
+	if rs.ResetSeconds > 0 {
+		s += fmt.Sprintf(", resets in %s", formatSeconds(rs.ResetSeconds))
+	}
+	return s
+}
+
+func formatSeconds(seconds uint32) string {
+	switch {
+	case seconds%86400 == 0:
+		return fmt.Sprintf("%dd", seconds/86400)
+	case seconds%3600 == 0:
+		return fmt.Sprintf("%dh", seconds/3600)
+	case seconds%60 == 0:
+		return fmt.Sprintf("%dm", seconds/60)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
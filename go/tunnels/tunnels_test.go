@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSetGloballyAvailableWithName(t *testing.T) {
+	tunnel := &Tunnel{}
+	if err := tunnel.SetName("my-tunnel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.SetGloballyAvailable(true); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Options == nil || !tunnel.Options.IsGloballyAvailable {
+		t.Errorf("tunnel options were not set to globally available")
+	}
+
+	converted, err := tunnel.requestObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted.Options == nil || !converted.Options.IsGloballyAvailable {
+		t.Errorf("request object did not carry the tunnel options")
+	}
+
+	if err := tunnel.SetGloballyAvailable(false); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Options.IsGloballyAvailable {
+		t.Errorf("tunnel options were not cleared")
+	}
+}
+
+func TestSetGloballyAvailableWithoutName(t *testing.T) {
+	tunnel := &Tunnel{}
+	if err := tunnel.SetGloballyAvailable(true); err != ErrGloballyAvailableRequiresName {
+		t.Errorf("expected ErrGloballyAvailableRequiresName, got %v", err)
+	}
+	if tunnel.Options != nil {
+		t.Errorf("tunnel options should not be set after a failed update")
+	}
+
+	if err := tunnel.SetGloballyAvailable(false); err != nil {
+		t.Errorf("disabling global availability should not require a name: %v", err)
+	}
+}
+
+func TestSetNameOnGloballyAvailableTunnel(t *testing.T) {
+	tunnel := &Tunnel{Name: "my-tunnel"}
+	if err := tunnel.SetGloballyAvailable(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.SetName(""); err != ErrNameRequiredWhenGloballyAvailable {
+		t.Errorf("expected ErrNameRequiredWhenGloballyAvailable, got %v", err)
+	}
+	if tunnel.Name != "my-tunnel" {
+		t.Errorf("tunnel name should not change after a failed update")
+	}
+	if err := tunnel.SetName("other-tunnel"); err != nil {
+		t.Errorf("renaming a globally available tunnel should succeed: %v", err)
+	}
+}
+
+func TestSetNameInvalid(t *testing.T) {
+	tunnel := &Tunnel{}
+	for _, name := range []string{"ab", "-tunnel", "tunnel-", "My_Tunnel", "bcdfghjk"} {
+		if err := tunnel.SetName(name); err == nil {
+			t.Errorf("expected error for invalid name %q", name)
+		}
+	}
+}
+
+func TestRateStatusUnmarshal(t *testing.T) {
+	var rate RateStatus
+	data := []byte(`{ "current": 30, "limit": 120, "periodSeconds": 60, "resetSeconds": 15 }`)
+	if err := json.Unmarshal(data, &rate); err != nil {
+		t.Fatal(err)
+	}
+	if rate.Current != 30 || rate.Limit != 120 || rate.PeriodSeconds != 60 || rate.ResetSeconds != 15 {
+		t.Errorf("unexpected rate status: %+v", rate)
+	}
+
+	var simpleRate RateStatus
+	if err := json.Unmarshal([]byte("7"), &simpleRate); err != nil {
+		t.Fatal(err)
+	}
+	if simpleRate.Current != 7 || simpleRate.PeriodSeconds != 0 {
+		t.Errorf("unexpected rate status: %+v", simpleRate)
+	}
+}
+
+func TestRateStatusPercentUsed(t *testing.T) {
+	rate := RateStatus{ResourceStatus: ResourceStatus{Current: 30, Limit: 120}}
+	if percent := rate.PercentUsed(); percent != 25 {
+		t.Errorf("expected 25 percent used, got %v", percent)
+	}
+
+	rate = RateStatus{ResourceStatus: ResourceStatus{Current: 30}}
+	if percent := rate.PercentUsed(); percent != 0 {
+		t.Errorf("expected 0 percent used without a limit, got %v", percent)
+	}
+}
+
+func TestRateStatusString(t *testing.T) {
+	tests := []struct {
+		rate     RateStatus
+		expected string
+	}{
+		{RateStatus{ResourceStatus: ResourceStatus{Current: 5}}, "5"},
+		{RateStatus{ResourceStatus: ResourceStatus{Current: 5, Limit: 20}}, "5/20 (25%)"},
+		{
+			RateStatus{ResourceStatus: ResourceStatus{Current: 5, Limit: 20}, PeriodSeconds: 60},
+			"5/20 (25%) per 1m",
+		},
+		{
+			RateStatus{ResourceStatus: ResourceStatus{Current: 5, Limit: 20}, PeriodSeconds: 3600, ResetSeconds: 90},
+			"5/20 (25%) per 1h, resets in 90s",
+		},
+	}
+	for _, test := range tests {
+		if s := test.rate.String(); s != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, s)
+		}
+	}
+}
+
+func TestTunnelTableIncludesRates(t *testing.T) {
+	tunnel := &Tunnel{
+		Status: &TunnelStatus{
+			DataTransferRate: &RateStatus{
+				ResourceStatus: ResourceStatus{Current: 10, Limit: 100},
+				PeriodSeconds:  86400,
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	tunnel.Table().WithWriter(&buf).Print()
+	if !strings.Contains(buf.String(), "10/100 (10%) per 1d") {
+		t.Errorf("table does not include the data transfer rate:\n%s", buf.String())
+	}
+}
+
+func TestAvailableScopesSplitsCombinedKeys(t *testing.T) {
+	tunnel := &Tunnel{
+		AccessTokens: map[TunnelAccessScope]string{
+			"host connect":          "host-connect-token",
+			TunnelAccessScopeManage: "manage-token",
+		},
+	}
+
+	scopes := tunnel.AvailableScopes()
+	expected := TunnelAccessScopes{TunnelAccessScopeConnect, TunnelAccessScopeHost, TunnelAccessScopeManage}
+	if len(scopes) != len(expected) {
+		t.Fatalf("expected scopes %v, got %v", expected, scopes)
+	}
+	for i := range expected {
+		if scopes[i] != expected[i] {
+			t.Errorf("expected scopes %v, got %v", expected, scopes)
+		}
+	}
+
+	if token, ok := tunnel.AccessToken(TunnelAccessScopeConnect); !ok || token != "host-connect-token" {
+		t.Errorf("expected the combined token for the connect scope, got %q", token)
+	}
+	if _, ok := tunnel.AccessToken(TunnelAccessScopeInspect); ok {
+		t.Errorf("expected no token for the inspect scope")
+	}
+
+	var buf bytes.Buffer
+	tunnel.Table().WithWriter(&buf).Print()
+	if !strings.Contains(buf.String(), "connect, host, manage") {
+		t.Errorf("table does not list each scope:\n%s", buf.String())
+	}
+}
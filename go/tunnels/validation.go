@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationErrors lists every problem found when validating a tunnel.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ValidateGraph validates a tunnel together with its ports before the tunnel is created.
+// It is the same as tunnel.Validate, except that a nil tunnel is reported as invalid.
+func ValidateGraph(tunnel *Tunnel) error {
+	if tunnel == nil {
+		return ValidationErrors{ErrNoTunnel}
+	}
+	return tunnel.Validate()
+}
+
+// Validate checks the tunnel against the constraints defined by the tunnel contracts:
+// the tunnel name, the tags and access control scopes of the tunnel, that port numbers
+// are set and unique, and each port as validated by TunnelPort.Validate. The service may
+// enforce other limits, such as the number of ports or tags, which are not checked.
+// Returns nil if the tunnel is valid, or ValidationErrors listing every problem found.
+func (t *Tunnel) Validate() error {
+	var errs ValidationErrors
+	if t.Name != "" && !isValidTunnelName(t.Name) {
+		errs = append(errs, fmt.Errorf("invalid tunnel name %q", t.Name))
+	}
+	errs = append(errs, validateTags("tunnel", t.Tags)...)
+	errs = append(errs, validateAccessControl("tunnel", t.AccessControl)...)
+
+	portNumbers := make(map[uint16]bool, len(t.Ports))
+	for i := range t.Ports {
+		port := &t.Ports[i]
+		if port.PortNumber != 0 && portNumbers[port.PortNumber] {
+			errs = append(errs, fmt.Errorf("duplicate port number %d", port.PortNumber))
+			continue
+		}
+		portNumbers[port.PortNumber] = true
+		errs = append(errs, port.validate()...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks the port against the constraints defined by the tunnel contracts:
+// that the port number is set, and the tags and access control scopes of the port.
+// Returns nil if the port is valid, or ValidationErrors listing every problem found.
+func (tp *TunnelPort) Validate() error {
+	if errs := tp.validate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (tp *TunnelPort) validate() (errs ValidationErrors) {
+	if tp.PortNumber == 0 {
+		return ValidationErrors{fmt.Errorf("port number must be set")}
+	}
+
+	owner := fmt.Sprintf("port %d", tp.PortNumber)
+	errs = append(errs, validateTags(owner, tp.Tags)...)
+	errs = append(errs, validateAccessControl(owner, tp.AccessControl)...)
+	return errs
+}
+
+func validateTags(owner string, tags []string) (errs ValidationErrors) {
+	for _, tag := range tags {
+		if !isValidTag(tag) {
+			errs = append(errs, fmt.Errorf("%s has invalid tag %q", owner, tag))
+		}
+	}
+	return errs
+}
+
+// isValidTag reports whether tag is non-empty and matches TunnelConstraintsTunnelTagRegex.
+func isValidTag(tag string) bool {
+	return TunnelConstraintsTunnelTagRegex.MatchString(tag)
+}
+
+func validateAccessControl(owner string, accessControl *TunnelAccessControl) (errs ValidationErrors) {
+	if accessControl == nil {
+		return nil
+	}
+	for i, entry := range accessControl.Entries {
+		for _, scope := range entry.Scopes {
+			if !allScopes[TunnelAccessScope(scope)] {
+				errs = append(errs, fmt.Errorf("%s access control entry %d has invalid scope %q", owner, i, scope))
+			}
+		}
+	}
+	return errs
+}
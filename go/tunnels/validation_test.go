@@ -0,0 +1,97 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT license.
+
+package tunnels
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateGraphValid(t *testing.T) {
+	tunnel := &Tunnel{
+		Name: "my-tunnel",
+		Tags: []string{"tag1"},
+		Ports: []TunnelPort{
+			{PortNumber: 80, Protocol: string(TunnelProtocolHttp)},
+			{PortNumber: 22, Tags: []string{"ssh"}},
+		},
+		AccessControl: &TunnelAccessControl{
+			Entries: []TunnelAccessControlEntry{
+				{
+					Type:     TunnelAccessControlEntryTypeAnonymous,
+					Subjects: []string{},
+					Scopes:   []string{string(TunnelAccessScopeConnect)},
+				},
+			},
+		},
+	}
+	if err := ValidateGraph(tunnel); err != nil {
+		t.Errorf("expected a valid tunnel, got %v", err)
+	}
+}
+
+func TestValidateGraphDuplicatePorts(t *testing.T) {
+	tunnel := &Tunnel{
+		Ports: []TunnelPort{{PortNumber: 80}, {PortNumber: 443}, {PortNumber: 80}},
+	}
+	err := ValidateGraph(tunnel)
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), "duplicate port number 80") {
+		t.Errorf("expected a duplicate port error, got %v", err)
+	}
+}
+
+func TestValidateGraphAccessControlScopes(t *testing.T) {
+	tunnel := &Tunnel{
+		AccessControl: &TunnelAccessControl{
+			Entries: []TunnelAccessControlEntry{
+				{
+					Type:     TunnelAccessControlEntryTypeUsers,
+					Subjects: []string{"user"},
+					Scopes:   []string{string(TunnelAccessScopeConnect)},
+				},
+			},
+		},
+		Ports: []TunnelPort{
+			{
+				PortNumber: 80,
+				AccessControl: &TunnelAccessControl{
+					Entries: []TunnelAccessControlEntry{
+						{
+							Type:     TunnelAccessControlEntryTypeUsers,
+							Subjects: []string{"user"},
+							Scopes:   []string{"invalid"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	err := ValidateGraph(tunnel)
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), "port 80 access control entry 0 has invalid scope") {
+		t.Errorf("expected an invalid scope error, got %v", err)
+	}
+}
+
+func TestTunnelPortValidate(t *testing.T) {
+	if err := (&TunnelPort{}).Validate(); err == nil || !strings.Contains(err.Error(), "port number must be set") {
+		t.Errorf("expected a port number error, got %v", err)
+	}
+
+	port := &TunnelPort{PortNumber: 8080, Tags: []string{"bad tag"}}
+	err := port.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected 1 validation error, got %v", err)
+	}
+	if !strings.Contains(errs[0].Error(), `port 8080 has invalid tag "bad tag"`) {
+		t.Errorf("expected a tag error, got %q", errs[0].Error())
+	}
+
+	if err := (&TunnelPort{PortNumber: 8080, Tags: []string{"web"}}).Validate(); err != nil {
+		t.Errorf("expected a valid port, got %v", err)
+	}
+}